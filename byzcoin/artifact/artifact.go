@@ -0,0 +1,356 @@
+// Package artifact loads compiled solidity contracts so that they can be
+// deployed on the bvm.
+//
+// The following compiler outputs are supported:
+//
+//   - solc --combined-json abi,bin,bin-runtime,metadata
+//   - solcjs --abi / --bin, producing a <File>_sol_<Contract>.abi and .bin pair
+//   - truffle and hardhat artifact JSON files
+//
+// Every loader works on a FileSystem, so that contracts can be read from any
+// directory (Dir) or from files held in memory (MapFS).
+package artifact
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+)
+
+// FileSystem is where the compiler outputs are read from. The names are
+// slash-separated paths.
+type FileSystem interface {
+	ReadFile(name string) ([]byte, error)
+}
+
+// Dir is the directory of the operating system filesystem rooted at its
+// value.
+type Dir string
+
+// ReadFile reads the file name of the directory.
+func (d Dir) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(string(d), filepath.FromSlash(name)))
+}
+
+// MapFS is a filesystem held in memory, mapping names to file contents.
+type MapFS map[string][]byte
+
+// ReadFile returns the content of the file name.
+func (m MapFS) ReadFile(name string) ([]byte, error) {
+	buf, ok := m[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return buf, nil
+}
+
+// Artifact is a compiled solidity contract.
+type Artifact struct {
+	// Name of the contract
+	Name string
+	// ABI is the JSON description of the contract interface
+	ABI string
+	// Bytecode is the creation code, sent in the deployment transaction
+	Bytecode []byte
+	// DeployedBytecode is the runtime code stored at the contract address
+	// once deployed. It is nil if the compiler output does not contain it.
+	DeployedBytecode []byte
+	// Source is the path of the solidity file the contract was compiled from
+	Source string
+	// Compiler is the compiler version, if known
+	Compiler string
+	// Metadata is the raw solc metadata JSON, if available
+	Metadata string
+}
+
+// ParseABI returns the parsed ABI of the artifact.
+func (a *Artifact) ParseABI() (abi.ABI, error) {
+	return abi.JSON(strings.NewReader(a.ABI))
+}
+
+// Load reads the contract called name from the file at p inside fsys. The
+// format is deduced from the file: a .abi or .bin file is read as a solcjs
+// pair, a JSON file is read as combined-json output if it has a "contracts"
+// map, and as a truffle/hardhat artifact otherwise. In combined-json output,
+// a contract defined in several sources is named by "<source>:<name>".
+func Load(fsys FileSystem, p string, name string) (*Artifact, error) {
+	switch path.Ext(p) {
+	case ".abi", ".bin":
+		a, err := LoadSolcjs(fsys, strings.TrimSuffix(p, path.Ext(p)))
+		if err != nil {
+			return nil, err
+		}
+		if name != "" && a.Name != name {
+			return nil, fmt.Errorf("%s: contains %s and not %s", p, a.Name, name)
+		}
+		return a, nil
+	case ".json":
+	default:
+		return nil, fmt.Errorf("%s: unknown artifact format", p)
+	}
+	buf, err := fsys.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(buf, &probe); err != nil {
+		return nil, fmt.Errorf("%s: %v", p, err)
+	}
+	if _, ok := probe["contracts"]; ok {
+		all, err := parseCombinedJSON(buf)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", p, err)
+		}
+		return find(all, name)
+	}
+	a, err := parseTruffle(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", p, err)
+	}
+	if name != "" && a.Name != name {
+		return nil, fmt.Errorf("%s: contains %s and not %s", p, a.Name, name)
+	}
+	return a, nil
+}
+
+// LoadFile is like Load but reads from the operating system filesystem.
+func LoadFile(p string, name string) (*Artifact, error) {
+	dir, file := filepath.Split(p)
+	if dir == "" {
+		dir = "."
+	}
+	return Load(Dir(dir), file, name)
+}
+
+// LoadSolcjs reads the <prefix>.abi and <prefix>.bin files written by solcjs.
+// solcjs names them <File>_sol_<Contract>, the contract name is taken from
+// the part after the last "_sol_".
+func LoadSolcjs(fsys FileSystem, prefix string) (*Artifact, error) {
+	abiBuf, err := fsys.ReadFile(prefix + ".abi")
+	if err != nil {
+		return nil, fmt.Errorf("reading contract ABI: %v", err)
+	}
+	binBuf, err := fsys.ReadFile(prefix + ".bin")
+	if err != nil {
+		return nil, fmt.Errorf("reading contract bytecode: %v", err)
+	}
+	bytecode, err := decodeHex(string(binBuf))
+	if err != nil {
+		return nil, fmt.Errorf("%s.bin: %v", prefix, err)
+	}
+	if len(bytecode) == 0 {
+		return nil, fmt.Errorf("%s.bin: no bytecode, the contract is abstract or an interface", prefix)
+	}
+	a := &Artifact{
+		Name:     path.Base(prefix),
+		ABI:      strings.TrimSpace(string(abiBuf)),
+		Bytecode: bytecode,
+	}
+	if i := strings.LastIndex(a.Name, "_sol_"); i >= 0 {
+		a.Source = a.Name[:i] + ".sol"
+		a.Name = a.Name[i+len("_sol_"):]
+	}
+	return a, nil
+}
+
+// LoadCombinedJSON reads all contracts of a solc --combined-json output. The
+// returned map is indexed by "<source>:<name>", and also by name when no other
+// source defines a contract with the same name.
+func LoadCombinedJSON(fsys FileSystem, p string) (map[string]*Artifact, error) {
+	buf, err := fsys.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	all, err := parseCombinedJSON(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", p, err)
+	}
+	return all, nil
+}
+
+// LoadTruffle reads a truffle or hardhat artifact.
+func LoadTruffle(fsys FileSystem, p string) (*Artifact, error) {
+	buf, err := fsys.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	a, err := parseTruffle(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", p, err)
+	}
+	return a, nil
+}
+
+type combinedJSON struct {
+	Contracts map[string]struct {
+		ABI        json.RawMessage `json:"abi"`
+		Bin        string          `json:"bin"`
+		BinRuntime string          `json:"bin-runtime"`
+		Metadata   string          `json:"metadata"`
+	} `json:"contracts"`
+	Version string `json:"version"`
+}
+
+func parseCombinedJSON(buf []byte) (map[string]*Artifact, error) {
+	var out combinedJSON
+	if err := json.Unmarshal(buf, &out); err != nil {
+		return nil, err
+	}
+	all := map[string]*Artifact{}
+	byName := map[string][]*Artifact{}
+	for id, c := range out.Contracts {
+		// Contracts are indexed by "<source>:<name>"
+		source, name := "", id
+		if i := strings.LastIndex(id, ":"); i >= 0 {
+			source, name = id[:i], id[i+1:]
+		}
+		abiJSON, err := rawABI(c.ABI)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", id, err)
+		}
+		bytecode, err := decodeHex(c.Bin)
+		if err != nil {
+			return nil, fmt.Errorf("%s: bin: %v", id, err)
+		}
+		if len(bytecode) == 0 {
+			return nil, fmt.Errorf("%s: no bytecode, the contract is abstract or an interface", id)
+		}
+		deployed, err := decodeHex(c.BinRuntime)
+		if err != nil {
+			return nil, fmt.Errorf("%s: bin-runtime: %v", id, err)
+		}
+		a := &Artifact{
+			Name:             name,
+			ABI:              abiJSON,
+			Bytecode:         bytecode,
+			DeployedBytecode: deployed,
+			Source:           source,
+			Compiler:         out.Version,
+			Metadata:         c.Metadata,
+		}
+		all[id] = a
+		byName[name] = append(byName[name], a)
+	}
+	// The bare name is only a key when it is not ambiguous
+	for name, as := range byName {
+		if _, ok := all[name]; !ok && len(as) == 1 {
+			all[name] = as[0]
+		}
+	}
+	return all, nil
+}
+
+type truffleJSON struct {
+	ContractName     string          `json:"contractName"`
+	ABI              json.RawMessage `json:"abi"`
+	Bytecode         string          `json:"bytecode"`
+	DeployedBytecode string          `json:"deployedBytecode"`
+	// truffle
+	SourcePath string `json:"sourcePath"`
+	Metadata   string `json:"metadata"`
+	Compiler   struct {
+		Version string `json:"version"`
+	} `json:"compiler"`
+	// hardhat
+	SourceName string `json:"sourceName"`
+}
+
+func parseTruffle(buf []byte) (*Artifact, error) {
+	var out truffleJSON
+	if err := json.Unmarshal(buf, &out); err != nil {
+		return nil, err
+	}
+	if out.ContractName == "" {
+		return nil, errors.New("not a truffle or hardhat artifact")
+	}
+	abiJSON, err := rawABI(out.ABI)
+	if err != nil {
+		return nil, err
+	}
+	bytecode, err := decodeHex(out.Bytecode)
+	if err != nil {
+		return nil, fmt.Errorf("bytecode: %v", err)
+	}
+	deployed, err := decodeHex(out.DeployedBytecode)
+	if err != nil {
+		return nil, fmt.Errorf("deployedBytecode: %v", err)
+	}
+	a := &Artifact{
+		Name:             out.ContractName,
+		ABI:              abiJSON,
+		Bytecode:         bytecode,
+		DeployedBytecode: deployed,
+		Source:           out.SourcePath,
+		Compiler:         out.Compiler.Version,
+		Metadata:         out.Metadata,
+	}
+	if a.Source == "" {
+		a.Source = out.SourceName
+	}
+	return a, nil
+}
+
+// rawABI returns the ABI as a JSON string. Older solc versions store the ABI
+// as a string containing JSON, newer ones and truffle store it directly.
+func rawABI(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 {
+		return "", errors.New("missing abi")
+	}
+	if raw[0] == '"' {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return "", err
+		}
+		return s, nil
+	}
+	return string(raw), nil
+}
+
+// decodeHex decodes the hex bytecode, with or without the 0x prefix. Unlinked
+// library placeholders (__Library__) are reported as errors.
+func decodeHex(s string) ([]byte, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "0x")
+	if s == "" {
+		return nil, nil
+	}
+	if strings.Contains(s, "__") {
+		return nil, errors.New("bytecode contains unlinked library references")
+	}
+	return hex.DecodeString(s)
+}
+
+// find returns the contract called name, which is either a contract name or
+// "<source>:<name>". The name can be empty if there is a single contract.
+func find(all map[string]*Artifact, name string) (*Artifact, error) {
+	if a, ok := all[name]; ok {
+		return a, nil
+	}
+	// The map holds some contracts twice, under their name and their
+	// qualified name
+	var found []*Artifact
+	seen := map[*Artifact]bool{}
+	for _, a := range all {
+		if !seen[a] && (name == "" || a.Name == name) {
+			seen[a] = true
+			found = append(found, a)
+		}
+	}
+	switch {
+	case len(found) == 1:
+		return found[0], nil
+	case name == "":
+		return nil, fmt.Errorf("%d contracts found, a name must be given", len(found))
+	case len(found) == 0:
+		return nil, fmt.Errorf("contract %s not found", name)
+	default:
+		return nil, fmt.Errorf("contract %s is defined in %d sources, use <source>:%s", name, len(found), name)
+	}
+}
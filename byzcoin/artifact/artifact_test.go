@@ -0,0 +1,121 @@
+package artifact
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testABI = `[{"constant":true,"inputs":[],"name":"get","outputs":[{"name":"","type":"uint256"}],"payable":false,"stateMutability":"view","type":"function"}]`
+
+// TestLoadSolcjs loads one of the contracts shipped in the contracts folder
+func TestLoadSolcjs(t *testing.T) {
+	a, err := LoadSolcjs(Dir("../contracts"), "MinimumToken/MinimumToken_sol_MinimumToken")
+	require.Nil(t, err)
+	require.Equal(t, "MinimumToken", a.Name)
+	require.Equal(t, "MinimumToken.sol", a.Source)
+	require.NotEmpty(t, a.Bytecode)
+	require.Nil(t, a.DeployedBytecode)
+	abi, err := a.ParseABI()
+	require.Nil(t, err)
+	_, ok := abi.Methods["transferFrom"]
+	require.True(t, ok)
+
+	_, err = LoadSolcjs(Dir("../contracts"), "MinimumToken/Missing")
+	require.NotNil(t, err)
+
+	// The name must match the contract of a solcjs pair
+	a, err = Load(Dir("../contracts"), "MinimumToken/MinimumToken_sol_MinimumToken.abi", "MinimumToken")
+	require.Nil(t, err)
+	require.Equal(t, "MinimumToken", a.Name)
+	_, err = Load(Dir("../contracts"), "MinimumToken/MinimumToken_sol_MinimumToken.bin", "LoanContract")
+	require.NotNil(t, err)
+
+	// An empty .bin, as written for interfaces, is not a deployable contract
+	_, err = LoadSolcjs(Dir("../contracts"), "LoanContract/ERC20Token_sol_ERC20Token")
+	require.NotNil(t, err)
+}
+
+func TestLoadCombinedJSON(t *testing.T) {
+	fsys := MapFS{
+		"combined.json": []byte(`{"contracts":{"Store.sol:Store":{"abi":` +
+			`"[{\"constant\":true,\"inputs\":[],\"name\":\"get\",\"outputs\":[],\"payable\":false,\"type\":\"function\"}]",` +
+			`"bin":"6080","bin-runtime":"6001","metadata":"{}"}},"version":"0.4.24"}`),
+	}
+	all, err := LoadCombinedJSON(fsys, "combined.json")
+	require.Nil(t, err)
+	a, ok := all["Store"]
+	require.True(t, ok)
+	require.Equal(t, "Store.sol", a.Source)
+	require.Equal(t, "0.4.24", a.Compiler)
+	require.Equal(t, []byte{0x60, 0x80}, a.Bytecode)
+	require.Equal(t, []byte{0x60, 0x01}, a.DeployedBytecode)
+	_, err = a.ParseABI()
+	require.Nil(t, err)
+
+	a, err = Load(fsys, "combined.json", "Store")
+	require.Nil(t, err)
+	require.Equal(t, "Store", a.Name)
+	_, err = Load(fsys, "combined.json", "Other")
+	require.NotNil(t, err)
+
+	// An interface has no bytecode to deploy
+	fsys["interface.json"] = []byte(`{"contracts":{"IStore.sol:IStore":{"abi":"[]","bin":"","bin-runtime":""}}}`)
+	_, err = LoadCombinedJSON(fsys, "interface.json")
+	require.NotNil(t, err)
+}
+
+// TestLoadCombinedJSONQualified resolves contracts with the same name in
+// different sources by their qualified name
+func TestLoadCombinedJSONQualified(t *testing.T) {
+	fsys := MapFS{
+		"combined.json": []byte(`{"contracts":{` +
+			`"a/Store.sol:Store":{"abi":"[]","bin":"6080"},` +
+			`"b/Store.sol:Store":{"abi":"[]","bin":"6081"},` +
+			`"b/Store.sol:Other":{"abi":"[]","bin":"6082"}}}`),
+	}
+	all, err := LoadCombinedJSON(fsys, "combined.json")
+	require.Nil(t, err)
+	_, ok := all["Store"]
+	require.False(t, ok)
+	require.Equal(t, []byte{0x60, 0x81}, all["b/Store.sol:Store"].Bytecode)
+	require.Equal(t, all["Other"], all["b/Store.sol:Other"])
+
+	a, err := Load(fsys, "combined.json", "a/Store.sol:Store")
+	require.Nil(t, err)
+	require.Equal(t, "Store", a.Name)
+	require.Equal(t, "a/Store.sol", a.Source)
+	require.Equal(t, []byte{0x60, 0x80}, a.Bytecode)
+	a, err = Load(fsys, "combined.json", "Other")
+	require.Nil(t, err)
+	require.Equal(t, []byte{0x60, 0x82}, a.Bytecode)
+
+	// The bare name is ambiguous
+	_, err = Load(fsys, "combined.json", "Store")
+	require.NotNil(t, err)
+	_, err = Load(fsys, "combined.json", "")
+	require.NotNil(t, err)
+}
+
+func TestLoadTruffle(t *testing.T) {
+	fsys := MapFS{
+		"truffle.json": []byte(`{"contractName":"Store","abi":` + testABI +
+			`,"bytecode":"0x6080","deployedBytecode":"0x6001","sourcePath":"/src/Store.sol","compiler":{"version":"0.4.24"}}`),
+		"hardhat.json": []byte(`{"_format":"hh-sol-artifact-1","contractName":"Store","sourceName":"contracts/Store.sol","abi":` + testABI +
+			`,"bytecode":"0x6080","deployedBytecode":"0x6001"}`),
+		"linked.json": []byte(`{"contractName":"Store","abi":[],"bytecode":"0x60__Lib______________________________________"}`),
+	}
+	a, err := Load(fsys, "truffle.json", "")
+	require.Nil(t, err)
+	require.Equal(t, "/src/Store.sol", a.Source)
+	require.Equal(t, "0.4.24", a.Compiler)
+	require.Equal(t, []byte{0x60, 0x01}, a.DeployedBytecode)
+
+	a, err = LoadTruffle(fsys, "hardhat.json")
+	require.Nil(t, err)
+	require.Equal(t, "contracts/Store.sol", a.Source)
+	require.Equal(t, []byte{0x60, 0x80}, a.Bytecode)
+
+	_, err = LoadTruffle(fsys, "linked.json")
+	require.NotNil(t, err)
+}
@@ -0,0 +1,106 @@
+package byzcoin
+
+import (
+	"encoding/json"
+	"math/big"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+// Backend is a bvm instance that transactions can be sent to and queried
+// from. It is implemented by the Client, talking to a ledger, and by the
+// SimulatedBackend, running the bvm in the process.
+type Backend interface {
+	NonceSource
+	EstimateGas(from common.Address, to *common.Address, value *big.Int, data []byte) (uint64, error)
+	GetReceipt(txHash common.Hash) (*Receipt, error)
+	GetLogs(filter LogFilter) ([]*types.Log, error)
+	StreamReceipts(filter LogFilter, handler func(*Receipt, []*types.Log, error)) error
+	TraceTransaction(txHash common.Hash, cfg vm.LogConfig) (*TraceResult, error)
+	TraceCalls(txHash common.Hash) (*CallFrame, error)
+	ProfileGas(txHashes []common.Hash, abis ...abi.ABI) (*GasProfile, error)
+	AddInvariant(inv Invariant) error
+	RemoveInvariant(address common.Address, name string) error
+	Bind(key *Key) error
+	Unbind(address common.Address) error
+	EnforceBindings(enforce bool) error
+	ApproveCode(code ApprovedCode) error
+	RevokeCode(codeHash common.Hash) error
+	EnforceApprovedCode(enforce bool) error
+	RegisterContract(name string, deployTx common.Hash, abi string, sourceHash common.Hash) error
+	UnregisterContract(name string) error
+	LookupContract(name string) (*RegisteredContract, error)
+	Contracts() ([]RegisteredContract, error)
+	Deploy(key *Key, bytecode []byte, value *big.Int) (common.Address, *types.Transaction, error)
+	Transact(key *Key, to common.Address, value *big.Int, data []byte) (*types.Transaction, error)
+	SendTx(signedTx *types.Transaction) error
+}
+
+var (
+	_ Backend = (*Client)(nil)
+	_ Backend = (*SimulatedBackend)(nil)
+)
+
+// txParams are the parameters of the transactions created by a backend.
+type txParams struct {
+	nonces   *NonceManager
+	gasLimit uint64
+	gasPrice *big.Int
+}
+
+// sendTransaction creates the transaction with the next nonce of key, signs
+// it and sends it to b. The nonce manager is told whether the transaction
+// got in. If the transaction is included but reverted, it is returned with
+// a *RevertError.
+func sendTransaction(b Backend, p txParams, key *Key, to *common.Address, value *big.Int, data []byte) (*types.Transaction, error) {
+	if value == nil {
+		value = big.NewInt(0)
+	}
+	nonce, err := p.nonces.Next(key.Address)
+	if err != nil {
+		return nil, err
+	}
+	var tx *types.Transaction
+	if to == nil {
+		tx = types.NewContractCreation(nonce, value, p.gasLimit, p.gasPrice, data)
+	} else {
+		tx = types.NewTransaction(nonce, *to, value, p.gasLimit, p.gasPrice, data)
+	}
+	signedTx, err := key.SignTx(tx)
+	if err != nil {
+		p.nonces.Reject(key.Address, nonce)
+		return nil, err
+	}
+	err = b.SendTx(signedTx)
+	if err != nil {
+		p.nonces.Reject(key.Address, nonce)
+		return nil, err
+	}
+	p.nonces.Confirm(key.Address, nonce)
+
+	// A reverted transaction is included and uses its nonce, the revert
+	// reason is read from its receipt.
+	r, err := b.GetReceipt(signedTx.Hash())
+	if err != nil {
+		return nil, err
+	}
+	if r.Status == types.ReceiptStatusFailed {
+		return signedTx, r.RevertError()
+	}
+	return signedTx, nil
+}
+
+// invariantArgs returns the arguments of the invariant instruction.
+func invariantArgs(inv Invariant, remove bool) byzcoin.Arguments {
+	// An Invariant always encodes
+	buf, _ := json.Marshal(inv)
+	args := byzcoin.Arguments{{Name: "invariant", Value: buf}}
+	if remove {
+		args = append(args, byzcoin.Argument{Name: "remove", Value: []byte{1}})
+	}
+	return args
+}
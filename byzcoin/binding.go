@@ -0,0 +1,191 @@
+package byzcoin
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Bindings link Ethereum addresses to darc identities. The bind instruction
+// binds an address to the first signer of the instruction, it carries the
+// signature by the key of the address of BindingHash, so that nobody can
+// claim the address of someone else. A binding is removed by the bind
+// instruction with the remove argument, signed by the bound identity.
+//
+// The bindings are kept in the memory database of the bvm, like the
+// invariants. Once enforced with the enforceBindings instruction, the
+// sender of every transaction must be bound to a signer of the byzcoin
+// instruction carrying it.
+
+var bindingsKey = []byte("bvm-bindings")
+
+// bindings is the registry of the bindings of a bvm instance.
+type bindings struct {
+	Enforce   bool                      `json:"enforce"`
+	Addresses map[common.Address]string `json:"addresses"`
+}
+
+// BindingHash returns the hash signed by the key of an address to bind it
+// to identity in the bvm instance instID.
+func BindingHash(instID byzcoin.InstanceID, identity string) []byte {
+	return crypto.Keccak256([]byte("bvm binding"), instID.Slice(), []byte(identity))
+}
+
+// bind binds address to the first signer of inst, if signature is the
+// signature of BindingHash by the key of address.
+func bind(memdb *MemDatabase, inst byzcoin.Instruction, address common.Address, signature []byte) error {
+	if len(inst.SignerIdentities) == 0 {
+		return errors.New("the instruction has no signer")
+	}
+	identity := inst.SignerIdentities[0].String()
+	public, err := crypto.SigToPub(BindingHash(inst.InstanceID, identity), signature)
+	if err != nil {
+		return err
+	}
+	if crypto.PubkeyToAddress(*public) != address {
+		return errors.New("the signature is not made by the key of " + address.Hex())
+	}
+	b, err := getBindings(memdb)
+	if err != nil {
+		return err
+	}
+	b.Addresses[address] = identity
+	return putBindings(memdb, b)
+}
+
+// unbind removes the binding of address, if one of the signers of inst is
+// the bound identity.
+func unbind(memdb *MemDatabase, inst byzcoin.Instruction, address common.Address) error {
+	b, err := getBindings(memdb)
+	if err != nil {
+		return err
+	}
+	identity, ok := b.Addresses[address]
+	if !ok {
+		return errors.New(address.Hex() + " is not bound")
+	}
+	if !signedBy(inst, identity) {
+		return errors.New("only " + identity + " can remove the binding of " + address.Hex())
+	}
+	delete(b.Addresses, address)
+	return putBindings(memdb, b)
+}
+
+// enforceBindings turns the enforcement of the bindings on or off.
+func enforceBindings(memdb *MemDatabase, enforce bool) error {
+	b, err := getBindings(memdb)
+	if err != nil {
+		return err
+	}
+	b.Enforce = enforce
+	return putBindings(memdb, b)
+}
+
+// checkBinding returns an error if the bindings are enforced and the sender
+// of tx is not bound to a signer of inst.
+func checkBinding(memdb *MemDatabase, inst byzcoin.Instruction, tx *types.Transaction) error {
+	b, err := getBindings(memdb)
+	if err != nil || !b.Enforce {
+		return err
+	}
+	sender, err := txSender(tx)
+	if err != nil {
+		return err
+	}
+	identity, ok := b.Addresses[sender]
+	if !ok {
+		return errors.New("the sender " + sender.Hex() + " is not bound to a darc identity")
+	}
+	if !signedBy(inst, identity) {
+		return errors.New("the sender " + sender.Hex() + " is bound to " + identity + ", which didn't sign the instruction")
+	}
+	return nil
+}
+
+// txSender returns the sender of tx.
+func txSender(tx *types.Transaction) (common.Address, error) {
+	return types.Sender(types.MakeSigner(getChainConfig(), getHeader(DefaultGasLimits).Number), tx)
+}
+
+// boundIdentity returns the identity address is bound to, or the empty
+// string.
+func boundIdentity(memdb *MemDatabase, address common.Address) (string, error) {
+	b, err := getBindings(memdb)
+	if err != nil {
+		return "", err
+	}
+	return b.Addresses[address], nil
+}
+
+// signedBy tells whether identity is one of the signers of inst.
+func signedBy(inst byzcoin.Instruction, identity string) bool {
+	for _, id := range inst.SignerIdentities {
+		if id.String() == identity {
+			return true
+		}
+	}
+	return false
+}
+
+func getBindings(memdb *MemDatabase) (*bindings, error) {
+	b := &bindings{Addresses: map[common.Address]string{}}
+	ok, err := memdb.Has(bindingsKey)
+	if err != nil || !ok {
+		return b, err
+	}
+	buf, err := memdb.Get(bindingsKey)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(buf, b)
+	if err != nil {
+		return nil, err
+	}
+	if b.Addresses == nil {
+		b.Addresses = map[common.Address]string{}
+	}
+	return b, nil
+}
+
+func putBindings(memdb *MemDatabase, b *bindings) error {
+	buf, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	return memdb.Put(bindingsKey, buf)
+}
+
+// bindArgs returns the arguments of the bind instruction binding the
+// address of key to identity in the bvm instance instID.
+func bindArgs(instID byzcoin.InstanceID, identity string, key *Key) (byzcoin.Arguments, error) {
+	signature, err := crypto.Sign(BindingHash(instID, identity), key.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	return byzcoin.Arguments{
+		{Name: "address", Value: []byte(key.Address.Hex())},
+		{Name: "signature", Value: signature},
+	}, nil
+}
+
+// unbindArgs returns the arguments of the bind instruction removing the
+// binding of address.
+func unbindArgs(address common.Address) byzcoin.Arguments {
+	return byzcoin.Arguments{
+		{Name: "address", Value: []byte(address.Hex())},
+		{Name: "remove", Value: []byte{1}},
+	}
+}
+
+// enforceArgs returns the arguments of the enforceBindings and
+// enforceApprovedCode instructions.
+func enforceArgs(enforce bool) byzcoin.Arguments {
+	if enforce {
+		return byzcoin.Arguments{{Name: "enforce", Value: []byte{1}}}
+	}
+	return byzcoin.Arguments{{Name: "enforce", Value: []byte{0}}}
+}
@@ -0,0 +1,59 @@
+package byzcoin
+
+import (
+	"testing"
+
+	"github.com/dedis/cothority/darc"
+	"github.com/stretchr/testify/require"
+)
+
+//Binds addresses to darc identities and enforces the bindings
+func TestBindings(t *testing.T) {
+	sb, keyA := newFundedBackend(t)
+	defer sb.Close()
+
+	_, privateB := GenerateKeys()
+	keyB := NewKeyFromECDSA(privateB)
+	require.Nil(t, sb.Deposit(5, keyB.Address))
+
+	//Without enforcement any sender can transact
+	_, err := sb.Transact(keyA, keyB.Address, nil, nil)
+	require.Nil(t, err)
+
+	require.Nil(t, sb.Bind(keyA))
+	identity, err := sb.BoundIdentity(keyA.Address)
+	require.Nil(t, err)
+	require.Equal(t, sb.Signer.Identity().String(), identity)
+
+	//The signature must be made by the key of the address
+	args, err := bindArgs(sb.InstanceID, sb.Signer.Identity().String(), keyB)
+	require.Nil(t, err)
+	args[0].Value = []byte(keyA.Address.Hex())
+	require.NotNil(t, sb.Invoke("bind", args))
+
+	require.Nil(t, sb.EnforceBindings(true))
+	_, err = sb.Transact(keyA, keyB.Address, nil, nil)
+	require.Nil(t, err)
+	//B is not bound
+	_, err = sb.Transact(keyB, keyA.Address, nil, nil)
+	require.NotNil(t, err)
+
+	//A is not bound to another signer
+	signer := sb.Signer
+	sb.Signer = darc.NewSignerEd25519(nil, nil)
+	_, err = sb.Transact(keyA, keyB.Address, nil, nil)
+	require.NotNil(t, err)
+	require.NotNil(t, sb.Unbind(keyA.Address))
+	sb.Signer = signer
+
+	require.Nil(t, sb.Unbind(keyA.Address))
+	identity, err = sb.BoundIdentity(keyA.Address)
+	require.Nil(t, err)
+	require.Equal(t, "", identity)
+	_, err = sb.Transact(keyA, keyB.Address, nil, nil)
+	require.NotNil(t, err)
+
+	require.Nil(t, sb.EnforceBindings(false))
+	_, err = sb.Transact(keyA, keyB.Address, nil, nil)
+	require.Nil(t, err)
+}
@@ -0,0 +1,311 @@
+// The bvm command queries the bvm instances of a ByzCoin ledger. The ledger
+// is given by a configuration file written by bcadmin.
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/byzcoin/bcadmin/lib"
+	"github.com/dedis/onet/log"
+	bvm "github.com/dedis/student_18_hugo_verex/byzcoin"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"gopkg.in/urfave/cli.v1"
+)
+
+var cmds = cli.Commands{
+	{
+		Name:  "trace",
+		Usage: "replay bvm transactions",
+		Subcommands: cli.Commands{
+			{
+				Name:      "calls",
+				Usage:     "show the call tree of a transaction",
+				ArgsUsage: "txhash",
+				Flags: []cli.Flag{
+					cli.BoolFlag{
+						Name:  "json",
+						Usage: "print the call tree as JSON",
+					},
+				},
+				Action: traceCalls,
+			},
+		},
+	},
+	{
+		Name:      "profile",
+		Usage:     "show the gas used by a set of transactions, by function and by opcode",
+		ArgsUsage: "txhash...",
+		Flags: []cli.Flag{
+			cli.StringSliceFlag{
+				Name:  "abi",
+				Usage: "ABI file of a called contract, to name its functions",
+			},
+			cli.StringFlag{
+				Name:  "compare",
+				Usage: "JSON profile of a previous version to compare with",
+			},
+			cli.BoolFlag{
+				Name:  "json",
+				Usage: "print the profile as JSON",
+			},
+		},
+		Action: profile,
+	},
+	{
+		Name:  "contract",
+		Usage: "look up the registry of contracts",
+		Subcommands: cli.Commands{
+			{
+				Name:      "show",
+				Usage:     "show a registered contract",
+				ArgsUsage: "name",
+				Flags: []cli.Flag{
+					cli.BoolFlag{
+						Name:  "abi",
+						Usage: "only print the ABI of the contract",
+					},
+				},
+				Action: contractShow,
+			},
+			{
+				Name:   "list",
+				Usage:  "list the registered contracts",
+				Action: contractList,
+			},
+		},
+	},
+}
+
+var cliApp = cli.NewApp()
+
+func init() {
+	cliApp.Name = "bvm"
+	cliApp.Usage = "Query the bvm instances of a ByzCoin ledger."
+	cliApp.Version = "0.1"
+	cliApp.Commands = cmds
+	cliApp.Flags = []cli.Flag{
+		cli.IntFlag{
+			Name:  "debug, d",
+			Value: 0,
+			Usage: "debug-level: 1 for terse, 5 for maximal",
+		},
+		cli.StringFlag{
+			Name:   "bc",
+			EnvVar: "BC",
+			Usage:  "the ByzCoin config to use (required)",
+		},
+		cli.StringFlag{
+			Name:   "instid, i",
+			EnvVar: "BVM",
+			Usage:  "the instance ID of the bvm (required)",
+		},
+	}
+	cliApp.Before = func(c *cli.Context) error {
+		log.SetDebugVisible(c.Int("debug"))
+		return nil
+	}
+}
+
+func main() {
+	log.ErrFatal(cliApp.Run(os.Args))
+}
+
+// getClient returns a client for the bvm instance given by the global flags.
+func getClient(c *cli.Context) (*bvm.Client, error) {
+	bcArg := c.GlobalString("bc")
+	if bcArg == "" {
+		return nil, errors.New("--bc flag is required")
+	}
+	_, cl, err := lib.LoadConfig(bcArg)
+	if err != nil {
+		return nil, err
+	}
+	instID, err := hex.DecodeString(c.GlobalString("instid"))
+	if err != nil || len(instID) != 32 {
+		return nil, errors.New("--instid must be the 32 bytes ID of the bvm instance, in hex")
+	}
+	return bvm.NewClient(cl, byzcoin.NewInstanceID(instID), nil), nil
+}
+
+func traceCalls(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errors.New("please give the hash of the transaction")
+	}
+	cl, err := getClient(c)
+	if err != nil {
+		return err
+	}
+	tree, err := cl.TraceCalls(common.HexToHash(c.Args().First()))
+	if err != nil {
+		return err
+	}
+	if c.Bool("json") {
+		buf, err := json.MarshalIndent(tree, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(c.App.Writer, string(buf))
+		return nil
+	}
+	printFrame(c.App.Writer, tree, 0)
+	return nil
+}
+
+func profile(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return errors.New("please give the hashes of the transactions")
+	}
+	var abis []abi.ABI
+	for _, file := range c.StringSlice("abi") {
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		contractAbi, err := abi.JSON(bytes.NewReader(buf))
+		if err != nil {
+			return fmt.Errorf("couldn't parse %s: %v", file, err)
+		}
+		abis = append(abis, contractAbi)
+	}
+	var txHashes []common.Hash
+	for _, arg := range c.Args() {
+		txHashes = append(txHashes, common.HexToHash(arg))
+	}
+	cl, err := getClient(c)
+	if err != nil {
+		return err
+	}
+	p, err := cl.ProfileGas(txHashes, abis...)
+	if err != nil {
+		return err
+	}
+
+	if file := c.String("compare"); file != "" {
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		before := bvm.NewGasProfile()
+		err = json.Unmarshal(buf, before)
+		if err != nil {
+			return fmt.Errorf("couldn't parse %s: %v", file, err)
+		}
+		for _, d := range bvm.CompareGasProfiles(before, p) {
+			fmt.Fprintf(c.App.Writer, "%-8s %-24s %10d %10d %+10d\n", d.Kind, label(d.Key, d.Name), d.Before, d.After, d.Delta())
+		}
+		return nil
+	}
+	if c.Bool("json") {
+		buf, err := json.MarshalIndent(p, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(c.App.Writer, string(buf))
+		return nil
+	}
+
+	fmt.Fprintf(c.App.Writer, "%d transactions, %d gas\n\n", p.Transactions, p.GasUsed)
+	fmt.Fprintf(c.App.Writer, "%-24s %6s %6s %10s %10s %10s\n", "function", "calls", "failed", "average", "min", "max")
+	keys := []string{}
+	for key := range p.Functions {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return p.Functions[keys[i]].GasUsed > p.Functions[keys[j]].GasUsed })
+	for _, key := range keys {
+		f := p.Functions[key]
+		fmt.Fprintf(c.App.Writer, "%-24s %6d %6d %10d %10d %10d\n", label(key, f.Name), f.Calls, f.Failed, f.Average(), f.MinGas, f.MaxGas)
+	}
+	fmt.Fprintf(c.App.Writer, "\n%-24s %10s %10s\n", "opcode", "count", "gas")
+	keys = keys[:0]
+	for key := range p.Opcodes {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return p.Opcodes[keys[i]].Gas > p.Opcodes[keys[j]].Gas })
+	for _, key := range keys {
+		fmt.Fprintf(c.App.Writer, "%-24s %10d %10d\n", key, p.Opcodes[key].Count, p.Opcodes[key].Gas)
+	}
+	return nil
+}
+
+func contractShow(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errors.New("please give the name of the contract")
+	}
+	cl, err := getClient(c)
+	if err != nil {
+		return err
+	}
+	rc, err := cl.LookupContract(c.Args().First())
+	if err != nil {
+		return err
+	}
+	if c.Bool("abi") {
+		fmt.Fprintln(c.App.Writer, rc.ABI)
+		return nil
+	}
+	fmt.Fprintln(c.App.Writer, "name:", rc.Name)
+	fmt.Fprintln(c.App.Writer, "address:", rc.Address.Hex())
+	fmt.Fprintln(c.App.Writer, "deployer:", rc.Deployer.Hex())
+	fmt.Fprintln(c.App.Writer, "deploy tx:", rc.DeployTx.Hex())
+	fmt.Fprintln(c.App.Writer, "source hash:", rc.SourceHash.Hex())
+	fmt.Fprintln(c.App.Writer, "owner:", rc.Owner)
+	return nil
+}
+
+func contractList(c *cli.Context) error {
+	cl, err := getClient(c)
+	if err != nil {
+		return err
+	}
+	contracts, err := cl.Contracts()
+	if err != nil {
+		return err
+	}
+	for _, rc := range contracts {
+		fmt.Fprintf(c.App.Writer, "%-24s %s\n", rc.Name, rc.Address.Hex())
+	}
+	return nil
+}
+
+// label returns the name of a function of a profile, or its key if it has
+// no name.
+func label(key, name string) string {
+	if name == "" || name == key {
+		return key
+	}
+	return name + " (" + key + ")"
+}
+
+// printFrame prints a frame of the call tree and its calls, indented by
+// their depth.
+func printFrame(w io.Writer, frame *bvm.CallFrame, depth int) {
+	line := fmt.Sprintf("%s%s %s -> %s gas=%d used=%d", strings.Repeat("  ", depth),
+		frame.Type, frame.From.Hex(), frame.To.Hex(), frame.Gas, frame.GasUsed)
+	if frame.Value != nil && frame.Value.ToInt().Sign() != 0 {
+		line += fmt.Sprintf(" value=%s", frame.Value.ToInt())
+	}
+	if len(frame.Input) >= 4 {
+		line += fmt.Sprintf(" selector=%x", []byte(frame.Input[:4]))
+	}
+	if len(frame.Output) > 0 {
+		line += fmt.Sprintf(" output=%x", []byte(frame.Output))
+	}
+	if frame.Error != "" {
+		line += " error: " + frame.Error
+	}
+	fmt.Fprintln(w, line)
+	for _, call := range frame.Calls {
+		printFrame(w, call, depth+1)
+	}
+}
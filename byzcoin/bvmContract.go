@@ -1,7 +1,10 @@
 package byzcoin
 
 import (
+	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/dedis/cothority/byzcoin"
 	"github.com/dedis/cothority/darc"
 	"github.com/dedis/onet/log"
@@ -10,6 +13,8 @@ import (
 	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
 	"math/big"
 )
 
@@ -17,6 +22,10 @@ import (
 var ContractBvmID = "bvm"
 var nilAddress = common.HexToAddress("0x0000000000000000000000000000000000000000")
 
+//faucetEnabled lets the credit instruction create ether out of nothing. Only the tests of the package enable it,
+//everywhere else ether only enters the bvm by depositing coins
+var faucetEnabled = false
+
 type contractBvm struct {
 	byzcoin.BasicContract
 	ES
@@ -59,7 +68,8 @@ func (c *contractBvm) Spawn(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruct
 	return
 }
 
-//Invoke provides three instructions : display, credit and transaction
+//Invoke provides ten instructions : display, credit, deposit, transaction, invariant, bind, enforceBindings, approveCode,
+//enforceApprovedCode and register
 func (c *contractBvm) Invoke(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, coins []byzcoin.Coin) (sc []byzcoin.StateChange, cout []byzcoin.Coin, err error) {
 	cout = coins
 	var darcID darc.ID
@@ -88,6 +98,9 @@ func (c *contractBvm) Invoke(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruc
 		return nil, nil, nil
 
 	case "credit":
+		if !faucetEnabled {
+			return nil, nil, errors.New("the credit faucet is disabled, deposit coins instead")
+		}
 		addressBuf := inst.Invoke.Args.Search("address")
 		if addressBuf == nil {
 			return nil, nil, errors.New("no address provided")
@@ -144,9 +157,47 @@ func (c *contractBvm) Invoke(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruc
 		if err != nil {
 			return nil, nil, err
 		}
-		transactionReceipt, err := sendTx(&ethTx, db)
+		//Contract creations need the deploy rule, if the darc of the instance has one
+		err = checkDeployRule(rst, inst, darcID, ethTx.To() == nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		//Once the bindings are enforced, the sender must be bound to a signer of the instruction
+		err = checkBinding(memdb, inst, &ethTx)
+		if err != nil {
+			return nil, nil, err
+		}
+		//Instances spawned before withdrawals existed get the system contract with their next transaction. The
+		//transaction is replayed on the state holding it, so that state is committed and kept as the pre-state
+		preStateRoot := es.RootHash
+		if installWithdraw(db) {
+			preStateRoot, err = commitState(db)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		//The transaction can't use more than the transaction limit, nor than what is left of the block budget
+		gas, err := availableGas(rst)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ethTx.Gas() > gas {
+			return nil, nil, fmt.Errorf("the gas limit of the transaction, %d, exceeds the %d gas available", ethTx.Gas(), gas)
+		}
+		//The contracts can read the instances of the ledger through the system contracts. The contracts touched by
+		//the transaction are recorded, their invariants are checked afterwards
+		touches := newTouchTracer()
+		config := getVMConfig()
+		config.Debug = true
+		config.Tracer = touches
+		transactionReceipt, _, err := applyTransaction(&ethTx, db, rst, config, gas)
+		if err != nil {
+			return nil, nil, err
+		}
+		//Keeps what is needed to replay the transaction
+		transactionReceipt.PreStateRoot = preStateRoot
+		err = storeTransaction(memdb, &ethTx)
 		if err != nil {
-			log.ErrFatal(err)
 			return nil, nil, err
 		}
 
@@ -155,7 +206,81 @@ func (c *contractBvm) Invoke(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruc
 		} else {
 			log.LLvl1("tx status:", transactionReceipt.Status, "(0/1 fail/success)", "gas used:", transactionReceipt.GasUsed, "tx receipt:", transactionReceipt.TxHash.Hex())
 		}
+		//With the approved code enforced, the code of every contract created by the transaction, directly or by
+		//another contract, must be in the registry. The contracts created by other contracts need the deploy rule too
+		if transactionReceipt.Status == types.ReceiptStatusSuccessful {
+			err = checkDeployRule(rst, inst, darcID, deployed(db, touches.created))
+			if err != nil {
+				return nil, nil, err
+			}
+			err = checkApprovedCode(memdb, db, touches.created)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		//A failed transaction doesn't change the contracts, their invariants still hold. The invariants use the
+		//gas left by the transaction, which the sender pays for
+		if transactionReceipt.Status == types.ReceiptStatusSuccessful {
+			violations, reject, invariantGas, err := checkInvariants(memdb, db, rst, touches.touched, ethTx.Gas()-transactionReceipt.GasUsed)
+			if err != nil {
+				return nil, nil, err
+			}
+			if reject != nil {
+				return nil, nil, *reject
+			}
+			for _, v := range violations {
+				log.LLvl1("tx", transactionReceipt.TxHash.Hex(), "breaks", v)
+			}
+			transactionReceipt.Violations = violations
+			err = chargeGas(db, &ethTx, transactionReceipt, invariantGas)
+			if err != nil {
+				return nil, nil, err
+			}
+			transactionReceipt.InvariantGas = invariantGas
+		}
+		//The ether sent to WithdrawAddress is burnt and credited to the coin instances
+		withdrawChanges, err := applyWithdrawals(rst, inst, memdb, db, withdrawals(transactionReceipt))
+		if err != nil {
+			return nil, nil, err
+		}
+		//The byzcoin instructions asked by the contracts are executed once the bvm state is saved
+		requests, err := instructionRequests(transactionReceipt)
+		if err != nil {
+			return nil, nil, err
+		}
+		//Like the invariants, the instructions are paid with the gas left by the transaction
+		if len(requests) > 0 {
+			gas := uint64(len(requests)) * instructionGas
+			if gas > ethTx.Gas()-transactionReceipt.GasUsed {
+				return nil, nil, errors.New("not enough gas left for the requested instructions")
+			}
+			err = chargeGas(db, &ethTx, transactionReceipt, gas)
+			if err != nil {
+				return nil, nil, err
+			}
+			transactionReceipt.InstructionGas = gas
+		}
+		if transactionReceipt.Status == types.ReceiptStatusFailed {
+			revertErr := transactionReceipt.RevertError()
+			log.LLvl1("tx", transactionReceipt.TxHash.Hex(), "failed:", revertErr)
+			//With abortOnRevert the whole byzcoin instruction fails, nothing is stored and the nonce is not used
+			if inst.Invoke.Args.Search("abortOnRevert") != nil {
+				return nil, nil, revertErr
+			}
+		}
+
+		//Indexes the logs by byzcoin block. GetIndex is the index of the last block applied to the trie, the
+		//transaction will be part of the next one
+		err = indexReceipt(memdb, uint64(rst.GetIndex()+1), transactionReceipt)
+		if err != nil {
+			return nil, nil, err
+		}
 
+		//Stores the receipt, with the revert reason if any
+		err = storeReceipt(memdb, transactionReceipt)
+		if err != nil {
+			return nil, nil, err
+		}
 
 		//Commits the general stateDb
 		es.RootHash, err = db.Commit(true)
@@ -184,44 +309,329 @@ func (c *contractBvm) Invoke(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruc
 			byzcoin.NewStateChange(byzcoin.Update, inst.InstanceID,
 				ContractBvmID, esBuf, darcID),
 		}
+		sc = append(sc, withdrawChanges...)
+		//The gas used, even by a failed transaction, is taken from the block budget, with the gas of the invariants
+		//and of the requested instructions
+		spent, err := spendGas(rst, transactionReceipt.GasUsed, darcID)
+		if err != nil {
+			return nil, nil, err
+		}
+		sc = append(sc, spent)
+		requested, returned, err := executeRequests(rst, inst, sc, transactionReceipt.TxHash, requests)
+		if err != nil {
+			return nil, nil, err
+		}
+		sc = append(sc, requested...)
+		//The coins returned by the instructions are not lost, they are returned with the ones of the instruction
+		cout = append(cout, returned...)
+	case "invariant":
+		//Adds, or removes with the remove argument, an invariant checked after every transaction
+		invBuf := inst.Invoke.Args.Search("invariant")
+		if invBuf == nil {
+			return nil, nil, errors.New("no invariant provided")
+		}
+		var inv Invariant
+		err = json.Unmarshal(invBuf, &inv)
+		if err != nil {
+			return nil, nil, err
+		}
+		memdb, db, err := getDB(es)
+		if err != nil {
+			return nil, nil, err
+		}
+		if inst.Invoke.Args.Search("remove") != nil {
+			err = removeInvariant(memdb, inv.Address, inv.Name)
+		} else {
+			err = addInvariant(memdb, inv)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		es, err = commitES(memdb, db)
+		if err != nil {
+			return nil, nil, err
+		}
+		esBuf, err := protobuf.Encode(&es)
+		if err != nil {
+			return nil, nil, err
+		}
+		sc = []byzcoin.StateChange{
+			byzcoin.NewStateChange(byzcoin.Update, inst.InstanceID,
+				ContractBvmID, esBuf, darcID),
+		}
+
+	case "deposit":
+		//Consumes the coins attached to the instruction and credits their value to the address
+		addressBuf := inst.Invoke.Args.Search("address")
+		if addressBuf == nil {
+			return nil, nil, errors.New("no address provided")
+		}
+		address := common.HexToAddress(string(addressBuf))
+		amount := uint64(0)
+		if amountBuf := inst.Invoke.Args.Search("coins"); amountBuf != nil {
+			if len(amountBuf) != 8 {
+				return nil, nil, errors.New("coins must be an 8 bytes little endian integer")
+			}
+			amount = binary.LittleEndian.Uint64(amountBuf)
+		}
+		wei, rest, err := depositCoins(coins, amount)
+		if err != nil {
+			return nil, nil, err
+		}
+		memdb, db, err := getDB(es)
+		if err != nil {
+			return nil, nil, err
+		}
+		db.AddBalance(address, wei)
+		log.LLvl1(address.Hex(), "deposited", wei, "wei")
+		//The deposited coins can be withdrawn later
+		err = addDeposited(memdb, new(big.Int).Div(wei, WeiPerCoin).Uint64())
+		if err != nil {
+			return nil, nil, err
+		}
+		es, err = commitES(memdb, db)
+		if err != nil {
+			return nil, nil, err
+		}
+		esBuf, err := protobuf.Encode(&es)
+		if err != nil {
+			return nil, nil, err
+		}
+		sc = []byzcoin.StateChange{
+			byzcoin.NewStateChange(byzcoin.Update, inst.InstanceID,
+				ContractBvmID, esBuf, darcID),
+		}
+		cout = rest
+
+	case "bind":
+		//Binds an Ethereum address to the signer of the instruction, or removes the binding with the remove argument
+		addressBuf := inst.Invoke.Args.Search("address")
+		if addressBuf == nil {
+			return nil, nil, errors.New("no address provided")
+		}
+		address := common.HexToAddress(string(addressBuf))
+		memdb, db, err := getDB(es)
+		if err != nil {
+			return nil, nil, err
+		}
+		if inst.Invoke.Args.Search("remove") != nil {
+			err = unbind(memdb, inst, address)
+		} else {
+			err = bind(memdb, inst, address, inst.Invoke.Args.Search("signature"))
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		es, err = commitES(memdb, db)
+		if err != nil {
+			return nil, nil, err
+		}
+		esBuf, err := protobuf.Encode(&es)
+		if err != nil {
+			return nil, nil, err
+		}
+		sc = []byzcoin.StateChange{
+			byzcoin.NewStateChange(byzcoin.Update, inst.InstanceID,
+				ContractBvmID, esBuf, darcID),
+		}
+
+	case "enforceBindings":
+		//With enforce set to 1, the senders of the transactions must be bound to a signer of the instruction
+		enforceBuf := inst.Invoke.Args.Search("enforce")
+		if len(enforceBuf) != 1 {
+			return nil, nil, errors.New("enforce must be 1 or 0")
+		}
+		memdb, db, err := getDB(es)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = enforceBindings(memdb, enforceBuf[0] == 1)
+		if err != nil {
+			return nil, nil, err
+		}
+		es, err = commitES(memdb, db)
+		if err != nil {
+			return nil, nil, err
+		}
+		esBuf, err := protobuf.Encode(&es)
+		if err != nil {
+			return nil, nil, err
+		}
+		sc = []byzcoin.StateChange{
+			byzcoin.NewStateChange(byzcoin.Update, inst.InstanceID,
+				ContractBvmID, esBuf, darcID),
+		}
+
+	case "approveCode":
+		//Adds, or removes with the remove argument, the provenance of verified code to the registry
+		codeBuf := inst.Invoke.Args.Search("code")
+		if codeBuf == nil {
+			return nil, nil, errors.New("no code provided")
+		}
+		var code ApprovedCode
+		err = json.Unmarshal(codeBuf, &code)
+		if err != nil {
+			return nil, nil, err
+		}
+		memdb, db, err := getDB(es)
+		if err != nil {
+			return nil, nil, err
+		}
+		if inst.Invoke.Args.Search("remove") != nil {
+			err = revokeCode(memdb, code.CodeHash)
+		} else {
+			err = approveCode(memdb, code)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		es, err = commitES(memdb, db)
+		if err != nil {
+			return nil, nil, err
+		}
+		esBuf, err := protobuf.Encode(&es)
+		if err != nil {
+			return nil, nil, err
+		}
+		sc = []byzcoin.StateChange{
+			byzcoin.NewStateChange(byzcoin.Update, inst.InstanceID,
+				ContractBvmID, esBuf, darcID),
+		}
+
+	case "enforceApprovedCode":
+		//With enforce set to 1, the contracts deployed by the transactions must have approved code
+		enforceBuf := inst.Invoke.Args.Search("enforce")
+		if len(enforceBuf) != 1 {
+			return nil, nil, errors.New("enforce must be 1 or 0")
+		}
+		memdb, db, err := getDB(es)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = enforceApprovedCode(memdb, enforceBuf[0] == 1)
+		if err != nil {
+			return nil, nil, err
+		}
+		es, err = commitES(memdb, db)
+		if err != nil {
+			return nil, nil, err
+		}
+		esBuf, err := protobuf.Encode(&es)
+		if err != nil {
+			return nil, nil, err
+		}
+		sc = []byzcoin.StateChange{
+			byzcoin.NewStateChange(byzcoin.Update, inst.InstanceID,
+				ContractBvmID, esBuf, darcID),
+		}
+
+	case "register":
+		//Names a contract deployed by a transaction of the instance, or removes the name with the remove argument
+		contractBuf := inst.Invoke.Args.Search("contract")
+		if contractBuf == nil {
+			return nil, nil, errors.New("no contract provided")
+		}
+		var rc RegisteredContract
+		err = json.Unmarshal(contractBuf, &rc)
+		if err != nil {
+			return nil, nil, err
+		}
+		memdb, db, err := getDB(es)
+		if err != nil {
+			return nil, nil, err
+		}
+		if inst.Invoke.Args.Search("remove") != nil {
+			err = unregisterContract(memdb, inst, rc.Name)
+		} else {
+			err = registerContract(memdb, db, inst, rc)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		es, err = commitES(memdb, db)
+		if err != nil {
+			return nil, nil, err
+		}
+		esBuf, err := protobuf.Encode(&es)
+		if err != nil {
+			return nil, nil, err
+		}
+		sc = []byzcoin.StateChange{
+			byzcoin.NewStateChange(byzcoin.Update, inst.InstanceID,
+				ContractBvmID, esBuf, darcID),
+		}
+
 	default :
-		err = errors.New("Contract can only display, credit and receive transactions")
+		err = errors.New("Contract can only display, credit, deposit, receive transactions, manage invariants, bind addresses, approve code and register contracts")
 		return
 
 	}
 	return
 }
 
-//sendTx is a helper function that applies the signed transaction to the EVM
-func sendTx(tx *types.Transaction, db *state.StateDB) (*types.Receipt, error){
+//sendTx is a helper function that applies the signed transaction to the EVM, with the transaction gas limit. The
+//system contracts reading the ledger fail, as no state trie is given
+func sendTx(tx *types.Transaction, db *state.StateDB) (*Receipt, error){
+	receipt, _, err := applyTransaction(tx, db, nil, getVMConfig(), DefaultGasLimits.Transaction)
+	return receipt, err
+}
+
+//applyTransaction does the same as core.ApplyTransaction, but keeps the data returned by the execution so that the
+//revert reason can be decoded. It also takes the state trie read by the system contracts, the vm configuration, so
+//that the execution can be traced, and the gas available to the transaction, whose gas limit can't be higher.
+func applyTransaction(tx *types.Transaction, db *state.StateDB, rst byzcoin.ReadOnlyStateTrie, config vm.Config, gas uint64) (*Receipt, []byte, error){
 
 	//get parameters defined in params
 	chainconfig := getChainConfig()
-	config := getVMConfig()
 
 	// GasPool tracks the amount of gas available during execution of the transactions in a block.
-	gp := new(core.GasPool).AddGas(uint64(1e18))
-	usedGas := uint64(0)
-	ug := &usedGas
+	gp := new(core.GasPool).AddGas(gas)
 
 	// ChainContext supports retrieving headers and consensus parameters from the
 	// current blockchain to be used during transaction processing.
 	var bc core.ChainContext
 	// Header represents a block header in the Ethereum blockchain.
-	var header  *types.Header
-	header = &types.Header{
-		Number: big.NewInt(0),
-		Difficulty: big.NewInt(0),
-		ParentHash: common.Hash{0},
-		Time: big.NewInt(0),
+	limits, err := getGasLimits(rst)
+	if err != nil {
+		return nil, nil, err
 	}
+	header := getHeader(limits)
 
-	receipt, usedGas, err := core.ApplyTransaction(chainconfig, bc, &nilAddress, gp, db, header, tx, ug, config)
-	if err !=nil {
-		log.Error()
-		return nil, err
+	msg, err := tx.AsMessage(types.MakeSigner(chainconfig, header.Number))
+	if err != nil {
+		return nil, nil, err
+	}
+	//The logs are recorded under the transaction hash
+	db.Prepare(tx.Hash(), common.Hash{}, 0)
+	context := core.NewEVMContext(msg, header, bc, &nilAddress)
+	bs := newBvmState(db, rst)
+	bvm := vm.NewEVM(context, bs, chainconfig, bs.vmConfig(config))
+	ret, gasUsed, failed, err := core.ApplyMessage(bvm, msg, gp)
+	if err != nil {
+		return nil, nil, err
+	}
+	//ByzantiumBlock is 0, so receipts do not carry the intermediate state root
+	db.Finalise(true)
+
+	receipt := types.NewReceipt(nil, failed, gasUsed)
+	receipt.TxHash = tx.Hash()
+	receipt.GasUsed = gasUsed
+	if msg.To() == nil {
+		receipt.ContractAddress = crypto.CreateAddress(bvm.Context.Origin, tx.Nonce())
+	}
+	receipt.Logs = db.GetLogs(tx.Hash())
+	if receipt.Logs == nil {
+		//The JSON encoding of the receipt requires a list of logs, even empty
+		receipt.Logs = []*types.Log{}
+	}
+	receipt.Bloom = types.CreateBloom(types.Receipts{receipt})
+
+	r := &Receipt{Receipt: receipt}
+	if failed {
+		r.RevertData = ret
+		r.RevertReason, _ = unpackRevert(ret)
 	}
-	return receipt, nil
+	return r, ret, nil
 }
 
 
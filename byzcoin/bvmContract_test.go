@@ -1,9 +1,11 @@
 package byzcoin
 
 import (
+	"crypto/ecdsa"
 	"github.com/dedis/onet/log"
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 	"math/big"
@@ -157,7 +159,8 @@ func TestInvoke_DeployToken(t *testing.T) {
 
 	//DEPLOY
 	//Getting smartcontract abi and bytecode
-	RawAbi, bytecode := getSmartContract("MinimumToken")
+	RawAbi, bytecode, err := getSmartContract("MinimumToken")
+	require.Nil(t, err)
 
 	//Getting transaction parameters
 	gasLimit, gasPrice := transactionGasParameters()
@@ -287,7 +290,8 @@ func TestInvoke_LoanContract(t *testing.T){
 
 	//DEPLOY
 	//Getting smartcontract abi and bytecode
-	rawAbi, bytecode := getSmartContract("LoanContract")
+	rawAbi, bytecode, err := getSmartContract("LoanContract")
+	require.Nil(t, err)
 
 	//Getting transaction parameters
 	gasLimit, gasPrice := transactionGasParameters()
@@ -418,6 +422,99 @@ func transactionGasParameters()(gasLimit uint64, gasPrice *big.Int){
 	return
 }
 
+//tokenFixture is a MinimumToken giving 100 tokens to the account A, with the keys the tests send from
+type tokenFixture struct {
+	privateA *ecdsa.PrivateKey
+	addressA common.Address
+	addressB common.Address
+	abi      abi.ABI
+	//code is the creation code of the token, with the constructor arguments
+	code []byte
+	//address is the address of the token, once deployed
+	address common.Address
+}
+
+//newTokenFixture returns the creation code of a MinimumToken owned by the account A
+func newTokenFixture(t *testing.T) *tokenFixture {
+	privateA, err := crypto.HexToECDSA("a33fca62081a2665454fe844a8afbe8e2e02fb66af558e695a79d058f9042f0d")
+	require.Nil(t, err)
+	f := &tokenFixture{
+		privateA: privateA,
+		addressA: crypto.PubkeyToAddress(privateA.PublicKey),
+		addressB: common.HexToAddress("0x2887A24130cACFD8f71C479d9f9Da5b9C6425CE8"),
+	}
+	rawAbi, bytecode, err := getSmartContract("MinimumToken")
+	require.Nil(t, err)
+	f.abi, err = abi.JSON(strings.NewReader(rawAbi))
+	require.Nil(t, err)
+	constructorArgs, err := f.abi.Pack("", f.addressA, big.NewInt(100))
+	require.Nil(t, err)
+	f.code = append(common.Hex2Bytes(bytecode), constructorArgs...)
+	return f
+}
+
+//deployToken deploys a MinimumToken on a new state where the account A holds 5 ether
+func deployToken(t *testing.T) (*tokenFixture, *MemDatabase, *state.StateDB) {
+	f := newTokenFixture(t)
+	memdb, db, err := getDB(ES{DbBuf: []byte{}})
+	require.Nil(t, err)
+	db.SetBalance(f.addressA, big.NewInt(1e18*5))
+	f.address = deployLocal(t, db, f.privateA, f.code)
+	return f, memdb, db
+}
+
+//transfer returns the call data of a transfer of amount tokens from A to the address to
+func (f *tokenFixture) transfer(t *testing.T, to common.Address, amount int64) []byte {
+	data, err := f.abi.Pack("transferFrom", f.addressA, to, big.NewInt(amount))
+	require.Nil(t, err)
+	return data
+}
+
+//signTx signs tx with the key of the account A
+func (f *tokenFixture) signTx(t *testing.T, tx *types.Transaction) *types.Transaction {
+	signed, err := types.SignTx(tx, types.HomesteadSigner{}, f.privateA)
+	require.Nil(t, err)
+	return signed
+}
+
+//newFundedBackend returns a simulated backend where the account A holds 5 ether, with the key of A
+func newFundedBackend(t *testing.T) (*SimulatedBackend, *Key) {
+	sb, err := NewSimulatedBackend()
+	require.Nil(t, err)
+	privateA, err := crypto.HexToECDSA("a33fca62081a2665454fe844a8afbe8e2e02fb66af558e695a79d058f9042f0d")
+	require.Nil(t, err)
+	keyA := NewKeyFromECDSA(privateA)
+	require.Nil(t, sb.Deposit(5, keyA.Address))
+	return sb, keyA
+}
+
+//deployLocal deploys code on db without going through byzcoin and returns the contract address
+func deployLocal(t *testing.T, db *state.StateDB, private *ecdsa.PrivateKey, code []byte) common.Address {
+	gasLimit, gasPrice := transactionGasParameters()
+	from := crypto.PubkeyToAddress(private.PublicKey)
+	nonce := db.GetNonce(from)
+	tx, err := types.SignTx(types.NewContractCreation(nonce, big.NewInt(0), gasLimit, gasPrice, code), types.HomesteadSigner{}, private)
+	require.Nil(t, err)
+	receipt, err := sendTx(tx, db)
+	require.Nil(t, err)
+	require.Equal(t, types.ReceiptStatusSuccessful, receipt.Status)
+	return receipt.ContractAddress
+}
+
+//sendStored applies tx on es the way the transaction instruction does, and returns the new state
+func sendStored(t *testing.T, es ES, tx *types.Transaction) (ES, *Receipt) {
+	memdb, db, err := getDB(es)
+	require.Nil(t, err)
+	receipt, err := sendTx(tx, db)
+	require.Nil(t, err)
+	receipt.PreStateRoot = es.RootHash
+	require.Nil(t, storeTransaction(memdb, tx))
+	require.Nil(t, storeReceipt(memdb, receipt))
+	es, err = commitES(memdb, db)
+	require.Nil(t, err)
+	return es, receipt
+}
+
 
 // bcTest is used here to provide some simple test structure for different
 // tests.
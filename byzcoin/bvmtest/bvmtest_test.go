@@ -0,0 +1,101 @@
+package bvmtest
+
+import (
+	"math/big"
+	"math/rand"
+	"path"
+	"testing"
+
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/log"
+	bvm "github.com/dedis/student_18_hugo_verex/byzcoin"
+	"github.com/dedis/student_18_hugo_verex/byzcoin/artifact"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	log.MainTest(m)
+}
+
+func loadToken(t *testing.T) *artifact.Artifact {
+	a, err := artifact.LoadSolcjs(artifact.Dir("../contracts"), path.Join("MinimumToken", "MinimumToken_sol_MinimumToken"))
+	require.Nil(t, err)
+	return a
+}
+
+// Deploys and calls a MinimumToken on the simulated backend
+func TestEnv_Simulated(t *testing.T) {
+	env := NewSimulatedEnv(t)
+	defer env.Close()
+	accounts := env.Accounts(2)
+	a, b := accounts[0], accounts[1]
+
+	token := env.Deploy(a, loadToken(t), a.Address, big.NewInt(100))
+	require.Equal(t, uint64(1), env.Receipt(token.Tx).Status)
+	token.MustTransact(a, "transferFrom", a.Address, b.Address, big.NewInt(10))
+	require.Equal(t, "error", token.MustRevert(a, "transferFrom", a.Address, b.Address, big.NewInt(1000)))
+}
+
+// Runs the same calls on a ledger of local conodes
+func TestEnv_Ledger(t *testing.T) {
+	l := NewLedger(t, 3)
+	l.Local.Check = onet.CheckNone
+	defer l.Close()
+
+	env := NewEnv(t, l.Client, l.Fund)
+	a := env.Account()
+	token := env.Deploy(a, loadToken(t), a.Address, big.NewInt(100))
+	//The second account is funded after the deployment, the counters of the signer follow
+	b := env.Account()
+	token.MustTransact(a, "transferFrom", a.Address, b.Address, big.NewInt(10))
+	require.Equal(t, "error", token.MustRevert(a, "transferFrom", a.Address, b.Address, big.NewInt(1000)))
+}
+
+// Fuzzes a MinimumToken with an invariant capping the balance of the second account
+func TestFuzzer(t *testing.T) {
+	a := loadToken(t)
+	f := &Fuzzer{
+		Seed:   1,
+		Runs:   3,
+		Length: 10,
+		Setup: func(env *Env, accounts []*bvm.Key) *Contract {
+			token := env.Deploy(accounts[0], a, accounts[0].Address, big.NewInt(100))
+			holder := accounts[1].Address
+			//The balances are the mapping at position 0
+			capped := &bvm.StoragePredicate{
+				Op:    bvm.PredicateAtMost,
+				Slots: []common.Hash{bvm.MappingSlot(holder.Hash(), 0)},
+				Bound: (*hexutil.Big)(big.NewInt(30)),
+			}
+			require.Nil(t, env.Backend.AddInvariant(bvm.Invariant{Name: "cap", Address: token.Address, Predicate: capped}))
+			return token
+		},
+	}
+	findings := f.Run(t)
+	require.NotEmpty(t, findings)
+	kinds := map[string]bool{}
+	for _, finding := range findings {
+		log.Lvl2(finding)
+		kinds[finding.Kind] = true
+		require.NotEmpty(t, finding.Calls)
+		require.True(t, len(finding.Calls) <= f.Length)
+		require.Equal(t, finding.Method, finding.Calls[len(finding.Calls)-1].Method)
+	}
+	//transferFrom reverts on most random arguments
+	require.True(t, kinds["revert"])
+}
+
+// Methods taking functions can't be fuzzed, they are left out instead of failing
+func TestRandomValue_Unsupported(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	function := abi.Type{T: abi.FunctionTy}
+	_, err := randomValue(r, function, nil)
+	require.NotNil(t, err)
+	_, err = randomValue(r, abi.Type{T: abi.SliceTy, Elem: &function}, nil)
+	require.NotNil(t, err)
+	require.False(t, fuzzable(abi.Method{Name: "call", Inputs: abi.Arguments{{Name: "callback", Type: function}}}))
+	require.True(t, fuzzable(abi.Method{Name: "call"}))
+}
@@ -0,0 +1,149 @@
+package bvmtest
+
+import (
+	"math/big"
+	"testing"
+
+	bvm "github.com/dedis/student_18_hugo_verex/byzcoin"
+	"github.com/dedis/student_18_hugo_verex/byzcoin/artifact"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/require"
+)
+
+// Env deploys and calls contracts on a bvm backend. Its methods fail the
+// test on errors, except the ones returning an error.
+type Env struct {
+	T       testing.TB
+	Backend bvm.Backend
+	// fund deposits coins to a new account
+	fund Funder
+	// closer releases the backend, if the environment created it
+	closer func()
+}
+
+// Funder deposits coins to an address. Ether only enters the bvm by
+// depositing coins, so the accounts are funded from coins.
+type Funder func(address common.Address, coins uint64) error
+
+// AccountCoins are the coins deposited to the accounts of an Env.
+const AccountCoins = uint64(5)
+
+// NewEnv returns an environment sending to backend, funding its accounts
+// with fund.
+func NewEnv(t testing.TB, backend bvm.Backend, fund Funder) *Env {
+	return &Env{T: t, Backend: backend, fund: fund}
+}
+
+// NewSimulatedEnv returns an environment on a new simulated backend. It
+// must be closed with Close when the test ends.
+func NewSimulatedEnv(t testing.TB) *Env {
+	sb, err := bvm.NewSimulatedBackend()
+	require.Nil(t, err)
+	env := NewEnv(t, sb, simulatedFunder(sb))
+	env.closer = sb.Close
+	return env
+}
+
+// Close releases the backend created by the environment. Closing the
+// simulated backend ends the receipt streams of the test.
+func (e *Env) Close() {
+	if e.closer != nil {
+		e.closer()
+		e.closer = nil
+	}
+}
+
+// simulatedFunder deposits coins created by the simulated backend sb.
+func simulatedFunder(sb *bvm.SimulatedBackend) Funder {
+	return func(address common.Address, coins uint64) error {
+		return sb.Deposit(coins, address)
+	}
+}
+
+// Account returns a new key whose address is funded with AccountCoins coins
+// worth of ether.
+func (e *Env) Account() *bvm.Key {
+	private, err := crypto.GenerateKey()
+	require.Nil(e.T, err)
+	key := bvm.NewKeyFromECDSA(private)
+	require.Nil(e.T, e.fund(key.Address, AccountCoins))
+	return key
+}
+
+// Accounts returns n new funded keys.
+func (e *Env) Accounts(n int) []*bvm.Key {
+	keys := make([]*bvm.Key, n)
+	for i := range keys {
+		keys[i] = e.Account()
+	}
+	return keys
+}
+
+// Contract is a contract deployed in an Env.
+type Contract struct {
+	env     *Env
+	Address common.Address
+	ABI     abi.ABI
+	// Tx is the deployment transaction
+	Tx *types.Transaction
+}
+
+// Deploy deploys the contract a with key, with the constructor arguments
+// args.
+func (e *Env) Deploy(key *bvm.Key, a *artifact.Artifact, args ...interface{}) *Contract {
+	contractAbi, err := a.ParseABI()
+	require.Nil(e.T, err)
+	constructorArgs, err := contractAbi.Pack("", args...)
+	require.Nil(e.T, err)
+	bytecode := append(common.CopyBytes(a.Bytecode), constructorArgs...)
+	address, tx, err := e.Backend.Deploy(key, bytecode, nil)
+	require.Nil(e.T, err, "deploying %s", a.Name)
+	return &Contract{env: e, Address: address, ABI: contractAbi, Tx: tx}
+}
+
+// At returns the contract with the ABI of a already deployed at address.
+func (e *Env) At(address common.Address, a *artifact.Artifact) *Contract {
+	contractAbi, err := a.ParseABI()
+	require.Nil(e.T, err)
+	return &Contract{env: e, Address: address, ABI: contractAbi}
+}
+
+// Transact calls method with args in a transaction sent by key. A reverted
+// transaction is returned with a *bvm.RevertError.
+func (c *Contract) Transact(key *bvm.Key, method string, args ...interface{}) (*types.Transaction, error) {
+	return c.TransactValue(key, nil, method, args...)
+}
+
+// TransactValue is Transact with value wei sent to the contract.
+func (c *Contract) TransactValue(key *bvm.Key, value *big.Int, method string, args ...interface{}) (*types.Transaction, error) {
+	data, err := c.ABI.Pack(method, args...)
+	require.Nil(c.env.T, err, "packing the arguments of %s", method)
+	return c.env.Backend.Transact(key, c.Address, value, data)
+}
+
+// MustTransact is Transact failing the test if the transaction is not
+// included or reverts.
+func (c *Contract) MustTransact(key *bvm.Key, method string, args ...interface{}) *types.Transaction {
+	tx, err := c.Transact(key, method, args...)
+	require.Nil(c.env.T, err, "calling %s", method)
+	return tx
+}
+
+// MustRevert is Transact failing the test unless the transaction reverts,
+// it returns the revert reason.
+func (c *Contract) MustRevert(key *bvm.Key, method string, args ...interface{}) string {
+	_, err := c.Transact(key, method, args...)
+	revertErr, ok := err.(*bvm.RevertError)
+	require.True(c.env.T, ok, "%s didn't revert: %v", method, err)
+	return revertErr.Reason
+}
+
+// Receipt returns the receipt of tx.
+func (e *Env) Receipt(tx *types.Transaction) *bvm.Receipt {
+	r, err := e.Backend.GetReceipt(tx.Hash())
+	require.Nil(e.T, err)
+	return r
+}
@@ -0,0 +1,365 @@
+package bvmtest
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	bvm "github.com/dedis/student_18_hugo_verex/byzcoin"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/require"
+)
+
+// Fuzzer sends sequences of random calls to a contract on simulated
+// backends, and reports the reverts, the invariant violations and the gas
+// anomalies it finds. Every finding comes with the shortest sequence of
+// calls found to reproduce it.
+type Fuzzer struct {
+	// Setup deploys the contract on a new environment, where accounts are
+	// already funded, and returns it. It can also add invariants. It is
+	// called for every sequence, so it must always deploy the same state.
+	Setup func(env *Env, accounts []*bvm.Key) *Contract
+	// Accounts is the number of accounts sending the calls, 2 if it is 0.
+	// They are the same for all the sequences.
+	Accounts int
+	// Seed seeds the random generator, the same seed gives the same calls
+	Seed int64
+	// Runs is the number of sequences and Length the number of calls of
+	// every sequence
+	Runs   int
+	Length int
+	// Methods restricts the calls to these methods, all the methods of the
+	// ABI are called if it is empty
+	Methods []string
+	// MaxValue is the highest value in wei sent with a call. No value is
+	// sent if it is nil.
+	MaxValue *big.Int
+	// GasThreshold reports the calls using more gas, if not 0
+	GasThreshold uint64
+	// IgnoreReverts doesn't report the reverts, only the violations and the
+	// gas anomalies
+	IgnoreReverts bool
+}
+
+// Call is a call made by the fuzzer.
+type Call struct {
+	// Sender is the index of the sending account
+	Sender int
+	Method string
+	Args   []interface{}
+	Value  *big.Int
+}
+
+func (c Call) String() string {
+	args := make([]string, len(c.Args))
+	for i, arg := range c.Args {
+		args[i] = formatArg(arg)
+	}
+	s := fmt.Sprintf("account[%d]: %s(%s)", c.Sender, c.Method, strings.Join(args, ", "))
+	if c.Value != nil && c.Value.Sign() != 0 {
+		s += fmt.Sprintf(" value=%s", c.Value)
+	}
+	return s
+}
+
+// Finding is a problem found by the fuzzer.
+type Finding struct {
+	// Kind is "revert", "invariant" or "gas"
+	Kind   string
+	Method string
+	Detail string
+	// Calls reproduce the finding from the state deployed by Setup, the
+	// last call triggers it
+	Calls []Call
+}
+
+func (f Finding) String() string {
+	s := fmt.Sprintf("%s in %s: %s\nreproducer:\n", f.Kind, f.Method, f.Detail)
+	for _, c := range f.Calls {
+		s += "  " + c.String() + "\n"
+	}
+	return s
+}
+
+// key identifies findings of the same kind, only the first one is kept.
+func (f Finding) key() string {
+	return f.Kind + "/" + f.Method + "/" + f.Detail
+}
+
+// Run runs the sequences and returns the findings.
+func (f *Fuzzer) Run(t *testing.T) []Finding {
+	r := rand.New(rand.NewSource(f.Seed))
+	n := f.Accounts
+	if n == 0 {
+		n = 2
+	}
+	keys := make([]*bvm.Key, n)
+	for i := range keys {
+		private, err := ecdsa.GenerateKey(crypto.S256(), r)
+		require.Nil(t, err)
+		keys[i] = bvm.NewKeyFromECDSA(private)
+	}
+	seen := map[string]bool{}
+	var findings []Finding
+	for run := 0; run < f.Runs; run++ {
+		contract, done := f.setup(t, keys)
+		var calls []Call
+		for i := 0; i < f.Length; i++ {
+			call, err := f.randomCall(r, contract, keys)
+			require.Nil(t, err)
+			calls = append(calls, call)
+			finding := f.send(t, contract, keys, call)
+			if finding == nil || seen[finding.key()] {
+				continue
+			}
+			seen[finding.key()] = true
+			finding.Calls = f.minimize(t, keys, calls, finding.key())
+			findings = append(findings, *finding)
+		}
+		done()
+	}
+	return findings
+}
+
+// setup funds the accounts and deploys the contract on a new simulated
+// backend. The returned function closes the backend.
+func (f *Fuzzer) setup(t *testing.T, keys []*bvm.Key) (*Contract, func()) {
+	sb, err := bvm.NewSimulatedBackend()
+	require.Nil(t, err)
+	env := NewEnv(t, sb, simulatedFunder(sb))
+	for _, key := range keys {
+		require.Nil(t, sb.Deposit(AccountCoins, key.Address))
+	}
+	return f.Setup(env, keys), sb.Close
+}
+
+// replay sends calls on a new state and tells if the last one gives the
+// finding key.
+func (f *Fuzzer) replay(t *testing.T, keys []*bvm.Key, calls []Call, key string) bool {
+	contract, done := f.setup(t, keys)
+	defer done()
+	for i, call := range calls {
+		finding := f.send(t, contract, keys, call)
+		if i == len(calls)-1 {
+			return finding != nil && finding.key() == key
+		}
+	}
+	return false
+}
+
+// minimize removes calls from calls as long as the last one still gives
+// the finding key.
+func (f *Fuzzer) minimize(t *testing.T, keys []*bvm.Key, calls []Call, key string) []Call {
+	calls = append([]Call{}, calls...)
+	for i := len(calls) - 2; i >= 0; i-- {
+		shorter := append(append([]Call{}, calls[:i]...), calls[i+1:]...)
+		if f.replay(t, keys, shorter, key) {
+			calls = shorter
+		}
+	}
+	return calls
+}
+
+// send sends the call and returns what it found, nil if nothing.
+func (f *Fuzzer) send(t *testing.T, contract *Contract, keys []*bvm.Key, call Call) *Finding {
+	tx, err := contract.TransactValue(keys[call.Sender], call.Value, call.Method, call.Args...)
+	switch e := err.(type) {
+	case nil:
+	case *bvm.RevertError:
+		if f.IgnoreReverts {
+			return nil
+		}
+		detail := "revert"
+		if e.Reason != "" {
+			detail = e.Reason
+		}
+		return &Finding{Kind: "revert", Method: call.Method, Detail: detail}
+	case bvm.Violation:
+		return &Finding{Kind: "invariant", Method: call.Method, Detail: e.Name + ": " + e.Reason}
+	default:
+		require.Nil(t, err, "sending %s", call)
+	}
+
+	r := contract.env.Receipt(tx)
+	if len(r.Violations) > 0 {
+		v := r.Violations[0]
+		return &Finding{Kind: "invariant", Method: call.Method, Detail: v.Name + ": " + v.Reason}
+	}
+	if f.GasThreshold != 0 && r.GasUsed > f.GasThreshold {
+		return &Finding{Kind: "gas", Method: call.Method, Detail: fmt.Sprintf("uses more than %d gas", f.GasThreshold)}
+	}
+	return nil
+}
+
+// randomCall returns a call to a random method with random arguments. Unless
+// Methods are given, the methods taking arguments that can't be generated,
+// like functions and tuples, are left out.
+func (f *Fuzzer) randomCall(r *rand.Rand, contract *Contract, keys []*bvm.Key) (Call, error) {
+	methods := f.Methods
+	if len(methods) == 0 {
+		for name, method := range contract.ABI.Methods {
+			if fuzzable(method) {
+				methods = append(methods, name)
+			}
+		}
+		// Map order is random, the seed must give the same calls
+		sort.Strings(methods)
+	}
+	if len(methods) == 0 {
+		return Call{}, errors.New("no method takes arguments that can be generated")
+	}
+	name := methods[r.Intn(len(methods))]
+	method, ok := contract.ABI.Methods[name]
+	if !ok {
+		return Call{}, errors.New("no method " + name)
+	}
+
+	// The addresses are mostly taken among the accounts and the contract,
+	// so that the calls touch the same state
+	addresses := []common.Address{{}, contract.Address}
+	for _, key := range keys {
+		addresses = append(addresses, key.Address)
+	}
+	call := Call{Sender: r.Intn(len(keys)), Method: method.Name}
+	for _, input := range method.Inputs {
+		arg, err := randomValue(r, input.Type, addresses)
+		if err != nil {
+			return Call{}, fmt.Errorf("argument %s of %s: %v", input.Name, method.Name, err)
+		}
+		call.Args = append(call.Args, arg)
+	}
+	if f.MaxValue != nil && r.Intn(2) == 0 {
+		call.Value = new(big.Int).Rand(r, new(big.Int).Add(f.MaxValue, big.NewInt(1)))
+	}
+	return call, nil
+}
+
+// fuzzable tells whether random values can be generated for all the inputs
+// of method.
+func fuzzable(method abi.Method) bool {
+	for _, input := range method.Inputs {
+		if !fuzzableType(input.Type) {
+			return false
+		}
+	}
+	return true
+}
+
+func fuzzableType(typ abi.Type) bool {
+	switch typ.T {
+	case abi.BoolTy, abi.AddressTy, abi.IntTy, abi.UintTy, abi.StringTy, abi.BytesTy, abi.FixedBytesTy, abi.HashTy:
+		return true
+	case abi.SliceTy, abi.ArrayTy:
+		return fuzzableType(*typ.Elem)
+	}
+	return false
+}
+
+// randomValue returns a random value of the ABI type typ, of the Go type
+// expected by abi.Pack.
+func randomValue(r *rand.Rand, typ abi.Type, addresses []common.Address) (interface{}, error) {
+	switch typ.T {
+	case abi.BoolTy:
+		return r.Intn(2) == 0, nil
+	case abi.AddressTy:
+		if r.Intn(10) == 0 {
+			var a common.Address
+			r.Read(a[:])
+			return a, nil
+		}
+		return addresses[r.Intn(len(addresses))], nil
+	case abi.IntTy, abi.UintTy:
+		n := randomInt(r, typ)
+		if typ.Type.Kind() == reflect.Ptr {
+			return n, nil
+		}
+		v := reflect.New(typ.Type).Elem()
+		if typ.T == abi.IntTy {
+			v.SetInt(n.Int64())
+		} else {
+			v.SetUint(n.Uint64())
+		}
+		return v.Interface(), nil
+	case abi.StringTy:
+		return string(randomBytes(r, 64)), nil
+	case abi.BytesTy:
+		return randomBytes(r, 64), nil
+	case abi.FixedBytesTy, abi.HashTy:
+		v := reflect.New(typ.Type).Elem()
+		for i := 0; i < v.Len(); i++ {
+			v.Index(i).SetUint(uint64(r.Intn(256)))
+		}
+		return v.Interface(), nil
+	case abi.SliceTy:
+		v := reflect.MakeSlice(typ.Type, r.Intn(4), r.Intn(4)+4)
+		for i := 0; i < v.Len(); i++ {
+			elem, err := randomValue(r, *typ.Elem, addresses)
+			if err != nil {
+				return nil, err
+			}
+			v.Index(i).Set(reflect.ValueOf(elem))
+		}
+		return v.Interface(), nil
+	case abi.ArrayTy:
+		v := reflect.New(typ.Type).Elem()
+		for i := 0; i < v.Len(); i++ {
+			elem, err := randomValue(r, *typ.Elem, addresses)
+			if err != nil {
+				return nil, err
+			}
+			v.Index(i).Set(reflect.ValueOf(elem))
+		}
+		return v.Interface(), nil
+	}
+	return nil, errors.New("cannot generate values of type " + typ.String())
+}
+
+// randomInt returns an integer in the range of typ, often one of the bounds
+// or a small number, as they find the most bugs.
+func randomInt(r *rand.Rand, typ abi.Type) *big.Int {
+	max := new(big.Int).Lsh(big.NewInt(1), uint(typ.Size))
+	min := new(big.Int)
+	if typ.T == abi.IntTy {
+		max.Rsh(max, 1)
+		min.Neg(max)
+	}
+	max.Sub(max, big.NewInt(1))
+	switch r.Intn(6) {
+	case 0:
+		return min
+	case 1:
+		return max
+	case 2:
+		return big.NewInt(int64(r.Intn(2)))
+	case 3, 4:
+		return big.NewInt(int64(r.Intn(1000)))
+	}
+	n := new(big.Int).Rand(r, new(big.Int).Sub(max, min))
+	return n.Add(n, min)
+}
+
+func randomBytes(r *rand.Rand, max int) []byte {
+	buf := make([]byte, r.Intn(max+1))
+	r.Read(buf)
+	return buf
+}
+
+func formatArg(arg interface{}) string {
+	switch a := arg.(type) {
+	case common.Address:
+		return a.Hex()
+	case []byte:
+		return fmt.Sprintf("0x%x", a)
+	case string:
+		return fmt.Sprintf("%q", a)
+	}
+	return fmt.Sprint(arg)
+}
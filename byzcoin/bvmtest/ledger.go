@@ -0,0 +1,121 @@
+// Package bvmtest helps testing solidity contracts on the bvm. An Env
+// creates funded accounts and deploys and calls contracts on any bvm
+// Backend: a Ledger running local conodes, or a simulated backend for
+// faster tests.
+package bvmtest
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/byzcoin/contracts"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/onet"
+	bvm "github.com/dedis/student_18_hugo_verex/byzcoin"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/require"
+)
+
+// Rules are the rules of the genesis darc of a Ledger.
+var Rules = []string{"spawn:" + bvm.ContractBvmID, "spawn:" + contracts.ContractCoinID, "invoke:mint", "invoke:fetch", "invoke:transaction", "invoke:display", "invoke:deposit", "invoke:invariant", "invoke:bind", "invoke:enforceBindings", "invoke:deploy", "invoke:approveCode", "invoke:enforceApprovedCode", "invoke:register"}
+
+// Ledger is a ByzCoin ledger running on local conodes, with a bvm instance.
+// The counters of Signer are read from the ledger for every instruction, so
+// they never have to be counted by hand.
+type Ledger struct {
+	t           testing.TB
+	Local       *onet.LocalTest
+	Servers     []*onet.Server
+	Roster      *onet.Roster
+	Signer      darc.Signer
+	GenesisDarc *darc.Darc
+	ByzCoin     *byzcoin.Client
+	// Client talks to the bvm instance spawned with the ledger
+	Client *bvm.Client
+	// Coin is the coin instance the accounts are funded from
+	Coin byzcoin.InstanceID
+}
+
+// ledgerCoins are the coins minted in the coin instance of a Ledger.
+const ledgerCoins = uint64(1e6)
+
+// NewLedger starts nodes conodes, creates a ledger whose genesis darc allows
+// Signer to use the bvm and spawns a bvm instance.
+func NewLedger(t testing.TB, nodes int) *Ledger {
+	l := &Ledger{
+		t:      t,
+		Local:  onet.NewTCPTest(cothority.Suite),
+		Signer: darc.NewSignerEd25519(nil, nil),
+	}
+	l.Servers, l.Roster, _ = l.Local.GenTree(nodes, true)
+
+	msg, err := byzcoin.DefaultGenesisMsg(byzcoin.CurrentVersion, l.Roster, Rules, l.Signer.Identity())
+	require.Nil(t, err)
+	l.GenesisDarc = &msg.GenesisDarc
+	// Short blocks, to keep the tests fast
+	msg.BlockInterval = time.Second / 2
+	l.ByzCoin, _, err = byzcoin.NewLedger(msg, false)
+	require.Nil(t, err)
+
+	instID := l.Spawn(byzcoin.NewInstanceID(l.GenesisDarc.GetBaseID()), bvm.ContractBvmID, nil)
+	l.Client = bvm.NewClient(l.ByzCoin, instID, l.Signer)
+	l.Coin = l.Spawn(byzcoin.NewInstanceID(l.GenesisDarc.GetBaseID()), contracts.ContractCoinID, nil)
+	coins := make([]byte, 8)
+	binary.LittleEndian.PutUint64(coins, ledgerCoins)
+	l.Invoke(l.Coin, "mint", byzcoin.Arguments{{Name: "coins", Value: coins}})
+	return l
+}
+
+// Fund deposits coins coins of the coin instance of the ledger to address.
+func (l *Ledger) Fund(address common.Address, coins uint64) error {
+	return l.Client.Deposit(l.Coin, coins, address)
+}
+
+// Close stops the conodes.
+func (l *Ledger) Close() {
+	l.Local.CloseAll()
+}
+
+// Spawn spawns an instance of contractID from the darc instance darcID and
+// returns its ID, once it is included.
+func (l *Ledger) Spawn(darcID byzcoin.InstanceID, contractID string, args byzcoin.Arguments) byzcoin.InstanceID {
+	inst := byzcoin.Instruction{
+		InstanceID: darcID,
+		Spawn: &byzcoin.Spawn{
+			ContractID: contractID,
+			Args:       args,
+		},
+	}
+	l.send(&inst)
+	return inst.DeriveID("")
+}
+
+// Invoke invokes command on the instance instID and waits for it to be
+// included.
+func (l *Ledger) Invoke(instID byzcoin.InstanceID, command string, args byzcoin.Arguments) {
+	l.send(&byzcoin.Instruction{
+		InstanceID: instID,
+		Invoke: &byzcoin.Invoke{
+			Command: command,
+			Args:    args,
+		},
+	})
+}
+
+// send signs the instruction with the next counter of the signer and waits
+// for it to be included.
+func (l *Ledger) send(inst *byzcoin.Instruction) {
+	counters, err := l.ByzCoin.GetSignerCounters(l.Signer.Identity().String())
+	require.Nil(l.t, err)
+	require.Equal(l.t, 1, len(counters.Counters))
+	inst.SignerCounter = []uint64{counters.Counters[0] + 1}
+	ctx := byzcoin.ClientTransaction{Instructions: []byzcoin.Instruction{*inst}}
+	require.Nil(l.t, ctx.SignWith(l.Signer))
+	_, err = l.ByzCoin.AddTransactionAndWait(ctx, 20)
+	require.Nil(l.t, err)
+	// DeriveID depends on the signature
+	*inst = ctx.Instructions[0]
+}
@@ -0,0 +1,259 @@
+package byzcoin
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+// CallFrame is one call of the call tree of a transaction: the transaction
+// itself, or a CALL, CALLCODE, DELEGATECALL, STATICCALL, CREATE or CREATE2
+// made by a contract.
+type CallFrame struct {
+	Type    string         `json:"type"`
+	From    common.Address `json:"from"`
+	To      common.Address `json:"to"`
+	Value   *hexutil.Big   `json:"value,omitempty"`
+	Gas     uint64         `json:"gas"`
+	GasUsed uint64         `json:"gasUsed"`
+	Input   hexutil.Bytes  `json:"input"`
+	Output  hexutil.Bytes  `json:"output,omitempty"`
+	Error   string         `json:"error,omitempty"`
+	Calls   []*CallFrame   `json:"calls,omitempty"`
+}
+
+// callTracer builds the call tree of a transaction. The EVM only notifies
+// the tracer of the start and end of the transaction, so the inner calls are
+// found from the opcodes: a frame is opened by a call opcode, and closed at
+// the first step that is back at the depth of the caller. The output of a
+// call is read from the memory of the caller, where the call wrote it, and
+// its success from the stack of the caller. The frames whose caller fails
+// before executing another step, or that are left open at the end of the
+// transaction, are closed as failed.
+type callTracer struct {
+	root *CallFrame
+	// stack holds the open frames, the frame executing at depth d being
+	// stack[d-1]
+	stack []*openFrame
+	// opened is the frame opened by the last step, nil if it was not a call
+	opened *openFrame
+}
+
+type openFrame struct {
+	*CallFrame
+	// gasBefore and cost are the gas left before the call opcode and its
+	// cost, including the gas given to the callee
+	gasBefore uint64
+	cost      uint64
+	// outOffset and outSize give where the caller expects the output
+	outOffset *big.Int
+	outSize   *big.Int
+	// started is true once the callee executed its first opcode, calls to
+	// accounts without code and to precompiles never start
+	started  bool
+	reverted bool
+	err      error
+}
+
+func newCallTracer() *callTracer {
+	return &callTracer{}
+}
+
+// CaptureStart opens the frame of the transaction.
+func (ct *callTracer) CaptureStart(from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) error {
+	typ := "CALL"
+	if create {
+		typ = "CREATE"
+	}
+	ct.root = &CallFrame{
+		Type:  typ,
+		From:  from,
+		To:    to,
+		Input: common.CopyBytes(input),
+		Gas:   gas,
+		Value: (*hexutil.Big)(new(big.Int).Set(value)),
+	}
+	ct.stack = []*openFrame{{CallFrame: ct.root, started: true}}
+	return nil
+}
+
+// CaptureState closes the frames that returned and opens a frame for every
+// call opcode.
+func (ct *callTracer) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int, err error) error {
+	ct.opened = nil
+	if len(ct.stack) == 0 {
+		return nil
+	}
+	if err != nil {
+		return ct.CaptureFault(env, pc, op, gas, cost, memory, stack, contract, depth, err)
+	}
+	// The callee of the last call opcode started executing
+	if depth == len(ct.stack) {
+		if top := ct.stack[len(ct.stack)-1]; !top.started {
+			top.started = true
+			top.Gas = gas
+		}
+	}
+	// Back in a caller: the frames above it are done
+	for len(ct.stack) > depth && len(ct.stack) > 1 {
+		ct.exit(gas, memory, stack)
+	}
+
+	if op == vm.REVERT {
+		ct.stack[len(ct.stack)-1].reverted = true
+	}
+	if frame := newFrame(op, contract, memory, stack); frame != nil {
+		frame.gasBefore = gas
+		frame.cost = cost
+		parent := ct.stack[len(ct.stack)-1]
+		parent.Calls = append(parent.Calls, frame.CallFrame)
+		ct.stack = append(ct.stack, frame)
+		ct.opened = frame
+	}
+	return nil
+}
+
+// CaptureFault records the error of the frame executing at depth, and
+// closes the frames it called, its caller never resumes.
+func (ct *callTracer) CaptureFault(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int, err error) error {
+	for len(ct.stack) > depth && len(ct.stack) > 1 {
+		ct.abort(err)
+	}
+	if depth >= 1 && depth <= len(ct.stack) {
+		ct.stack[depth-1].err = err
+	}
+	return nil
+}
+
+// CaptureEnd closes the frames left open and the frame of the transaction.
+func (ct *callTracer) CaptureEnd(output []byte, gasUsed uint64, t time.Duration, err error) error {
+	if ct.root == nil {
+		return nil
+	}
+	for len(ct.stack) > 1 {
+		ct.abort(err)
+	}
+	ct.root.Output = common.CopyBytes(output)
+	ct.root.GasUsed = gasUsed
+	if err != nil {
+		ct.root.Error = err.Error()
+	}
+	return nil
+}
+
+// CallTree returns the root of the call tree, nil if nothing was traced.
+func (ct *callTracer) CallTree() *CallFrame {
+	return ct.root
+}
+
+// exit closes the frame on top of the stack. gas, memory and stack are the
+// ones of the caller, right after the call returned.
+func (ct *callTracer) exit(gas uint64, memory *vm.Memory, stack *vm.Stack) {
+	frame := ct.stack[len(ct.stack)-1]
+	ct.stack = ct.stack[:len(ct.stack)-1]
+
+	// The callee gives back the gas it didn't use
+	var left uint64
+	if gas+frame.cost >= frame.gasBefore {
+		left = gas + frame.cost - frame.gasBefore
+	}
+	if frame.started && frame.Gas >= left {
+		frame.GasUsed = frame.Gas - left
+	} else {
+		frame.Gas = left
+	}
+
+	data := stack.Data()
+	success := len(data) > 0 && data[len(data)-1].Sign() != 0
+	switch frame.Type {
+	case "CREATE", "CREATE2":
+		if success {
+			frame.To = common.BigToAddress(data[len(data)-1])
+		}
+	default:
+		if success {
+			frame.Output = memoryCopy(memory, frame.outOffset, frame.outSize)
+		}
+	}
+	if !success {
+		switch {
+		case frame.err != nil:
+			frame.Error = frame.err.Error()
+		case frame.reverted:
+			frame.Error = vm.ErrExecutionReverted.Error()
+		default:
+			frame.Error = "internal failure"
+		}
+	}
+}
+
+// abort closes the frame on top of the stack as failed, with its own error
+// or else err, when it can't be closed from its caller. It is given all its
+// gas, which is lost.
+func (ct *callTracer) abort(err error) {
+	frame := ct.stack[len(ct.stack)-1]
+	ct.stack = ct.stack[:len(ct.stack)-1]
+	if frame.started {
+		frame.GasUsed = frame.Gas
+	}
+	switch {
+	case frame.err != nil:
+		frame.Error = frame.err.Error()
+	case frame.reverted:
+		frame.Error = vm.ErrExecutionReverted.Error()
+	case err != nil:
+		frame.Error = err.Error()
+	default:
+		frame.Error = "internal failure"
+	}
+}
+
+// newFrame returns the frame opened by op, nil if op is not a call opcode.
+// The arguments are read from the stack and the memory before the opcode
+// executes.
+func newFrame(op vm.OpCode, contract *vm.Contract, memory *vm.Memory, stack *vm.Stack) *openFrame {
+	data := stack.Data()
+	arg := func(n int) *big.Int {
+		if n >= len(data) {
+			return new(big.Int)
+		}
+		return data[len(data)-1-n]
+	}
+	frame := &openFrame{CallFrame: &CallFrame{
+		Type: op.String(),
+		From: contract.Address(),
+	}}
+	switch op {
+	case vm.CALL, vm.CALLCODE:
+		frame.To = common.BigToAddress(arg(1))
+		frame.Value = (*hexutil.Big)(new(big.Int).Set(arg(2)))
+		frame.outOffset, frame.outSize = new(big.Int).Set(arg(5)), new(big.Int).Set(arg(6))
+		frame.Input = memoryCopy(memory, arg(3), arg(4))
+	case vm.DELEGATECALL, vm.STATICCALL:
+		frame.To = common.BigToAddress(arg(1))
+		frame.outOffset, frame.outSize = new(big.Int).Set(arg(4)), new(big.Int).Set(arg(5))
+		frame.Input = memoryCopy(memory, arg(2), arg(3))
+	case vm.CREATE, vm.CREATE2:
+		frame.Value = (*hexutil.Big)(new(big.Int).Set(arg(0)))
+		frame.Input = memoryCopy(memory, arg(1), arg(2))
+	default:
+		return nil
+	}
+	return frame
+}
+
+// memoryCopy returns a copy of size bytes of the memory from offset, nil if
+// they are out of the memory.
+func memoryCopy(memory *vm.Memory, offset, size *big.Int) []byte {
+	if !offset.IsInt64() || !size.IsInt64() {
+		return nil
+	}
+	start, length := offset.Int64(), size.Int64()
+	if length == 0 || start+length > int64(memory.Len()) {
+		return nil
+	}
+	return common.CopyBytes(memory.Data()[start : start+length])
+}
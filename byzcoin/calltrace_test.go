@@ -0,0 +1,97 @@
+package byzcoin
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/require"
+)
+
+//Builds the call tree of a LoanContract asking a token for its balance
+func TestTraceCalls(t *testing.T) {
+	token, memdb, db := deployToken(t)
+	addressA, tokenAddress := token.addressA, token.address
+
+	rawAbi, bytecode, err := getSmartContract("LoanContract")
+	require.Nil(t, err)
+	loanAbi, err := abi.JSON(strings.NewReader(rawAbi))
+	require.Nil(t, err)
+	constructorArgs, err := loanAbi.Pack("", big.NewInt(3), big.NewInt(1), big.NewInt(10000), "TOK", tokenAddress, big.NewInt(10))
+	require.Nil(t, err)
+	loanAddress := deployLocal(t, db, token.privateA, append(common.Hex2Bytes(bytecode), constructorArgs...))
+	nonce := db.GetNonce(addressA)
+	es, err := commitES(memdb, db)
+	require.Nil(t, err)
+
+	//MinimumToken has no balanceOf function, so the inner call reverts
+	checkTokens, err := loanAbi.Pack("checkTokens")
+	require.Nil(t, err)
+	gasLimit, gasPrice := transactionGasParameters()
+	tx := token.signTx(t, types.NewTransaction(nonce, loanAddress, big.NewInt(0), gasLimit, gasPrice, checkTokens))
+	es, _ = sendStored(t, es, tx)
+
+	memdb, _, err = getDB(es)
+	require.Nil(t, err)
+	tree, err := traceCalls(memdb, nil, tx.Hash())
+	require.Nil(t, err)
+	require.Equal(t, "CALL", tree.Type)
+	require.Equal(t, addressA, tree.From)
+	require.Equal(t, loanAddress, tree.To)
+	require.Equal(t, checkTokens, []byte(tree.Input))
+	require.NotEmpty(t, tree.Error)
+
+	require.Equal(t, 1, len(tree.Calls))
+	call := tree.Calls[0]
+	require.Equal(t, "CALL", call.Type)
+	require.Equal(t, loanAddress, call.From)
+	require.Equal(t, tokenAddress, call.To)
+	//balanceOf(address) with the address of the loan
+	require.Equal(t, append(crypto.Keccak256([]byte("balanceOf(address)"))[:4], common.LeftPadBytes(loanAddress.Bytes(), 32)...), []byte(call.Input))
+	require.Equal(t, vm.ErrExecutionReverted.Error(), call.Error)
+	require.True(t, call.GasUsed > 0)
+	require.True(t, call.GasUsed < call.Gas)
+	require.Empty(t, call.Calls)
+}
+
+//The frames left open when the caller fails right after the call are closed as failed
+func TestTraceCallsUnwound(t *testing.T) {
+	token, _, db := deployToken(t)
+	//The callee loops until it runs out of gas
+	callee := common.HexToAddress("0xca11ee")
+	db.SetCode(callee, []byte{byte(vm.JUMPDEST), byte(vm.PUSH1), 0, byte(vm.JUMP)})
+	//The caller calls it, then copies 16MB of call data, which it can't pay for with the gas left
+	caller := common.HexToAddress("0xca11e4")
+	code := []byte{byte(vm.PUSH3), 0xff, 0xff, 0xff, byte(vm.PUSH1), 0}
+	for i := 0; i < 5; i++ {
+		code = append(code, byte(vm.PUSH1), 0)
+	}
+	code = append(code, byte(vm.PUSH20))
+	code = append(code, callee.Bytes()...)
+	code = append(code, byte(vm.GAS), byte(vm.CALL), byte(vm.CALLDATACOPY), byte(vm.STOP))
+	db.SetCode(caller, code)
+
+	_, gasPrice := transactionGasParameters()
+	tx := token.signTx(t, types.NewTransaction(db.GetNonce(token.addressA), caller, big.NewInt(0), 100000, gasPrice, nil))
+	tracer := newCallTracer()
+	config := getVMConfig()
+	config.Debug = true
+	config.Tracer = tracer
+	receipt, _, err := applyTransaction(tx, db, nil, config, tx.Gas())
+	require.Nil(t, err)
+	require.Equal(t, types.ReceiptStatusFailed, receipt.Status)
+
+	tree := tracer.CallTree()
+	require.NotEmpty(t, tree.Error)
+	require.Equal(t, 1, len(tree.Calls))
+	call := tree.Calls[0]
+	require.Equal(t, callee, call.To)
+	require.Equal(t, vm.ErrOutOfGas.Error(), call.Error)
+	require.True(t, call.GasUsed > 0)
+	require.Equal(t, call.Gas, call.GasUsed)
+}
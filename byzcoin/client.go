@@ -0,0 +1,454 @@
+package byzcoin
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/onet"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Client talks to a bvm instance. The byzcoin instructions are signed by
+// Signer, which must be allowed to invoke the bvm instance, and the Ethereum
+// transactions by the keys passed to the methods.
+type Client struct {
+	*onet.Client
+	ByzCoin    *byzcoin.Client
+	InstanceID byzcoin.InstanceID
+	Signer     darc.Signer
+	Nonces     *NonceManager
+	// GasLimit and GasPrice are used for all transactions sent
+	GasLimit uint64
+	GasPrice *big.Int
+	// Wait is the number of blocks to wait for a transaction to be included
+	Wait int
+}
+
+// NewClient returns a client for the bvm instance instID of the ledger
+// reached through bcl.
+func NewClient(bcl *byzcoin.Client, instID byzcoin.InstanceID, signer darc.Signer) *Client {
+	c := &Client{
+		Client:     onet.NewClient(cothority.Suite, ServiceName),
+		ByzCoin:    bcl,
+		InstanceID: instID,
+		Signer:     signer,
+		GasLimit:   uint64(1e7),
+		GasPrice:   big.NewInt(1),
+		Wait:       10,
+	}
+	c.Nonces = NewNonceManager(c)
+	return c
+}
+
+// GetNonce asks the service for the nonce of address.
+func (c *Client) GetNonce(address common.Address) (uint64, error) {
+	reply := &GetNonceReply{}
+	err := c.SendProtobuf(c.ByzCoin.Roster.List[0], &GetNonce{
+		ByzCoinID:  c.ByzCoin.ID,
+		InstanceID: c.InstanceID,
+		Address:    address,
+	}, reply)
+	if err != nil {
+		return 0, err
+	}
+	return reply.Nonce, nil
+}
+
+// EstimateGas returns the lowest gas limit with which the transaction from
+// the address from succeeds. to is nil for a contract creation. If the
+// transaction always reverts, a *RevertError is returned.
+func (c *Client) EstimateGas(from common.Address, to *common.Address, value *big.Int, data []byte) (uint64, error) {
+	req := &EstimateGas{
+		ByzCoinID:  c.ByzCoin.ID,
+		InstanceID: c.InstanceID,
+		From:       from,
+		Data:       data,
+	}
+	if to != nil {
+		req.To = to.Bytes()
+	}
+	if value != nil {
+		req.Value = value.Bytes()
+	}
+	reply := &EstimateGasReply{}
+	err := c.SendProtobuf(c.ByzCoin.Roster.List[0], req, reply)
+	if err != nil {
+		return 0, err
+	}
+	if reply.Reverted {
+		return 0, newRevertError(reply.RevertData)
+	}
+	return reply.Gas, nil
+}
+
+// GetReceipt returns the receipt of the transaction txHash.
+func (c *Client) GetReceipt(txHash common.Hash) (*Receipt, error) {
+	reply := &GetReceiptReply{}
+	err := c.SendProtobuf(c.ByzCoin.Roster.List[0], &GetReceipt{
+		ByzCoinID:  c.ByzCoin.ID,
+		InstanceID: c.InstanceID,
+		TxHash:     txHash,
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	r := &Receipt{}
+	err = json.Unmarshal(reply.Receipt, r)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetLogs returns the logs emitted by the transactions of the bvm instance
+// that match filter.
+func (c *Client) GetLogs(filter LogFilter) ([]*types.Log, error) {
+	req := &GetLogs{
+		ByzCoinID:  c.ByzCoin.ID,
+		InstanceID: c.InstanceID,
+		FromBlock:  filter.FromBlock,
+		ToBlock:    filter.ToBlock,
+		Addresses:  filter.Addresses,
+	}
+	for _, topics := range filter.Topics {
+		req.Topics = append(req.Topics, LogTopics{Hashes: topics})
+	}
+	reply := &GetLogsReply{}
+	err := c.SendProtobuf(c.ByzCoin.Roster.List[0], req, reply)
+	if err != nil {
+		return nil, err
+	}
+	var logs []*types.Log
+	err = json.Unmarshal(reply.Logs, &logs)
+	if err != nil {
+		return nil, err
+	}
+	return logs, nil
+}
+
+// StreamReceipts calls handler with the receipt of every new transaction of
+// the bvm instance that has a log matching filter, together with the
+// matching logs. With an empty filter all receipts are passed to handler.
+// The block range of the filter is ignored. It only returns when the
+// connection fails.
+func (c *Client) StreamReceipts(filter LogFilter, handler func(*Receipt, []*types.Log, error)) error {
+	req := &StreamReceipts{
+		ByzCoinID:  c.ByzCoin.ID,
+		InstanceID: c.InstanceID,
+		Addresses:  filter.Addresses,
+	}
+	for _, topics := range filter.Topics {
+		req.Topics = append(req.Topics, LogTopics{Hashes: topics})
+	}
+	conn, err := c.Stream(c.ByzCoin.Roster.List[0], req)
+	if err != nil {
+		return err
+	}
+	for {
+		reply := StreamReceiptsReply{}
+		if err := conn.ReadMessage(&reply); err != nil {
+			return err
+		}
+		r := &Receipt{}
+		var logs []*types.Log
+		err := json.Unmarshal(reply.Receipt, r)
+		if err == nil {
+			err = json.Unmarshal(reply.Logs, &logs)
+		}
+		handler(r, logs, err)
+	}
+}
+
+// TraceTransaction returns the opcode trace of the transaction txHash. The
+// Disable fields of cfg leave out parts of every step, Limit is ignored.
+// The replay reads the current instances of the ledger, the trace of an old
+// transaction reading them can differ from what actually ran.
+func (c *Client) TraceTransaction(txHash common.Hash, cfg vm.LogConfig) (*TraceResult, error) {
+	reply := &TraceTransactionReply{}
+	err := c.SendProtobuf(c.ByzCoin.Roster.List[0], &TraceTransaction{
+		ByzCoinID:      c.ByzCoin.ID,
+		InstanceID:     c.InstanceID,
+		TxHash:         txHash,
+		DisableStack:   cfg.DisableStack,
+		DisableMemory:  cfg.DisableMemory,
+		DisableStorage: cfg.DisableStorage,
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	trace := &TraceResult{}
+	err = json.Unmarshal(reply.Trace, trace)
+	if err != nil {
+		return nil, err
+	}
+	return trace, nil
+}
+
+// TraceCalls returns the call tree of the transaction txHash.
+func (c *Client) TraceCalls(txHash common.Hash) (*CallFrame, error) {
+	reply := &TraceCallsReply{}
+	err := c.SendProtobuf(c.ByzCoin.Roster.List[0], &TraceCalls{
+		ByzCoinID:  c.ByzCoin.ID,
+		InstanceID: c.InstanceID,
+		TxHash:     txHash,
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	tree := &CallFrame{}
+	err = json.Unmarshal(reply.Trace, tree)
+	if err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+// ProfileGas returns the gas profile of the transactions txHashes. The
+// functions of the contracts whose ABI is given are named in the profile.
+func (c *Client) ProfileGas(txHashes []common.Hash, abis ...abi.ABI) (*GasProfile, error) {
+	reply := &ProfileGasReply{}
+	err := c.SendProtobuf(c.ByzCoin.Roster.List[0], &ProfileGas{
+		ByzCoinID:  c.ByzCoin.ID,
+		InstanceID: c.InstanceID,
+		TxHashes:   txHashes,
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	profile := NewGasProfile()
+	err = json.Unmarshal(reply.Profile, profile)
+	if err != nil {
+		return nil, err
+	}
+	for _, contractAbi := range abis {
+		profile.Name(contractAbi)
+	}
+	return profile, nil
+}
+
+// Deposit fetches amount coins from the coin instance coinID and credits
+// their value, WeiPerCoin wei per coin, to address. The signer must be
+// allowed to invoke:fetch on the coin instance and invoke:deposit on the bvm.
+func (c *Client) Deposit(coinID byzcoin.InstanceID, amount uint64, address common.Address) error {
+	args := depositArgs(address, amount)
+	return c.addInstructions(
+		byzcoin.Instruction{
+			InstanceID: coinID,
+			Invoke: &byzcoin.Invoke{
+				Command: "fetch",
+				Args:    byzcoin.Arguments{args[1]},
+			},
+		},
+		byzcoin.Instruction{
+			InstanceID: c.InstanceID,
+			Invoke: &byzcoin.Invoke{
+				Command: "deposit",
+				Args:    args,
+			},
+		},
+	)
+}
+
+// AddInvariant attaches inv to its contract, it is checked after every
+// transaction. The signer must be allowed to invoke:invariant.
+func (c *Client) AddInvariant(inv Invariant) error {
+	return c.invoke("invariant", invariantArgs(inv, false))
+}
+
+// RemoveInvariant removes the invariant name of the contract at address.
+func (c *Client) RemoveInvariant(address common.Address, name string) error {
+	return c.invoke("invariant", invariantArgs(Invariant{Address: address, Name: name}, true))
+}
+
+// Bind binds the address of key to the signer of the client. The signer must
+// be allowed to invoke:bind.
+func (c *Client) Bind(key *Key) error {
+	args, err := bindArgs(c.InstanceID, c.Signer.Identity().String(), key)
+	if err != nil {
+		return err
+	}
+	return c.invoke("bind", args)
+}
+
+// Unbind removes the binding of address, which must be bound to the signer
+// of the client.
+func (c *Client) Unbind(address common.Address) error {
+	return c.invoke("bind", unbindArgs(address))
+}
+
+// EnforceBindings turns on or off the check that the senders of the
+// transactions are bound to the signers of the instructions. The signer
+// must be allowed to invoke:enforceBindings.
+func (c *Client) EnforceBindings(enforce bool) error {
+	return c.invoke("enforceBindings", enforceArgs(enforce))
+}
+
+// ApproveCode adds the provenance of verified code to the registry of the
+// bvm instance. The signer must be allowed to invoke:approveCode.
+func (c *Client) ApproveCode(code ApprovedCode) error {
+	return c.invoke("approveCode", approveCodeArgs(code, false))
+}
+
+// RevokeCode removes the code codeHash from the registry.
+func (c *Client) RevokeCode(codeHash common.Hash) error {
+	return c.invoke("approveCode", approveCodeArgs(ApprovedCode{CodeHash: codeHash}, true))
+}
+
+// EnforceApprovedCode turns on or off the check that the deployed contracts
+// have approved code. The signer must be allowed to
+// invoke:enforceApprovedCode.
+func (c *Client) EnforceApprovedCode(enforce bool) error {
+	return c.invoke("enforceApprovedCode", enforceArgs(enforce))
+}
+
+// SpawnGasLimits puts the gas limits l on the ledger, guarded by the genesis
+// darc darcID. The signer must be allowed to spawn:bvmGasLimits on the
+// genesis darc.
+func (c *Client) SpawnGasLimits(darcID darc.ID, l GasLimits) error {
+	return c.addInstructions(byzcoin.Instruction{
+		InstanceID: byzcoin.NewInstanceID(darcID),
+		Spawn: &byzcoin.Spawn{
+			ContractID: ContractBvmGasLimitsID,
+			Args:       gasLimitsArgs(l),
+		},
+	})
+}
+
+// SetGasLimits changes the gas limits of the ledger to l. The signer must
+// be allowed to invoke:setLimits on the darc of the limits.
+func (c *Client) SetGasLimits(l GasLimits) error {
+	return c.addInstructions(byzcoin.Instruction{
+		InstanceID: GasLimitsID,
+		Invoke: &byzcoin.Invoke{
+			Command: "setLimits",
+			Args:    gasLimitsArgs(l),
+		},
+	})
+}
+
+// RegisterContract names the contract deployed by the transaction deployTx
+// in the registry of the bvm instance. The signer owns the name, and must
+// be allowed to invoke:register.
+func (c *Client) RegisterContract(name string, deployTx common.Hash, abi string, sourceHash common.Hash) error {
+	return c.invoke("register", registerArgs(RegisteredContract{Name: name, DeployTx: deployTx, ABI: abi, SourceHash: sourceHash}, false))
+}
+
+// UnregisterContract removes the contract name from the registry. The
+// signer must own the name.
+func (c *Client) UnregisterContract(name string) error {
+	return c.invoke("register", registerArgs(RegisteredContract{Name: name}, true))
+}
+
+// LookupContract returns the contract name of the registry.
+func (c *Client) LookupContract(name string) (*RegisteredContract, error) {
+	if name == "" {
+		return nil, errors.New("no contract name")
+	}
+	contracts, err := c.getContracts(name)
+	if err != nil {
+		return nil, err
+	}
+	return &contracts[0], nil
+}
+
+// Contracts returns all the contracts of the registry.
+func (c *Client) Contracts() ([]RegisteredContract, error) {
+	return c.getContracts("")
+}
+
+func (c *Client) getContracts(name string) ([]RegisteredContract, error) {
+	reply := &GetContractReply{}
+	err := c.SendProtobuf(c.ByzCoin.Roster.List[0], &GetContract{
+		ByzCoinID:  c.ByzCoin.ID,
+		InstanceID: c.InstanceID,
+		Name:       name,
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	var contracts []RegisteredContract
+	err = json.Unmarshal(reply.Contracts, &contracts)
+	if err != nil {
+		return nil, err
+	}
+	if name != "" && len(contracts) != 1 {
+		return nil, errors.New("no contract " + name)
+	}
+	return contracts, nil
+}
+
+// Deploy deploys the contract bytecode with key, and returns the address of
+// the new contract. If the deployment is included but reverted, the
+// transaction and the address it was computed for are returned with a
+// *RevertError.
+func (c *Client) Deploy(key *Key, bytecode []byte, value *big.Int) (common.Address, *types.Transaction, error) {
+	tx, err := c.send(key, nil, value, bytecode)
+	if tx == nil {
+		return common.Address{}, nil, err
+	}
+	return crypto.CreateAddress(key.Address, tx.Nonce()), tx, err
+}
+
+// Transact sends a transaction from key to the address to, carrying data. If
+// the transaction is included but reverted, the transaction is returned with
+// a *RevertError.
+func (c *Client) Transact(key *Key, to common.Address, value *big.Int, data []byte) (*types.Transaction, error) {
+	return c.send(key, &to, value, data)
+}
+
+// SendTx sends an already signed transaction to the bvm.
+func (c *Client) SendTx(signedTx *types.Transaction) error {
+	txBuf, err := signedTx.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	return c.invoke("transaction", byzcoin.Arguments{{Name: "tx", Value: txBuf}})
+}
+
+// send sends a transaction from key with the nonce manager and the gas
+// parameters of the client.
+func (c *Client) send(key *Key, to *common.Address, value *big.Int, data []byte) (*types.Transaction, error) {
+	return sendTransaction(c, txParams{nonces: c.Nonces, gasLimit: c.GasLimit, gasPrice: c.GasPrice}, key, to, value, data)
+}
+
+// invoke sends a byzcoin transaction invoking command on the bvm instance
+// and waits for it to be included.
+func (c *Client) invoke(command string, args byzcoin.Arguments) error {
+	return c.addInstructions(byzcoin.Instruction{
+		InstanceID: c.InstanceID,
+		Invoke: &byzcoin.Invoke{
+			Command: command,
+			Args:    args,
+		},
+	})
+}
+
+// addInstructions sends a byzcoin transaction made of instructions, signed
+// with the next counters of the signer, and waits for it to be included.
+func (c *Client) addInstructions(instructions ...byzcoin.Instruction) error {
+	counters, err := c.ByzCoin.GetSignerCounters(c.Signer.Identity().String())
+	if err != nil {
+		return err
+	}
+	if len(counters.Counters) != 1 {
+		return errors.New("could not get the signer counter")
+	}
+	for i := range instructions {
+		instructions[i].SignerCounter = []uint64{counters.Counters[0] + uint64(i) + 1}
+	}
+	ctx := byzcoin.ClientTransaction{Instructions: instructions}
+	err = ctx.SignWith(c.Signer)
+	if err != nil {
+		return err
+	}
+	_, err = c.ByzCoin.AddTransactionAndWait(ctx, c.Wait)
+	return err
+}
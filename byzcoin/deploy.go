@@ -0,0 +1,55 @@
+package byzcoin
+
+import (
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/darc"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state"
+)
+
+// Deployments are authorized separately from the other transactions, so
+// that the operators of a bvm instance can restrict them to audited
+// contracts. Once the darc of the bvm instance has a DeployRule, the
+// transactions creating a contract must be carried by instructions whose
+// signers satisfy it, on top of invoke:transaction. Without the rule, anyone
+// allowed to invoke:transaction can deploy.
+//
+// The contracts created by the CREATEs and CREATE2s of other contracts are
+// deployments as well: once the transaction is executed, it fails with its
+// instruction if it created a contract and the signers don't satisfy the
+// rule, so that no factory can deploy for them.
+
+// DeployRule is the rule of the darc of the bvm instance that restricts the
+// deployments.
+var DeployRule = darc.Action("invoke:deploy")
+
+// checkDeployRule returns an error if deploys is true and the signers of
+// inst don't satisfy the DeployRule of the darc darcID.
+func checkDeployRule(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, darcID darc.ID, deploys bool) error {
+	if !deploys {
+		return nil
+	}
+	d, err := byzcoin.LoadDarcFromTrie(rst, darcID)
+	if err != nil {
+		return err
+	}
+	if d.Rules.Get(DeployRule) == nil {
+		return nil
+	}
+	var ids []string
+	for _, id := range inst.SignerIdentities {
+		ids = append(ids, id.String())
+	}
+	return evalRule(rst, darcID, DeployRule, ids...)
+}
+
+// deployed tells if one of the contracts created at addresses has code, the
+// others were reverted.
+func deployed(db *state.StateDB, addresses []common.Address) bool {
+	for _, address := range addresses {
+		if db.GetCodeSize(address) > 0 {
+			return true
+		}
+	}
+	return false
+}
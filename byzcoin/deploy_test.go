@@ -0,0 +1,49 @@
+package byzcoin
+
+import (
+	"testing"
+
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/darc/expression"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/require"
+)
+
+//Restricts the deployments with the deploy rule of the darc of the instance
+func TestDeployRule(t *testing.T) {
+	sb, keyA := newFundedBackend(t)
+	defer sb.Close()
+
+	//Without the rule, anyone can deploy
+	_, _, err := sb.Deploy(keyA, emitterCode(), nil)
+	require.Nil(t, err)
+	factory, _, err := sb.Deploy(keyA, factoryCode(nil), nil)
+	require.Nil(t, err)
+
+	auditor := darc.NewSignerEd25519(nil, nil)
+	require.Nil(t, sb.SetRule(DeployRule, expression.Expr(auditor.Identity().String())))
+	nonce, err := sb.GetNonce(keyA.Address)
+	require.Nil(t, err)
+	_, _, err = sb.Deploy(keyA, emitterCode(), nil)
+	require.NotNil(t, err)
+	//The failed instruction doesn't use the nonce, and the other transactions are still allowed
+	_, err = sb.Transact(keyA, common.HexToAddress("0x2887A24130cACFD8f71C479d9f9Da5b9C6425CE8"), nil, nil)
+	require.Nil(t, err)
+	next, err := sb.GetNonce(keyA.Address)
+	require.Nil(t, err)
+	require.Equal(t, nonce+1, next)
+
+	//A factory can't deploy for a signer without the rule, creating an empty account is not a deployment
+	_, err = sb.Transact(keyA, factory, nil, emitterCode())
+	require.NotNil(t, err)
+	_, err = sb.Transact(keyA, factory, nil, nil)
+	require.Nil(t, err)
+
+	signer := sb.Signer
+	sb.Signer = auditor
+	_, _, err = sb.Deploy(keyA, emitterCode(), nil)
+	require.Nil(t, err)
+	_, err = sb.Transact(keyA, factory, nil, emitterCode())
+	require.Nil(t, err)
+	sb.Signer = signer
+}
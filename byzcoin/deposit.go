@@ -0,0 +1,132 @@
+package byzcoin
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/byzcoin/contracts"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Deposits bring byzcoin coins into the bvm. The coins are fetched from a
+// coin instance by a previous instruction of the same byzcoin transaction,
+// and consumed by the deposit instruction, which credits their value in wei
+// to an Ethereum address. This way the ether of the bvm is backed by coins
+// taken out of the ledger, instead of being created by the credit faucet.
+//
+// The coins deposited and not withdrawn yet are counted in the memory
+// database. Withdrawals can't take out more, so ether created otherwise,
+// like by the faucet of the tests, never becomes coins.
+
+// WeiPerCoin is the value in wei of one byzcoin coin: a coin is worth one
+// ether.
+var WeiPerCoin = big.NewInt(1e18)
+
+// depositedKey is the key of the number of coins deposited and not withdrawn.
+var depositedKey = []byte("bvm-deposited")
+
+// depositCoins takes amount coins named contracts.CoinName out of coins,
+// all of them if amount is 0. It returns their value in wei and the coins
+// left, to be passed to the next instruction.
+func depositCoins(coins []byzcoin.Coin, amount uint64) (*big.Int, []byzcoin.Coin, error) {
+	available := uint64(0)
+	for _, coin := range coins {
+		if coin.Name.Equal(contracts.CoinName) {
+			available += coin.Value
+		}
+	}
+	if amount == 0 {
+		amount = available
+	}
+	if amount == 0 {
+		return nil, nil, errors.New("no coins to deposit")
+	}
+	if amount > available {
+		return nil, nil, errors.New("not enough coins to deposit")
+	}
+
+	wei := new(big.Int).Mul(new(big.Int).SetUint64(amount), WeiPerCoin)
+	var rest []byzcoin.Coin
+	for _, coin := range coins {
+		if coin.Name.Equal(contracts.CoinName) && amount > 0 {
+			taken := coin.Value
+			if taken > amount {
+				taken = amount
+			}
+			coin.Value -= taken
+			amount -= taken
+			if coin.Value == 0 {
+				continue
+			}
+		}
+		rest = append(rest, coin)
+	}
+	return wei, rest, nil
+}
+
+// depositArgs returns the arguments of a deposit of amount coins to the
+// address, encoded like the arguments of the coin contract.
+func depositArgs(address common.Address, amount uint64) byzcoin.Arguments {
+	amountBuf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(amountBuf, amount)
+	return byzcoin.Arguments{
+		{Name: "address", Value: []byte(address.Hex())},
+		{Name: "coins", Value: amountBuf},
+	}
+}
+
+// getDeposited returns the number of coins deposited in the bvm and not
+// withdrawn yet.
+func getDeposited(memdb *MemDatabase) (uint64, error) {
+	ok, err := memdb.Has(depositedKey)
+	if err != nil || !ok {
+		return 0, err
+	}
+	buf, err := memdb.Get(depositedKey)
+	if err != nil {
+		return 0, err
+	}
+	var deposited uint64
+	err = json.Unmarshal(buf, &deposited)
+	if err != nil {
+		return 0, err
+	}
+	return deposited, nil
+}
+
+func putDeposited(memdb *MemDatabase, deposited uint64) error {
+	buf, err := json.Marshal(deposited)
+	if err != nil {
+		return err
+	}
+	return memdb.Put(depositedKey, buf)
+}
+
+// addDeposited counts coins more deposited coins.
+func addDeposited(memdb *MemDatabase, coins uint64) error {
+	deposited, err := getDeposited(memdb)
+	if err != nil {
+		return err
+	}
+	if deposited+coins < deposited {
+		return errors.New("too many coins deposited")
+	}
+	return putDeposited(memdb, deposited+coins)
+}
+
+// takeDeposited counts coins withdrawn coins, it returns an error if fewer
+// were deposited.
+func takeDeposited(memdb *MemDatabase, coins uint64) error {
+	deposited, err := getDeposited(memdb)
+	if err != nil {
+		return err
+	}
+	if coins > deposited {
+		return fmt.Errorf("withdrawing %d coins, but only %d were deposited", coins, deposited)
+	}
+	return putDeposited(memdb, deposited-coins)
+}
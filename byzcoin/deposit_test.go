@@ -0,0 +1,84 @@
+package byzcoin
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/byzcoin/contracts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/require"
+)
+
+//Takes byzcoins out of the coins attached to an instruction, leaving the other coins
+func TestDepositCoins(t *testing.T) {
+	other := byzcoin.NewInstanceID([]byte("other coin"))
+	coins := []byzcoin.Coin{
+		{Name: contracts.CoinName, Value: 3},
+		{Name: other, Value: 10},
+		{Name: contracts.CoinName, Value: 4},
+	}
+
+	wei, rest, err := depositCoins(coins, 5)
+	require.Nil(t, err)
+	require.Equal(t, new(big.Int).Mul(big.NewInt(5), WeiPerCoin), wei)
+	require.Equal(t, []byzcoin.Coin{{Name: other, Value: 10}, {Name: contracts.CoinName, Value: 2}}, rest)
+
+	//Without an amount, all the byzcoins are deposited
+	wei, rest, err = depositCoins(coins, 0)
+	require.Nil(t, err)
+	require.Equal(t, new(big.Int).Mul(big.NewInt(7), WeiPerCoin), wei)
+	require.Equal(t, []byzcoin.Coin{{Name: other, Value: 10}}, rest)
+
+	_, _, err = depositCoins(coins, 8)
+	require.NotNil(t, err)
+	_, _, err = depositCoins(rest, 0)
+	require.NotNil(t, err)
+}
+
+//The deposit instruction credits the value of the coins and passes the others on
+func TestDeposit(t *testing.T) {
+	sb, err := NewSimulatedBackend()
+	require.Nil(t, err)
+	defer sb.Close()
+	address := common.HexToAddress("0x2887A24130cACFD8f71C479d9f9Da5b9C6425CE8")
+
+	require.Nil(t, sb.Deposit(2, address))
+	balance, err := sb.GetBalance(address)
+	require.Nil(t, err)
+	require.Equal(t, new(big.Int).Mul(big.NewInt(2), WeiPerCoin), balance)
+
+	coins := []byzcoin.Coin{{Name: contracts.CoinName, Value: 5}}
+	cout, err := sb.InvokeWithCoins("deposit", depositArgs(address, 3), coins)
+	require.Nil(t, err)
+	require.Equal(t, []byzcoin.Coin{{Name: contracts.CoinName, Value: 2}}, cout)
+	balance, err = sb.GetBalance(address)
+	require.Nil(t, err)
+	require.Equal(t, new(big.Int).Mul(big.NewInt(5), WeiPerCoin), balance)
+
+	//Nothing is credited without coins
+	_, err = sb.InvokeWithCoins("deposit", depositArgs(address, 1), nil)
+	require.NotNil(t, err)
+}
+
+//Without the faucet of the tests, ether only enters by depositing coins
+func TestCredit_Disabled(t *testing.T) {
+	sb, err := NewSimulatedBackend()
+	require.Nil(t, err)
+	defer sb.Close()
+	address := common.HexToAddress("0x2887A24130cACFD8f71C479d9f9Da5b9C6425CE8")
+	args := byzcoin.Arguments{{Name: "address", Value: []byte(address.Hex())}}
+
+	faucetEnabled = false
+	defer func() { faucetEnabled = true }()
+	require.NotNil(t, sb.Invoke("credit", args))
+	balance, err := sb.GetBalance(address)
+	require.Nil(t, err)
+	require.Equal(t, 0, balance.Sign())
+
+	faucetEnabled = true
+	require.Nil(t, sb.Invoke("credit", args))
+	balance, err = sb.GetBalance(address)
+	require.Nil(t, err)
+	require.Equal(t, big.NewInt(1e18*5), balance)
+}
@@ -0,0 +1,234 @@
+package byzcoin
+
+import (
+	"fmt"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/stretchr/testify/require"
+)
+
+// The differential tests run the same transactions through sendTx and
+// through core.ApplyTransaction with the chain config of the main network,
+// and report where the two executions diverge. The reference is a stock geth
+// EVM: the system contracts of the bvm are not in its precompiled contracts.
+
+//divergence is a difference between the bvm and the geth executions of the transaction at index Tx
+type divergence struct {
+	Tx    int
+	Field string
+	Bvm   interface{}
+	Geth  interface{}
+}
+
+func (d divergence) String() string {
+	return fmt.Sprintf("tx %d: %s is %v in the bvm and %v in geth", d.Tx, d.Field, d.Bvm, d.Geth)
+}
+
+//gethReference is the context of a stock geth node applying the transactions
+type gethReference struct {
+	config *params.ChainConfig
+	header *types.Header
+}
+
+//mainnetReference returns the context of a main network block after the Byzantium fork, mined by coinbase
+func mainnetReference(coinbase common.Address) *gethReference {
+	return &gethReference{
+		config: params.MainnetChainConfig,
+		header: &types.Header{
+			Number:     new(big.Int).Set(params.MainnetChainConfig.ByzantiumBlock),
+			Coinbase:   coinbase,
+			Difficulty: big.NewInt(1),
+			GasLimit:   8000000,
+			Time:       big.NewInt(1508131331),
+		},
+	}
+}
+
+//referenceChain is the chain context of the reference, it knows no previous header
+type referenceChain struct{}
+
+func (referenceChain) Engine() consensus.Engine {
+	return ethash.NewFaker()
+}
+
+func (referenceChain) GetHeader(common.Hash, uint64) *types.Header {
+	return nil
+}
+
+//apply applies tx to db like geth does. Every bvm transaction is a byzcoin instruction with its own gas pool, so
+//every transaction is applied as the only one of its block, and the cumulative gas used can be compared.
+func (ref *gethReference) apply(tx *types.Transaction, db *state.StateDB) (*types.Receipt, error) {
+	gp := new(core.GasPool).AddGas(ref.header.GasLimit)
+	usedGas := uint64(0)
+	db.Prepare(tx.Hash(), common.Hash{}, 0)
+	receipt, _, err := core.ApplyTransaction(ref.config, referenceChain{}, &ref.header.Coinbase, gp, db, ref.header, tx,
+		&usedGas, vm.Config{})
+	return receipt, err
+}
+
+//runDifferential credits the alloc balances on empty states, applies txs on both, and returns the divergences in
+//errors, receipts, gas and state root after every transaction
+func runDifferential(t *testing.T, ref *gethReference, alloc map[common.Address]*big.Int,
+	txs []*types.Transaction) []divergence {
+	_, bvmDB, err := getDB(ES{DbBuf: []byte{}})
+	require.Nil(t, err)
+	gethDB, err := state.New(common.Hash{}, state.NewDatabase(ethdb.NewMemDatabase()))
+	require.Nil(t, err)
+	for address, balance := range alloc {
+		bvmDB.SetBalance(address, balance)
+		gethDB.SetBalance(address, balance)
+	}
+
+	var divergences []divergence
+	diverge := func(i int, field string, bvm, geth interface{}) {
+		if !reflect.DeepEqual(bvm, geth) {
+			divergences = append(divergences, divergence{Tx: i, Field: field, Bvm: bvm, Geth: geth})
+		}
+	}
+	for i, tx := range txs {
+		bvmReceipt, bvmErr := sendTx(tx, bvmDB)
+		gethReceipt, gethErr := ref.apply(tx, gethDB)
+		diverge(i, "error", bvmErr != nil, gethErr != nil)
+		if bvmErr == nil && gethErr == nil {
+			diverge(i, "status", bvmReceipt.Status, gethReceipt.Status)
+			diverge(i, "gas used", bvmReceipt.GasUsed, gethReceipt.GasUsed)
+			diverge(i, "cumulative gas used", bvmReceipt.CumulativeGasUsed, gethReceipt.CumulativeGasUsed)
+			diverge(i, "contract address", bvmReceipt.ContractAddress, gethReceipt.ContractAddress)
+			diverge(i, "logs", logFields(bvmReceipt.Logs), logFields(gethReceipt.Logs))
+			diverge(i, "bloom", bvmReceipt.Bloom, gethReceipt.Bloom)
+		}
+		diverge(i, "state root", bvmDB.IntermediateRoot(true), gethDB.IntermediateRoot(true))
+	}
+	return divergences
+}
+
+//logFields keeps the fields of the logs set by the execution, the block fields are not known to the bvm
+func logFields(logs []*types.Log) []types.Log {
+	fields := []types.Log{}
+	for _, l := range logs {
+		fields = append(fields, types.Log{Address: l.Address, Topics: l.Topics, Data: l.Data})
+	}
+	return fields
+}
+
+//tokenSequence returns transactions deploying a MinimumToken, transferring tokens and ether, one transfer
+//reverting and one transaction having a wrong nonce
+func tokenSequence(t *testing.T, f *tokenFixture, gasLimit uint64) []*types.Transaction {
+	_, gasPrice := transactionGasParameters()
+	token := crypto.CreateAddress(f.addressA, 0)
+	unsigned := []*types.Transaction{
+		types.NewContractCreation(0, big.NewInt(0), gasLimit, gasPrice, f.code),
+		types.NewTransaction(1, token, big.NewInt(0), gasLimit, gasPrice, f.transfer(t, f.addressB, 10)),
+		types.NewTransaction(2, token, big.NewInt(0), gasLimit, gasPrice, f.transfer(t, f.addressB, 1000)),
+		types.NewTransaction(3, f.addressB, big.NewInt(1e9), gasLimit, gasPrice, nil),
+		types.NewTransaction(10, f.addressB, big.NewInt(1e9), gasLimit, gasPrice, nil),
+	}
+	var txs []*types.Transaction
+	for _, tx := range unsigned {
+		txs = append(txs, f.signTx(t, tx))
+	}
+	return txs
+}
+
+//With the same fee recipient, token and ether transfers execute as on the main network
+func TestDifferential_Token(t *testing.T) {
+	token := newTokenFixture(t)
+	alloc := map[common.Address]*big.Int{token.addressA: big.NewInt(1e18 * 5)}
+
+	divergences := runDifferential(t, mainnetReference(nilAddress), alloc, tokenSequence(t, token, 3e6))
+	require.Empty(t, divergences, "%v", divergences)
+}
+
+//The bvm gives the fees to nilAddress and has higher gas limits than the main network, which geth reports as divergences
+func TestDifferential_BlockContext(t *testing.T) {
+	token := newTokenFixture(t)
+	alloc := map[common.Address]*big.Int{token.addressA: big.NewInt(1e18 * 5)}
+	miner := common.HexToAddress("0x1000000000000000000000000000000000000001")
+
+	//The receipts match, the states differ by the balance of the fee recipient
+	divergences := runDifferential(t, mainnetReference(miner), alloc, tokenSequence(t, token, 3e6))
+	require.Equal(t, 5, len(divergences), "%v", divergences)
+	for i, d := range divergences {
+		require.Equal(t, i, d.Tx)
+		require.Equal(t, "state root", d.Field)
+	}
+
+	//Transactions above the block gas limit of the main network, but within the limits of the bvm, are only applied by the bvm
+	gasLimit, _ := transactionGasParameters()
+	divergences = runDifferential(t, mainnetReference(nilAddress), alloc, tokenSequence(t, token, gasLimit))
+	require.NotEmpty(t, divergences)
+	require.Equal(t, divergence{Tx: 0, Field: "error", Bvm: false, Geth: true}, divergences[0])
+}
+
+//factoryCode deploys a contract whose calls CREATE a contract with the init code INVALID, which uses all the gas it is
+//given, and then store 1 in the slot 0
+var factoryCode = common.Hex2Bytes("6013600c60003960136000f3" + "60fe600053600160006000f0506001600055" + "00")
+
+//loanSequence returns transactions deploying a ModifiedToken and a LoanContract, giving the loan its tokens and
+//checking them, with an inner call from the loan to the token, then deploying and calling the factory
+func loanSequence(t *testing.T, f *tokenFixture, gasLimit uint64) []*types.Transaction {
+	_, gasPrice := transactionGasParameters()
+	rawAbi, tokenCode, err := getSmartContract("ModifiedToken")
+	require.Nil(t, err)
+	tokenAbi, err := abi.JSON(strings.NewReader(rawAbi))
+	require.Nil(t, err)
+	rawAbi, loanCode, err := getSmartContract("LoanContract")
+	require.Nil(t, err)
+	loanAbi, err := abi.JSON(strings.NewReader(rawAbi))
+	require.Nil(t, err)
+
+	token := crypto.CreateAddress(f.addressA, 0)
+	loan := crypto.CreateAddress(f.addressA, 1)
+	factory := crypto.CreateAddress(f.addressA, 4)
+	constructorArgs, err := loanAbi.Pack("", big.NewInt(1e9), big.NewInt(1), big.NewInt(100), "TOK", token, big.NewInt(10))
+	require.Nil(t, err)
+	create, err := tokenAbi.Pack("create", uint64(100), loan)
+	require.Nil(t, err)
+	checkTokens, err := loanAbi.Pack("checkTokens")
+	require.Nil(t, err)
+	unsigned := []*types.Transaction{
+		types.NewContractCreation(0, big.NewInt(0), gasLimit, gasPrice, common.Hex2Bytes(tokenCode)),
+		types.NewContractCreation(1, big.NewInt(0), gasLimit, gasPrice, append(common.Hex2Bytes(loanCode), constructorArgs...)),
+		types.NewTransaction(2, token, big.NewInt(0), gasLimit, gasPrice, create),
+		types.NewTransaction(3, loan, big.NewInt(0), gasLimit, gasPrice, checkTokens),
+		types.NewContractCreation(4, big.NewInt(0), gasLimit, gasPrice, factoryCode),
+		types.NewTransaction(5, factory, big.NewInt(0), gasLimit, gasPrice, nil),
+	}
+	var txs []*types.Transaction
+	for _, tx := range unsigned {
+		txs = append(txs, f.signTx(t, tx))
+	}
+	return txs
+}
+
+//The calls between contracts execute as on the main network, but the bvm doesn't enable EIP-150: a CREATE from a
+//contract gives it all the remaining gas instead of 63/64 of it, so the factory runs out of gas only in the bvm
+func TestDifferential_LoanContract(t *testing.T) {
+	token := newTokenFixture(t)
+	alloc := map[common.Address]*big.Int{token.addressA: big.NewInt(1e18 * 5)}
+	txs := loanSequence(t, token, 3e6)
+
+	divergences := runDifferential(t, mainnetReference(nilAddress), alloc, txs[:5])
+	require.Empty(t, divergences, "%v", divergences)
+
+	divergences = runDifferential(t, mainnetReference(nilAddress), alloc, txs)
+	require.NotEmpty(t, divergences)
+	require.Equal(t, divergence{Tx: 5, Field: "status", Bvm: uint64(0), Geth: uint64(1)}, divergences[0])
+	for _, d := range divergences {
+		require.Equal(t, 5, d.Tx)
+	}
+}
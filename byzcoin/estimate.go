@@ -0,0 +1,65 @@
+package byzcoin
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// estimateGas returns the lowest gas limit with which the transaction sent by
+// from succeeds on the state es, the system contracts reading rst. Nothing
+// is committed. If the transaction reverts even with the highest gas limit,
+// a *RevertError is returned.
+func estimateGas(es ES, rst byzcoin.ReadOnlyStateTrie, from common.Address, to *common.Address, value *big.Int, data []byte, hi uint64) (uint64, error) {
+	_, db, err := getDB(es)
+	if err != nil {
+		return 0, err
+	}
+	if value == nil {
+		value = big.NewInt(0)
+	}
+	// The highest gas limit tried is the transaction limit
+	limits, err := getGasLimits(rst)
+	if err != nil {
+		return 0, err
+	}
+	if hi == 0 || hi > limits.Transaction {
+		hi = limits.Transaction
+	}
+	nonce := db.GetNonce(from)
+
+	// run executes the transaction with the given gas limit on a copy of the
+	// state. The gas price is zero, so that the balance of the sender only
+	// needs to cover the value.
+	run := func(gas uint64) ([]byte, bool, error) {
+		msg := types.NewMessage(from, to, nonce, value, gas, big.NewInt(0), data, false)
+		ret, _, failed, err := applyMessage(db.Copy(), rst, msg)
+		return ret, failed, err
+	}
+
+	ret, failed, err := run(hi)
+	if err != nil {
+		return 0, err
+	}
+	if failed {
+		if len(ret) == 0 {
+			return 0, fmt.Errorf("gas required exceeds %d or always failing transaction", hi)
+		}
+		return 0, newRevertError(ret)
+	}
+	lo := params.TxGas - 1
+	for lo+1 < hi {
+		mid := (lo + hi) / 2
+		_, failed, err := run(mid)
+		if err != nil || failed {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return hi, nil
+}
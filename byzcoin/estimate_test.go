@@ -0,0 +1,42 @@
+package byzcoin
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/stretchr/testify/require"
+)
+
+//Estimates the gas of MinimumToken transfers, one of them reverting
+func TestEstimateGas(t *testing.T) {
+	token, memdb, db := deployToken(t)
+	addressA, contractAddress := token.addressA, token.address
+	es, err := commitES(memdb, db)
+	require.Nil(t, err)
+
+	transfer := token.transfer(t, token.addressB, 1)
+	gas, err := estimateGas(es, nil, addressA, &contractAddress, nil, transfer, 0)
+	require.Nil(t, err)
+	require.True(t, gas > params.TxGas)
+
+	//The estimated gas is just enough
+	_, db, err = getDB(es)
+	require.Nil(t, err)
+	msg := types.NewMessage(addressA, &contractAddress, 1, big.NewInt(0), gas, big.NewInt(0), transfer, false)
+	_, _, failed, err := applyMessage(db.Copy(), nil, msg)
+	require.Nil(t, err)
+	require.False(t, failed)
+	msg = types.NewMessage(addressA, &contractAddress, 1, big.NewInt(0), gas-1, big.NewInt(0), transfer, false)
+	_, _, failed, err = applyMessage(db.Copy(), nil, msg)
+	require.True(t, err != nil || failed)
+
+	//Transferring more than the balance reverts with the reason given to require
+	transfer = token.transfer(t, token.addressB, 1000)
+	_, err = estimateGas(es, nil, addressA, &contractAddress, nil, transfer, 0)
+	require.NotNil(t, err)
+	revert, ok := err.(*RevertError)
+	require.True(t, ok)
+	require.Equal(t, "error", revert.Reason)
+}
@@ -0,0 +1,294 @@
+package byzcoin
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/big"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/protobuf"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// The gas of the Ethereum transactions is limited twice: every transaction
+// can use at most the Transaction limit, and all the transactions of a
+// byzcoin block, whatever their bvm instance, share the Block limit. The
+// gas used in the current block is kept in the instance GasBudgetID, which
+// the transaction instructions update: a transaction whose gas limit
+// exceeds what is left of the block budget fails, with its instruction.
+// The gas of the invariants and of the instructions asked by the contracts
+// is part of the gas used by a transaction, it counts in the budget.
+//
+// The limits are part of the consensus, so they are kept on the ledger, in
+// the instance GasLimitsID. As they apply to every bvm instance, it can only
+// be spawned from the genesis darc, the darc of the config instance, which
+// then guards it. Its setLimits command changes the limits. Until it is
+// spawned, the limits are DefaultGasLimits.
+
+// GasLimits are the gas caps of the transactions.
+type GasLimits struct {
+	// Transaction is the highest gas limit of a transaction
+	Transaction uint64
+	// Block is the gas shared by the transactions of a byzcoin block
+	Block uint64
+}
+
+// DefaultGasLimits are the limits used until the instance GasLimitsID is
+// spawned.
+var DefaultGasLimits = GasLimits{Transaction: 1e7, Block: 1e8}
+
+// ContractBvmGasLimitsID is the contract of the instance GasLimitsID.
+var ContractBvmGasLimitsID = "bvmGasLimits"
+
+// GasLimitsID is the instance holding the gas limits of all the bvm
+// instances of the ledger.
+var GasLimitsID = gasLimitsID()
+
+func gasLimitsID() byzcoin.InstanceID {
+	h := sha256.Sum256([]byte("bvm gas limits"))
+	return byzcoin.NewInstanceID(h[:])
+}
+
+// ContractBvmGasID is the contract of the instance GasBudgetID. It is not
+// registered, the instance can't be invoked.
+var ContractBvmGasID = "bvmGas"
+
+// GasBudgetID is the instance holding the gas used in the current block.
+var GasBudgetID = gasBudgetID()
+
+func gasBudgetID() byzcoin.InstanceID {
+	h := sha256.Sum256([]byte("bvm gas budget"))
+	return byzcoin.NewInstanceID(h[:])
+}
+
+// check returns an error if the limits can't be used.
+func (l GasLimits) check() error {
+	if l.Transaction == 0 || l.Block < l.Transaction {
+		return errors.New("the block limit must be at least the transaction limit, which can't be 0")
+	}
+	return nil
+}
+
+// gasLimitsArgs returns the arguments of the instructions setting the
+// limits l, 8 bytes little endian integers as for the coin contract.
+func gasLimitsArgs(l GasLimits) byzcoin.Arguments {
+	transaction := make([]byte, 8)
+	binary.LittleEndian.PutUint64(transaction, l.Transaction)
+	block := make([]byte, 8)
+	binary.LittleEndian.PutUint64(block, l.Block)
+	return byzcoin.Arguments{
+		{Name: "transaction", Value: transaction},
+		{Name: "block", Value: block},
+	}
+}
+
+// gasLimitsFromArgs returns the limits given by the arguments args.
+func gasLimitsFromArgs(args byzcoin.Arguments) (GasLimits, error) {
+	transaction := args.Search("transaction")
+	block := args.Search("block")
+	if len(transaction) != 8 || len(block) != 8 {
+		return GasLimits{}, errors.New("the transaction and block limits must be 8 bytes little endian integers")
+	}
+	l := GasLimits{
+		Transaction: binary.LittleEndian.Uint64(transaction),
+		Block:       binary.LittleEndian.Uint64(block),
+	}
+	return l, l.check()
+}
+
+// contractGasLimits is the contract of the instance GasLimitsID.
+type contractGasLimits struct {
+	byzcoin.BasicContract
+	GasLimits
+}
+
+func contractGasLimitsFromBytes(in []byte) (byzcoin.Contract, error) {
+	c := &contractGasLimits{}
+	err := protobuf.Decode(in, &c.GasLimits)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Spawn creates the instance GasLimitsID, guarded by the genesis darc it is
+// spawned from, with the limits given by the transaction and block
+// arguments.
+func (c *contractGasLimits) Spawn(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, coins []byzcoin.Coin) (sc []byzcoin.StateChange, cout []byzcoin.Coin, err error) {
+	cout = coins
+	_, _, _, genesisDarcID, err := rst.GetValues(byzcoin.ConfigInstanceID.Slice())
+	if err != nil {
+		return nil, nil, err
+	}
+	if inst.InstanceID != byzcoin.NewInstanceID(genesisDarcID) {
+		return nil, nil, errors.New("the gas limits can only be spawned from the genesis darc")
+	}
+	_, _, _, _, err = rst.GetValues(GasLimitsID.Slice())
+	if err == nil {
+		return nil, nil, errors.New("the gas limits are already spawned")
+	}
+	if !isKeyNotSet(err) {
+		return nil, nil, err
+	}
+	l, err := gasLimitsFromArgs(inst.Spawn.Args)
+	if err != nil {
+		return nil, nil, err
+	}
+	buf, err := protobuf.Encode(&l)
+	if err != nil {
+		return nil, nil, err
+	}
+	sc = []byzcoin.StateChange{
+		byzcoin.NewStateChange(byzcoin.Create, GasLimitsID, ContractBvmGasLimitsID, buf, darc.ID(inst.InstanceID.Slice())),
+	}
+	return
+}
+
+// Invoke changes the limits with the setLimits command, whose arguments are
+// the ones of Spawn.
+func (c *contractGasLimits) Invoke(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, coins []byzcoin.Coin) (sc []byzcoin.StateChange, cout []byzcoin.Coin, err error) {
+	cout = coins
+	if inst.Invoke.Command != "setLimits" {
+		return nil, nil, errors.New("unknown command " + inst.Invoke.Command)
+	}
+	_, _, _, darcID, err := rst.GetValues(inst.InstanceID.Slice())
+	if err != nil {
+		return nil, nil, err
+	}
+	l, err := gasLimitsFromArgs(inst.Invoke.Args)
+	if err != nil {
+		return nil, nil, err
+	}
+	buf, err := protobuf.Encode(&l)
+	if err != nil {
+		return nil, nil, err
+	}
+	sc = []byzcoin.StateChange{
+		byzcoin.NewStateChange(byzcoin.Update, GasLimitsID, ContractBvmGasLimitsID, buf, darcID),
+	}
+	return
+}
+
+// errKeyNotSet is the error of the state tries for missing keys, with the
+// message of the byzcoin trie.
+var errKeyNotSet = errors.New("key not set")
+
+// isKeyNotSet tells if err is the error of a missing key. The byzcoin trie
+// doesn't export its error, so the messages are compared.
+func isKeyNotSet(err error) bool {
+	return err != nil && err.Error() == errKeyNotSet.Error()
+}
+
+// getGasLimits returns the limits kept on the ledger rst, DefaultGasLimits
+// if they are not spawned yet or if there is no ledger.
+func getGasLimits(rst byzcoin.ReadOnlyStateTrie) (GasLimits, error) {
+	if rst == nil {
+		return DefaultGasLimits, nil
+	}
+	value, _, contractID, _, err := rst.GetValues(GasLimitsID.Slice())
+	if isKeyNotSet(err) {
+		return DefaultGasLimits, nil
+	}
+	if err != nil {
+		return GasLimits{}, err
+	}
+	if contractID != ContractBvmGasLimitsID {
+		return GasLimits{}, errors.New("the gas limits instance has the wrong contract")
+	}
+	var l GasLimits
+	err = protobuf.Decode(value, &l)
+	if err != nil {
+		return GasLimits{}, err
+	}
+	return l, nil
+}
+
+// chargeGas adds gas used after the execution to the receipt, and takes its
+// price from the sender of tx, like the gas of the transaction.
+func chargeGas(db *state.StateDB, tx *types.Transaction, r *Receipt, gas uint64) error {
+	sender, err := txSender(tx)
+	if err != nil {
+		return err
+	}
+	fee := new(big.Int).Mul(new(big.Int).SetUint64(gas), tx.GasPrice())
+	db.SubBalance(sender, fee)
+	db.AddBalance(nilAddress, fee)
+	r.GasUsed += gas
+	r.CumulativeGasUsed += gas
+	return nil
+}
+
+// gasBudget is the value of the instance GasBudgetID.
+type gasBudget struct {
+	// BlockIndex is the index of the block of the transactions that used
+	// GasUsed
+	BlockIndex uint64
+	GasUsed    uint64
+}
+
+// availableGas returns the gas a transaction of the block being built on
+// rst can use.
+func availableGas(rst byzcoin.ReadOnlyStateTrie) (uint64, error) {
+	limits, err := getGasLimits(rst)
+	if err != nil {
+		return 0, err
+	}
+	budget, _, err := getGasBudget(rst)
+	if err != nil {
+		return 0, err
+	}
+	if budget.GasUsed >= limits.Block {
+		return 0, nil
+	}
+	if left := limits.Block - budget.GasUsed; left < limits.Transaction {
+		return left, nil
+	}
+	return limits.Transaction, nil
+}
+
+// spendGas returns the state change adding gasUsed to the gas used in the
+// block. The instance is created under darcID if it doesn't exist.
+func spendGas(rst byzcoin.ReadOnlyStateTrie, gasUsed uint64, darcID darc.ID) (byzcoin.StateChange, error) {
+	budget, budgetDarcID, err := getGasBudget(rst)
+	if err != nil {
+		return byzcoin.StateChange{}, err
+	}
+	budget.GasUsed += gasUsed
+	buf, err := protobuf.Encode(budget)
+	if err != nil {
+		return byzcoin.StateChange{}, err
+	}
+	if budgetDarcID == nil {
+		return byzcoin.NewStateChange(byzcoin.Create, GasBudgetID, ContractBvmGasID, buf, darcID), nil
+	}
+	return byzcoin.NewStateChange(byzcoin.Update, GasBudgetID, ContractBvmGasID, buf, budgetDarcID), nil
+}
+
+// getGasBudget returns the gas used in the block being built on rst, and
+// the darc of the instance GasBudgetID, nil if it doesn't exist yet.
+func getGasBudget(rst byzcoin.ReadOnlyStateTrie) (*gasBudget, darc.ID, error) {
+	// GetIndex is the index of the last block applied to the trie
+	block := uint64(rst.GetIndex() + 1)
+	value, _, contractID, darcID, err := rst.GetValues(GasBudgetID.Slice())
+	if isKeyNotSet(err) {
+		return &gasBudget{BlockIndex: block}, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if contractID != ContractBvmGasID {
+		return nil, nil, errors.New("the gas budget instance has the wrong contract")
+	}
+	budget := &gasBudget{}
+	err = protobuf.Decode(value, budget)
+	if err != nil {
+		return nil, nil, err
+	}
+	if budget.BlockIndex != block {
+		budget = &gasBudget{BlockIndex: block}
+	}
+	return budget, darcID, nil
+}
@@ -0,0 +1,101 @@
+package byzcoin
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/protobuf"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/require"
+)
+
+//Caps the gas of the transactions and shares the block budget between the instructions
+func TestGasLimits(t *testing.T) {
+	sb, keyA := newFundedBackend(t)
+	defer sb.Close()
+	addressB := common.HexToAddress("0x2887A24130cACFD8f71C479d9f9Da5b9C6425CE8")
+
+	//The limits are the default ones until they are spawned on the ledger, from the genesis darc only
+	limits, err := getGasLimits(sb.trie)
+	require.Nil(t, err)
+	require.Equal(t, DefaultGasLimits, limits)
+	other := darc.NewDarc(darc.InitRules(nil, nil), []byte("other"))
+	inst := byzcoin.Instruction{
+		InstanceID: byzcoin.NewInstanceID(other.GetBaseID()),
+		Spawn:      &byzcoin.Spawn{ContractID: ContractBvmGasLimitsID, Args: gasLimitsArgs(GasLimits{Transaction: 1, Block: 1})},
+	}
+	_, _, err = (&contractGasLimits{}).Spawn(sb.trie, inst, nil)
+	require.NotNil(t, err)
+	require.NotNil(t, sb.SetGasLimits(GasLimits{Transaction: 2e6, Block: 1e6}))
+	require.Nil(t, sb.SetGasLimits(GasLimits{Transaction: 2e6, Block: 2e6}))
+	require.Nil(t, sb.SetGasLimits(GasLimits{Transaction: 1e6, Block: 1e6 + 30000}))
+	limits, err = getGasLimits(sb.trie)
+	require.Nil(t, err)
+	require.Equal(t, GasLimits{Transaction: 1e6, Block: 1e6 + 30000}, limits)
+
+	//Above the transaction limit
+	sb.GasLimit = 2e6
+	_, err = sb.Transact(keyA, addressB, nil, nil)
+	require.NotNil(t, err)
+
+	//The simulated backend applies every instruction in a block of its own, the index is moved back so that the
+	//transactions share a block
+	sb.GasLimit = 1e6
+	sameBlock := func() {
+		sb.Lock()
+		sb.trie.index--
+		sb.Unlock()
+	}
+	_, err = sb.Transact(keyA, addressB, nil, nil)
+	require.Nil(t, err)
+	sameBlock()
+	_, err = sb.Transact(keyA, addressB, nil, nil)
+	require.Nil(t, err)
+	sameBlock()
+	value, _, contractID, _, err := sb.trie.GetValues(GasBudgetID.Slice())
+	require.Nil(t, err)
+	require.Equal(t, ContractBvmGasID, contractID)
+	budget := gasBudget{}
+	require.Nil(t, protobuf.Decode(value, &budget))
+	require.Equal(t, uint64(2*21000), budget.GasUsed)
+
+	//Less than the transaction limit is left in the block
+	_, err = sb.Transact(keyA, addressB, nil, nil)
+	require.NotNil(t, err)
+	sb.GasLimit = 9e5
+	_, err = sb.Transact(keyA, addressB, nil, nil)
+	require.Nil(t, err)
+
+	//The next block has the whole budget
+	sb.GasLimit = 1e6
+	_, err = sb.Transact(keyA, addressB, nil, nil)
+	require.Nil(t, err)
+}
+
+//failingTrie fails to read the instances
+type failingTrie struct {
+	*memStateTrie
+}
+
+func (t failingTrie) GetValues(key []byte) ([]byte, uint64, string, darc.ID, error) {
+	return nil, 0, "", nil, errors.New("unreadable trie")
+}
+
+//Only a missing instance is an empty budget or the default limits, the other errors are returned
+func TestGasBudgetErrors(t *testing.T) {
+	sb, err := NewSimulatedBackend()
+	require.Nil(t, err)
+	defer sb.Close()
+
+	budget, _, err := getGasBudget(sb.trie)
+	require.Nil(t, err)
+	require.Equal(t, uint64(0), budget.GasUsed)
+	_, _, err = getGasBudget(failingTrie{sb.trie})
+	require.NotNil(t, err)
+	_, err = getGasLimits(failingTrie{sb.trie})
+	require.NotNil(t, err)
+	_, err = availableGas(failingTrie{sb.trie})
+	require.NotNil(t, err)
+}
@@ -0,0 +1,335 @@
+package byzcoin
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/byzcoin/contracts"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/darc/expression"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Contracts ask for byzcoin instructions by emitting the event
+//
+//	event ByzcoinInstruction(bytes32 instanceID, string action, bytes args)
+//
+// where action is "spawn:<contract ID>" or "invoke:<command>", as in the
+// rules of the darcs, and args the arguments of the instruction, packed as
+// a sequence of
+//
+//	uint8 length of the name, name, uint32 length of the value, value
+//
+// Once the transaction succeeded, the instructions are executed in the
+// order of the events, after the Ethereum transaction, in the same byzcoin
+// instruction. They are authorised under the darc of the contract emitting
+// the event, ContractDarcID: the rule of the action in the darc of the
+// instance must be satisfied by darc:<ContractDarcID>, so that a darc only
+// trusts the contracts it names. If one of them fails, the whole byzcoin
+// instruction fails and the transaction is not applied. The events that
+// can't be decoded are not instructions, they are skipped.
+//
+// Each instruction costs instructionGas, taken from the gas left by the
+// transaction and counted in the block budget. If there is not enough gas
+// left, the byzcoin instruction fails.
+//
+// The instructions are given no coins. The coins returned by one are given
+// to the next, and the ones left are returned by the byzcoin instruction.
+//
+// The contracts the bvm can call are the ones registered with
+// RegisterInstructionContract, the coin and value contracts by default.
+
+// instructionTopic is the topic of the ByzcoinInstruction event.
+var instructionTopic = crypto.Keccak256Hash([]byte("ByzcoinInstruction(bytes32,string,bytes)"))
+
+// maxInstructions is the highest number of instructions a transaction can
+// ask for.
+const maxInstructions = 16
+
+// instructionGas is the gas charged to the transaction for each instruction
+// it asks for.
+const instructionGas = uint64(20000)
+
+var instructionArguments abi.Arguments
+
+var instructionContracts = struct {
+	sync.Mutex
+	m map[string]byzcoin.ContractFn
+}{m: map[string]byzcoin.ContractFn{}}
+
+func init() {
+	for _, t := range []string{"bytes32", "string", "bytes"} {
+		typ, err := abi.NewType(t)
+		if err != nil {
+			panic(err)
+		}
+		instructionArguments = append(instructionArguments, abi.Argument{Type: typ})
+	}
+	RegisterInstructionContract(contracts.ContractCoinID, contracts.ContractCoinFromBytes)
+	RegisterInstructionContract(contracts.ContractValueID, contracts.ContractValueFromBytes)
+}
+
+// RegisterInstructionContract allows the contracts running in the bvm to
+// spawn and invoke instances of the byzcoin contract contractID. Like the
+// byzcoin contracts, it must be registered by all the nodes.
+func RegisterInstructionContract(contractID string, f byzcoin.ContractFn) {
+	instructionContracts.Lock()
+	defer instructionContracts.Unlock()
+	instructionContracts.m[contractID] = f
+}
+
+func getInstructionContract(contractID string) (byzcoin.ContractFn, bool) {
+	instructionContracts.Lock()
+	defer instructionContracts.Unlock()
+	f, ok := instructionContracts.m[contractID]
+	return f, ok
+}
+
+// ContractDarcID returns the ID of the darc of the contract at address in
+// the bvm instance instID. It is created by the bvm with the first
+// instruction asked by the contract, and can only be signed by the bvm for
+// this contract.
+func ContractDarcID(instID byzcoin.InstanceID, address common.Address) darc.ID {
+	return contractDarc(instID, address).GetBaseID()
+}
+
+// contractDarc returns the darc of the contract at address in the bvm
+// instance instID. It has no evolve rule, it never changes.
+func contractDarc(instID byzcoin.InstanceID, address common.Address) *darc.Darc {
+	rules := darc.NewRules()
+	rules.AddRule(darc.Action("_sign"), expression.Expr(contractIdentity(instID, address)))
+	return darc.NewDarc(rules, []byte("bvm "+instID.String()+" "+address.Hex()))
+}
+
+// contractIdentity is the identity of the contract at address in the bvm
+// instance instID, with which the bvm signs the instructions asked by the
+// contract.
+func contractIdentity(instID byzcoin.InstanceID, address common.Address) string {
+	return "bvm:" + hex.EncodeToString(instID.Slice()) + hex.EncodeToString(address.Bytes())
+}
+
+// instructionRequest is an instruction asked by the contract at Contract.
+type instructionRequest struct {
+	Contract   common.Address
+	InstanceID byzcoin.InstanceID
+	Action     string
+	Args       byzcoin.Arguments
+}
+
+// instructionRequests returns the instructions asked by the logs of the
+// receipt. The logs that can't be decoded are skipped.
+func instructionRequests(r *Receipt) ([]instructionRequest, error) {
+	var requests []instructionRequest
+	for _, l := range r.Logs {
+		if len(l.Topics) != 1 || l.Topics[0] != instructionTopic {
+			continue
+		}
+		values, err := instructionArguments.UnpackValues(l.Data)
+		if err != nil {
+			continue
+		}
+		id := values[0].([32]byte)
+		args, err := unpackInstructionArgs(values[2].([]byte))
+		if err != nil {
+			continue
+		}
+		requests = append(requests, instructionRequest{
+			Contract:   l.Address,
+			InstanceID: byzcoin.NewInstanceID(id[:]),
+			Action:     values[1].(string),
+			Args:       args,
+		})
+	}
+	if len(requests) > maxInstructions {
+		return nil, fmt.Errorf("a transaction can ask for %d instructions at most", maxInstructions)
+	}
+	return requests, nil
+}
+
+// unpackInstructionArgs decodes the arguments of a ByzcoinInstruction event.
+func unpackInstructionArgs(buf []byte) (byzcoin.Arguments, error) {
+	var args byzcoin.Arguments
+	for len(buf) > 0 {
+		n := int(buf[0])
+		if len(buf) < 1+n+4 {
+			return nil, errors.New("truncated instruction argument")
+		}
+		name := string(buf[1 : 1+n])
+		buf = buf[1+n:]
+		m := int(binary.BigEndian.Uint32(buf))
+		if len(buf) < 4+m {
+			return nil, errors.New("truncated instruction argument")
+		}
+		args = append(args, byzcoin.Argument{Name: name, Value: buf[4 : 4+m]})
+		buf = buf[4+m:]
+	}
+	return args, nil
+}
+
+// PackInstructionArgs encodes args as the args of a ByzcoinInstruction
+// event.
+func PackInstructionArgs(args byzcoin.Arguments) []byte {
+	var buf []byte
+	for _, arg := range args {
+		buf = append(buf, byte(len(arg.Name)))
+		buf = append(buf, arg.Name...)
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(arg.Value)))
+		buf = append(buf, length...)
+		buf = append(buf, arg.Value...)
+	}
+	return buf
+}
+
+// executeRequests executes the instructions asked by the transaction txHash
+// of the bvm instance invoked by inst, on top of the state changes sc
+// already made by the instruction. It returns the state changes of the
+// instructions and the coins they returned.
+func executeRequests(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, sc []byzcoin.StateChange,
+	txHash common.Hash, requests []instructionRequest) ([]byzcoin.StateChange, []byzcoin.Coin, error) {
+	if len(requests) == 0 {
+		return nil, nil, nil
+	}
+	staged := newStagingTrie(rst)
+	staged.apply(sc)
+	var out []byzcoin.StateChange
+	var coins []byzcoin.Coin
+
+	for i, req := range requests {
+		// The darc of a contract is created with its first request
+		d := contractDarc(inst.InstanceID, req.Contract)
+		if _, _, _, _, err := staged.GetValues(d.GetBaseID()); err != nil {
+			darcBuf, err := d.ToProto()
+			if err != nil {
+				return nil, nil, err
+			}
+			created := byzcoin.NewStateChange(byzcoin.Create, byzcoin.NewInstanceID(d.GetBaseID()), byzcoin.ContractDarcID, darcBuf, d.GetBaseID())
+			staged.apply([]byzcoin.StateChange{created})
+			out = append(out, created)
+		}
+
+		var changes []byzcoin.StateChange
+		var err error
+		changes, coins, err = executeRequest(staged, inst.InstanceID, txHash, i, req, coins)
+		if err != nil {
+			return nil, nil, fmt.Errorf("instruction %d asked by the transaction: %v", i, err)
+		}
+		staged.apply(changes)
+		out = append(out, changes...)
+	}
+	return out, coins, nil
+}
+
+// executeRequest checks that the contract of the bvm instance bvmID can make
+// the instruction req, and executes it with coins. It returns the state
+// changes and the coins returned by the instruction.
+func executeRequest(rst byzcoin.ReadOnlyStateTrie, bvmID byzcoin.InstanceID, txHash common.Hash, index int,
+	req instructionRequest, coins []byzcoin.Coin) ([]byzcoin.StateChange, []byzcoin.Coin, error) {
+	// The hash of the Ethereum transaction and the counter make the IDs
+	// derived from the instruction unique
+	inst := byzcoin.Instruction{
+		InstanceID:    req.InstanceID,
+		SignerCounter: []uint64{uint64(index) + 1},
+	}
+	args := append(req.Args, byzcoin.Argument{Name: "bvmTx", Value: txHash.Bytes()})
+	value, _, contractID, darcID, err := rst.GetValues(req.InstanceID.Slice())
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case strings.HasPrefix(req.Action, "spawn:"):
+		contractID = strings.TrimPrefix(req.Action, "spawn:")
+		inst.Spawn = &byzcoin.Spawn{ContractID: contractID, Args: args}
+		value = nil
+	case strings.HasPrefix(req.Action, "invoke:"):
+		inst.Invoke = &byzcoin.Invoke{Command: strings.TrimPrefix(req.Action, "invoke:"), Args: args}
+	default:
+		return nil, nil, errors.New("unknown action " + req.Action)
+	}
+	if contractID == ContractBvmID {
+		return nil, nil, errors.New("the bvm can't send instructions to a bvm")
+	}
+	f, ok := getInstructionContract(contractID)
+	if !ok {
+		return nil, nil, errors.New("contract " + contractID + " is not registered for the bvm")
+	}
+
+	err = evalRule(rst, darcID, darc.Action(req.Action), contractIdentity(bvmID, req.Contract))
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := f(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	if inst.Spawn != nil {
+		return c.Spawn(rst, inst, coins)
+	}
+	return c.Invoke(rst, inst, coins)
+}
+
+// darcGetter returns the function reading the darcs named in the rules from
+// rst, for darc.EvalExpr.
+func darcGetter(rst byzcoin.ReadOnlyStateTrie) func(string, bool) *darc.Darc {
+	return func(s string, latest bool) *darc.Darc {
+		id, err := hex.DecodeString(strings.TrimPrefix(s, "darc:"))
+		if err != nil {
+			return nil
+		}
+		d, err := byzcoin.LoadDarcFromTrie(rst, id)
+		if err != nil {
+			return nil
+		}
+		return d
+	}
+}
+
+// stagingTrie is a state trie with the state changes of the instruction
+// applied on top, so that the instructions see the changes of the previous
+// ones. ForEach and GetProof only see the underlying trie.
+type stagingTrie struct {
+	byzcoin.ReadOnlyStateTrie
+	changes *memStateTrie
+	deleted map[string]bool
+}
+
+func newStagingTrie(rst byzcoin.ReadOnlyStateTrie) *stagingTrie {
+	return &stagingTrie{ReadOnlyStateTrie: rst, changes: newMemStateTrie(), deleted: map[string]bool{}}
+}
+
+func (t *stagingTrie) GetValues(key []byte) ([]byte, uint64, string, darc.ID, error) {
+	if t.deleted[string(key)] {
+		return nil, 0, "", nil, errKeyNotSet
+	}
+	if _, ok := t.changes.values[string(key)]; ok {
+		return t.changes.GetValues(key)
+	}
+	return t.ReadOnlyStateTrie.GetValues(key)
+}
+
+func (t *stagingTrie) apply(scs []byzcoin.StateChange) {
+	for _, sc := range scs {
+		key := string(sc.InstanceID)
+		if sc.StateAction == byzcoin.Remove {
+			t.deleted[key] = true
+			delete(t.changes.values, key)
+			continue
+		}
+		delete(t.deleted, key)
+		if _, ok := t.changes.values[key]; !ok && sc.StateAction == byzcoin.Update {
+			// Keeps the version of the underlying trie
+			_, version, _, _, err := t.ReadOnlyStateTrie.GetValues(sc.InstanceID)
+			if err == nil {
+				t.changes.values[key] = memInstance{version: version}
+			}
+		}
+		t.changes.apply([]byzcoin.StateChange{sc})
+	}
+}
@@ -0,0 +1,193 @@
+package byzcoin
+
+import (
+	"math/big"
+	"strconv"
+	"testing"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/byzcoin/contracts"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/darc/expression"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/stretchr/testify/require"
+)
+
+//registerContract is a byzcoin contract holding the value given at spawn or set
+type registerContract struct {
+	byzcoin.BasicContract
+}
+
+func (c *registerContract) Spawn(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, coins []byzcoin.Coin) ([]byzcoin.StateChange, []byzcoin.Coin, error) {
+	_, _, _, darcID, err := rst.GetValues(inst.InstanceID.Slice())
+	if err != nil {
+		return nil, nil, err
+	}
+	return []byzcoin.StateChange{
+		byzcoin.NewStateChange(byzcoin.Create, inst.DeriveID(""), "test-register", inst.Spawn.Args.Search("value"), darcID),
+	}, coins, nil
+}
+
+func (c *registerContract) Invoke(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, coins []byzcoin.Coin) ([]byzcoin.StateChange, []byzcoin.Coin, error) {
+	_, _, _, darcID, err := rst.GetValues(inst.InstanceID.Slice())
+	if err != nil {
+		return nil, nil, err
+	}
+	//pay returns the value as a number of coins
+	if inst.Invoke.Command == "pay" {
+		value, err := strconv.ParseUint(string(inst.Invoke.Args.Search("value")), 10, 64)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, append(coins, byzcoin.Coin{Name: contracts.CoinName, Value: value}), nil
+	}
+	return []byzcoin.StateChange{
+		byzcoin.NewStateChange(byzcoin.Update, inst.InstanceID, "test-register", inst.Invoke.Args.Search("value"), darcID),
+	}, coins, nil
+}
+
+//emitterCode returns the creation code of a contract logging its input as a ByzcoinInstruction event
+func emitterCode() []byte {
+	runtime := []byte{
+		byte(vm.CALLDATASIZE), byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.CALLDATACOPY),
+		byte(vm.PUSH32),
+	}
+	runtime = append(runtime, instructionTopic.Bytes()...)
+	runtime = append(runtime, byte(vm.CALLDATASIZE), byte(vm.PUSH1), 0, byte(vm.LOG1), byte(vm.STOP))
+	init := []byte{
+		byte(vm.PUSH1), byte(len(runtime)), byte(vm.DUP1), byte(vm.PUSH1), 11, byte(vm.PUSH1), 0, byte(vm.CODECOPY),
+		byte(vm.PUSH1), 0, byte(vm.RETURN),
+	}
+	return append(init, runtime...)
+}
+
+//Contracts spawn and invoke instances whose darcs allow the darc of the contract
+func TestInstructionRequests(t *testing.T) {
+	RegisterInstructionContract("test-register", func([]byte) (byzcoin.Contract, error) {
+		return &registerContract{}, nil
+	})
+	sb, keyA := newFundedBackend(t)
+	defer sb.Close()
+
+	//A darc allowing the bvm to spawn and set registers, and one allowing nothing
+	newDarc := func(rules darc.Rules) byzcoin.InstanceID {
+		d := darc.NewDarc(rules, []byte(t.Name()))
+		buf, err := d.ToProto()
+		require.Nil(t, err)
+		sb.trie.apply([]byzcoin.StateChange{
+			byzcoin.NewStateChange(byzcoin.Create, byzcoin.NewInstanceID(d.GetBaseID()), byzcoin.ContractDarcID, buf, d.GetBaseID()),
+		})
+		return byzcoin.NewInstanceID(d.GetBaseID())
+	}
+	emitter, _, err := sb.Deploy(keyA, emitterCode(), nil)
+	require.Nil(t, err)
+	other, _, err := sb.Deploy(keyA, emitterCode(), nil)
+	require.Nil(t, err)
+	contractDarc := expression.Expr(darc.NewIdentityDarc(ContractDarcID(sb.InstanceID, emitter)).String())
+	rules := darc.NewRules()
+	require.Nil(t, rules.AddRule("spawn:test-register", contractDarc))
+	require.Nil(t, rules.AddRule("invoke:set", contractDarc))
+	require.Nil(t, rules.AddRule("invoke:pay", contractDarc))
+	darcID := newDarc(rules)
+	closedDarcID := newDarc(darc.NewRules())
+
+	requestData := func(id byzcoin.InstanceID, action string, value string) []byte {
+		var id32 [32]byte
+		copy(id32[:], id.Slice())
+		args := PackInstructionArgs(byzcoin.Arguments{{Name: "value", Value: []byte(value)}})
+		data, err := instructionArguments.Pack(id32, action, args)
+		require.Nil(t, err)
+		return data
+	}
+	request := func(id byzcoin.InstanceID, action string, value string) error {
+		_, err := sb.Transact(keyA, emitter, nil, requestData(id, action, value))
+		return err
+	}
+	register := func() (byzcoin.InstanceID, string) {
+		for key, inst := range sb.trie.values {
+			if inst.contractID == "test-register" {
+				return byzcoin.NewInstanceID([]byte(key)), string(inst.value)
+			}
+		}
+		return byzcoin.InstanceID{}, ""
+	}
+
+	require.Nil(t, request(darcID, "spawn:test-register", "hello"))
+	registerID, value := register()
+	require.Equal(t, "hello", value)
+	tx, err := sb.Transact(keyA, emitter, nil, requestData(registerID, "invoke:set", "world"))
+	require.Nil(t, err)
+	_, value = register()
+	require.Equal(t, "world", value)
+
+	//The instruction gas is paid by the transaction and taken from the block budget
+	r, err := sb.GetReceipt(tx.Hash())
+	require.Nil(t, err)
+	require.Equal(t, instructionGas, r.InstructionGas)
+	budget, _, err := getGasBudget(sb.trie)
+	require.Nil(t, err)
+	require.Equal(t, r.GasUsed, budget.GasUsed)
+
+	//Without enough gas left for the instruction, the byzcoin instruction fails
+	sb.GasLimit = r.GasUsed - r.InstructionGas
+	_, err = sb.Transact(keyA, emitter, nil, requestData(registerID, "invoke:set", "again"))
+	require.NotNil(t, err)
+	_, value = register()
+	require.Equal(t, "world", value)
+	sb.GasLimit = 1e7
+
+	//The instruction fails when the darc doesn't allow the bvm, or the contract is unknown
+	nonce, err := sb.GetNonce(keyA.Address)
+	require.Nil(t, err)
+	require.NotNil(t, request(closedDarcID, "spawn:test-register", "hello"))
+	require.NotNil(t, request(darcID, "spawn:unknown", "hello"))
+	require.NotNil(t, request(sb.InstanceID, "invoke:credit", ""))
+	after, err := sb.GetNonce(keyA.Address)
+	require.Nil(t, err)
+	require.Equal(t, nonce, after)
+	_, value = register()
+	require.Equal(t, "world", value)
+
+	//Another contract is not allowed by the darc
+	_, err = sb.Transact(keyA, other, nil, requestData(registerID, "invoke:set", "other"))
+	require.NotNil(t, err)
+	_, value = register()
+	require.Equal(t, "world", value)
+
+	//An event that can't be decoded is not an instruction, the transaction is applied
+	_, err = sb.Transact(keyA, emitter, nil, []byte("not an instruction"))
+	require.Nil(t, err)
+	var id32 [32]byte
+	copy(id32[:], registerID.Slice())
+	truncated, err := instructionArguments.Pack(id32, "invoke:set", []byte{5, 'v'})
+	require.Nil(t, err)
+	_, err = sb.Transact(keyA, emitter, nil, truncated)
+	require.Nil(t, err)
+	_, value = register()
+	require.Equal(t, "world", value)
+
+	//The coins returned by the instructions are returned by the byzcoin instruction
+	nonce, err = sb.GetNonce(keyA.Address)
+	require.Nil(t, err)
+	gasLimit, gasPrice := transactionGasParameters()
+	tx, err = keyA.SignTx(types.NewTransaction(nonce, emitter, big.NewInt(0), gasLimit, gasPrice, requestData(registerID, "invoke:pay", "3")))
+	require.Nil(t, err)
+	txBuf, err := tx.MarshalJSON()
+	require.Nil(t, err)
+	sent := []byzcoin.Coin{{Name: contracts.CoinName, Value: 1}}
+	cout, err := sb.InvokeWithCoins("transaction", byzcoin.Arguments{{Name: "tx", Value: txBuf}}, sent)
+	require.Nil(t, err)
+	require.Equal(t, []byzcoin.Coin{{Name: contracts.CoinName, Value: 1}, {Name: contracts.CoinName, Value: 3}}, cout)
+}
+
+//The arguments of the instructions are decoded as they are packed
+func TestInstructionArgs(t *testing.T) {
+	args := byzcoin.Arguments{{Name: "a", Value: []byte{}}, {Name: "value", Value: common.Hex2Bytes("0102")}}
+	unpacked, err := unpackInstructionArgs(PackInstructionArgs(args))
+	require.Nil(t, err)
+	require.Equal(t, args, unpacked)
+	_, err = unpackInstructionArgs([]byte{5, 'v'})
+	require.NotNil(t, err)
+}
@@ -0,0 +1,347 @@
+package byzcoin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Invariants are conditions on the state of a contract that must hold after
+// every transaction, like the invariants proven with Stainless. They are
+// attached to a contract with the invariant instruction and kept in the
+// memory database of the bvm, so that every node checks the same ones.
+//
+// An invariant is either a view call to the contract, that must return
+// true, or one of the built-in predicates over the storage of the contract.
+// Both are data kept on the ledger, so that all the nodes evaluate them the
+// same way. Only the invariants of the contracts touched by a transaction
+// are checked, with the gas left by the transaction, and the gas they use
+// is paid by the sender.
+
+var invariantsKey = []byte("bvm-invariants")
+
+// The operators of the storage predicates.
+const (
+	// PredicateEqual holds if the sum of the slots is the bound
+	PredicateEqual = "eq"
+	// PredicateAtMost holds if the sum of the slots is at most the bound
+	PredicateAtMost = "le"
+	// PredicateAtLeast holds if the sum of the slots is at least the bound
+	PredicateAtLeast = "ge"
+)
+
+// maxPredicateSlots is the highest number of slots a predicate can add up.
+const maxPredicateSlots = 64
+
+// predicateSlotGas is the gas of reading a slot, the cost of SLOAD.
+const predicateSlotGas = uint64(200)
+
+// errInvariantGas is the reason of the invariants that are left without
+// gas by the transaction.
+var errInvariantGas = errors.New("out of gas")
+
+// Invariant is a condition on the state of the contract at Address.
+type Invariant struct {
+	// Name identifies the invariant among the ones of the contract
+	Name    string         `json:"name"`
+	Address common.Address `json:"address"`
+	// Call is the input of a view call to the contract, which must return
+	// the ABI encoding of true
+	Call hexutil.Bytes `json:"call,omitempty"`
+	// Predicate is a built-in predicate over the storage of the contract,
+	// used if Call is empty
+	Predicate *StoragePredicate `json:"predicate,omitempty"`
+	// Reject makes the transactions breaking the invariant fail. Otherwise
+	// they are included, and the violation is recorded in their receipt.
+	Reject bool `json:"reject"`
+}
+
+// StoragePredicate compares the sum of the unsigned integers stored in
+// Slots to a bound, with the operator Op.
+type StoragePredicate struct {
+	Op    string        `json:"op"`
+	Slots []common.Hash `json:"slots"`
+	// BoundSlot is the slot holding the bound, Bound is used if it is nil
+	BoundSlot *common.Hash `json:"boundSlot,omitempty"`
+	Bound     *hexutil.Big `json:"bound,omitempty"`
+}
+
+// verify returns an error if the predicate can't be evaluated.
+func (p *StoragePredicate) verify() error {
+	switch p.Op {
+	case PredicateEqual, PredicateAtMost, PredicateAtLeast:
+	default:
+		return errors.New("unknown predicate operator " + p.Op)
+	}
+	if len(p.Slots) == 0 || len(p.Slots) > maxPredicateSlots {
+		return fmt.Errorf("a predicate adds up between 1 and %d slots", maxPredicateSlots)
+	}
+	if p.BoundSlot == nil && p.Bound == nil {
+		return errors.New("the predicate has no bound")
+	}
+	return nil
+}
+
+// gas returns the gas of evaluating the predicate.
+func (p *StoragePredicate) gas() uint64 {
+	slots := uint64(len(p.Slots))
+	if p.BoundSlot != nil {
+		slots++
+	}
+	return slots * predicateSlotGas
+}
+
+// eval returns why the predicate doesn't hold on the storage of the
+// contract at address, nil if it holds.
+func (p *StoragePredicate) eval(db *state.StateDB, address common.Address) error {
+	sum := new(big.Int)
+	for _, slot := range p.Slots {
+		sum.Add(sum, db.GetState(address, slot).Big())
+	}
+	var bound *big.Int
+	if p.BoundSlot != nil {
+		bound = db.GetState(address, *p.BoundSlot).Big()
+	} else {
+		bound = p.Bound.ToInt()
+	}
+	c := sum.Cmp(bound)
+	if (p.Op == PredicateEqual && c != 0) || (p.Op == PredicateAtMost && c > 0) || (p.Op == PredicateAtLeast && c < 0) {
+		return fmt.Errorf("the sum of the slots is %v, the bound %v", sum, bound)
+	}
+	return nil
+}
+
+// Slot returns the storage slot of the state variable declared at position
+// n, for the value types that fit in one slot.
+func Slot(n uint64) common.Hash {
+	return common.BigToHash(new(big.Int).SetUint64(n))
+}
+
+// MappingSlot returns the storage slot of the value at key in the mapping
+// declared at position n. Addresses and integers are given as their 32
+// bytes ABI encoding.
+func MappingSlot(key common.Hash, n uint64) common.Hash {
+	return crypto.Keccak256Hash(key.Bytes(), Slot(n).Bytes())
+}
+
+// Violation is an invariant broken by a transaction.
+type Violation struct {
+	Address common.Address `json:"address"`
+	Name    string         `json:"name"`
+	Reason  string         `json:"reason"`
+}
+
+func (v Violation) Error() string {
+	return fmt.Sprintf("invariant %s of %s broken: %s", v.Name, v.Address.Hex(), v.Reason)
+}
+
+// checkInvariants evaluates the invariants of the touched contracts on db
+// and rst, with at most gas. It returns the broken ones, the first broken
+// invariant rejecting the transaction, nil if there is none, and the gas
+// used.
+func checkInvariants(memdb *MemDatabase, db *state.StateDB, rst byzcoin.ReadOnlyStateTrie, touched map[common.Address]bool, gas uint64) ([]Violation, *Violation, uint64, error) {
+	invariants, err := getInvariants(memdb)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	var violations []Violation
+	var reject *Violation
+	used := uint64(0)
+	for _, inv := range invariants {
+		if !touched[inv.Address] {
+			continue
+		}
+		invGas, err := evalInvariant(inv, db, rst, gas-used)
+		used += invGas
+		if err == nil {
+			continue
+		}
+		v := Violation{Address: inv.Address, Name: inv.Name, Reason: err.Error()}
+		violations = append(violations, v)
+		if inv.Reject && reject == nil {
+			reject = &v
+		}
+	}
+	return violations, reject, used, nil
+}
+
+// evalInvariant returns the gas used to evaluate inv on db and rst, with at
+// most gas, and why inv doesn't hold, nil if it holds.
+func evalInvariant(inv Invariant, db *state.StateDB, rst byzcoin.ReadOnlyStateTrie, gas uint64) (uint64, error) {
+	if len(inv.Call) == 0 {
+		if inv.Predicate.gas() > gas {
+			return gas, errInvariantGas
+		}
+		return inv.Predicate.gas(), inv.Predicate.eval(db, inv.Address)
+	}
+	// The call is made on a copy, so that it leaves no trace in the state
+	to := inv.Address
+	msg := types.NewMessage(nilAddress, &to, 0, big.NewInt(0), gas, big.NewInt(0), inv.Call, false)
+	ret, used, failed, err := applyMessage(db.Copy(), rst, msg)
+	if err != nil {
+		// Not even the intrinsic gas of the call is left
+		return 0, errInvariantGas
+	}
+	if failed {
+		if reason, err := unpackRevert(ret); err == nil {
+			return used, errors.New("view call reverted: " + reason)
+		}
+		return used, errors.New("view call reverted")
+	}
+	if len(ret) != 32 || new(big.Int).SetBytes(ret).Cmp(big.NewInt(1)) != 0 {
+		return used, fmt.Errorf("view call returned %x", ret)
+	}
+	return used, nil
+}
+
+// touchTracer records the accounts a transaction can have changed: the
+// recipient of the transaction, the contracts that executed code and the
+// recipients of calls and self-destructs. It also records the contracts
+// created by the transaction and by the CREATEs and CREATE2s of the
+// contracts, whose code is checked like the one of a deployment.
+type touchTracer struct {
+	touched map[common.Address]bool
+	created []common.Address
+	// creating holds the depths of the CREATEs and CREATE2s that didn't
+	// return yet, the created address is on the stack of the caller once
+	// it is back at that depth
+	creating []int
+}
+
+func newTouchTracer() *touchTracer {
+	return &touchTracer{touched: map[common.Address]bool{}}
+}
+
+// CaptureStart records the recipient of the transaction, or the created
+// contract.
+func (tt *touchTracer) CaptureStart(from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) error {
+	tt.touched[to] = true
+	if create {
+		tt.created = append(tt.created, to)
+	}
+	return nil
+}
+
+// CaptureState records the executing contract, the recipients of value
+// and the contracts created.
+func (tt *touchTracer) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int, err error) error {
+	tt.touched[contract.Address()] = true
+	// Back in the caller of CREATEs: the creations of the frames that
+	// returned are done, the one made at this depth left the address of the
+	// contract on the stack, 0 if it failed
+	for n := len(tt.creating); n > 0 && tt.creating[n-1] >= depth; n = len(tt.creating) {
+		if tt.creating[n-1] == depth && len(stack.Data()) > 0 {
+			if address := stack.Back(0); address.Sign() != 0 {
+				tt.created = append(tt.created, common.BigToAddress(address))
+			}
+		}
+		tt.creating = tt.creating[:n-1]
+	}
+	switch op {
+	case vm.CREATE, vm.CREATE2:
+		tt.creating = append(tt.creating, depth)
+	case vm.CALL, vm.CALLCODE:
+		if len(stack.Data()) > 1 {
+			tt.touched[common.BigToAddress(stack.Back(1))] = true
+		}
+	case vm.SELFDESTRUCT:
+		if len(stack.Data()) > 0 {
+			tt.touched[common.BigToAddress(stack.Back(0))] = true
+		}
+	}
+	return nil
+}
+
+// CaptureFault does nothing, the contract was recorded by CaptureState.
+func (tt *touchTracer) CaptureFault(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int, err error) error {
+	return nil
+}
+
+// CaptureEnd does nothing.
+func (tt *touchTracer) CaptureEnd(output []byte, gasUsed uint64, t time.Duration, err error) error {
+	return nil
+}
+
+// addInvariant adds inv to the invariants, replacing the invariant of the
+// same contract with the same name.
+func addInvariant(memdb *MemDatabase, inv Invariant) error {
+	if inv.Name == "" {
+		return errors.New("the invariant has no name")
+	}
+	if len(inv.Call) == 0 {
+		if inv.Predicate == nil {
+			return errors.New("the invariant has neither a call nor a predicate")
+		}
+		if err := inv.Predicate.verify(); err != nil {
+			return err
+		}
+	}
+	invariants, err := getInvariants(memdb)
+	if err != nil {
+		return err
+	}
+	replaced := false
+	for i := range invariants {
+		if invariants[i].Address == inv.Address && invariants[i].Name == inv.Name {
+			invariants[i] = inv
+			replaced = true
+		}
+	}
+	if !replaced {
+		invariants = append(invariants, inv)
+	}
+	return putInvariants(memdb, invariants)
+}
+
+// removeInvariant removes the invariant name of the contract at address.
+func removeInvariant(memdb *MemDatabase, address common.Address, name string) error {
+	invariants, err := getInvariants(memdb)
+	if err != nil {
+		return err
+	}
+	kept := []Invariant{}
+	for _, inv := range invariants {
+		if inv.Address != address || inv.Name != name {
+			kept = append(kept, inv)
+		}
+	}
+	if len(kept) == len(invariants) {
+		return errors.New("no invariant " + name + " for " + address.Hex())
+	}
+	return putInvariants(memdb, kept)
+}
+
+func getInvariants(memdb *MemDatabase) ([]Invariant, error) {
+	ok, err := memdb.Has(invariantsKey)
+	if err != nil || !ok {
+		return nil, err
+	}
+	buf, err := memdb.Get(invariantsKey)
+	if err != nil {
+		return nil, err
+	}
+	var invariants []Invariant
+	err = json.Unmarshal(buf, &invariants)
+	if err != nil {
+		return nil, err
+	}
+	return invariants, nil
+}
+
+func putInvariants(memdb *MemDatabase, invariants []Invariant) error {
+	buf, err := json.Marshal(invariants)
+	if err != nil {
+		return err
+	}
+	return memdb.Put(invariantsKey, buf)
+}
@@ -0,0 +1,100 @@
+package byzcoin
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/require"
+)
+
+// Checks storage predicates and view calls on the balances of a MinimumToken
+func TestInvariants(t *testing.T) {
+	sb, keyA := newFundedBackend(t)
+	defer sb.Close()
+	addressB := common.HexToAddress("0x2887A24130cACFD8f71C479d9f9Da5b9C6425CE8")
+
+	rawAbi, bytecode, err := getSmartContract("MinimumToken")
+	require.Nil(t, err)
+	tokenAbi, err := abi.JSON(strings.NewReader(rawAbi))
+	require.Nil(t, err)
+	constructorArgs, err := tokenAbi.Pack("", keyA.Address, big.NewInt(100))
+	require.Nil(t, err)
+	token, _, err := sb.Deploy(keyA, append(common.Hex2Bytes(bytecode), constructorArgs...), nil)
+	require.Nil(t, err)
+
+	//balanceOf is the mapping at position 0, total the integer at position 1
+	balanceA, balanceB, total := MappingSlot(keyA.Address.Hash(), 0), MappingSlot(addressB.Hash(), 0), Slot(1)
+	supply := &StoragePredicate{Op: PredicateEqual, Slots: []common.Hash{balanceA, balanceB}, BoundSlot: &total}
+	capped := &StoragePredicate{Op: PredicateAtMost, Slots: []common.Hash{balanceB}, Bound: (*hexutil.Big)(big.NewInt(15))}
+	require.NotNil(t, sb.AddInvariant(Invariant{Name: "none", Address: token}))
+	require.NotNil(t, sb.AddInvariant(Invariant{Name: "unknown", Address: token, Predicate: &StoragePredicate{Op: "lt", Slots: []common.Hash{balanceB}, BoundSlot: &total}}))
+	require.NotNil(t, sb.AddInvariant(Invariant{Name: "unbounded", Address: token, Predicate: &StoragePredicate{Op: PredicateAtMost, Slots: []common.Hash{balanceB}}}))
+	require.Nil(t, sb.AddInvariant(Invariant{Name: "supply", Address: token, Predicate: supply, Reject: true}))
+	require.Nil(t, sb.AddInvariant(Invariant{Name: "cap", Address: token, Predicate: capped}))
+
+	//An invariant of another contract, broken from the start, is not checked as long as the contract is not touched
+	other, _, err := sb.Deploy(keyA, append(common.Hex2Bytes(bytecode), constructorArgs...), nil)
+	require.Nil(t, err)
+	empty := &StoragePredicate{Op: PredicateEqual, Slots: []common.Hash{balanceA}, Bound: (*hexutil.Big)(big.NewInt(0))}
+	require.Nil(t, sb.AddInvariant(Invariant{Name: "empty", Address: other, Predicate: empty}))
+
+	transfer := func(amount int64) (common.Hash, error) {
+		data, err := tokenAbi.Pack("transferFrom", keyA.Address, addressB, big.NewInt(amount))
+		require.Nil(t, err)
+		tx, err := sb.Transact(keyA, token, nil, data)
+		if err != nil {
+			return common.Hash{}, err
+		}
+		return tx.Hash(), nil
+	}
+	txHash, err := transfer(10)
+	require.Nil(t, err)
+	r, err := sb.GetReceipt(txHash)
+	require.Nil(t, err)
+	require.Empty(t, r.Violations)
+	//The predicates of the token read four slots, the sender pays for them
+	require.Equal(t, 4*predicateSlotGas, r.InvariantGas)
+	replayed, err := sb.TraceTransaction(txHash, vm.LogConfig{DisableStack: true, DisableStorage: true})
+	require.Nil(t, err)
+	require.Equal(t, r.GasUsed, replayed.Gas+r.InvariantGas)
+	require.True(t, r.GasUsed <= sb.GasLimit)
+
+	//Breaking the flagging invariant is recorded in the receipt
+	txHash, err = transfer(10)
+	require.Nil(t, err)
+	r, err = sb.GetReceipt(txHash)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(r.Violations))
+	require.Equal(t, "cap", r.Violations[0].Name)
+
+	//Breaking a rejecting invariant makes the instruction fail with its violation, even after a flagging one
+	require.Nil(t, sb.RemoveInvariant(token, "cap"))
+	require.Nil(t, sb.AddInvariant(Invariant{Name: "flag", Address: token, Predicate: capped}))
+	require.Nil(t, sb.AddInvariant(Invariant{Name: "cap", Address: token, Predicate: capped, Reject: true}))
+	nonce, err := sb.GetNonce(keyA.Address)
+	require.Nil(t, err)
+	_, err = transfer(10)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "invariant cap")
+	after, err := sb.GetNonce(keyA.Address)
+	require.Nil(t, err)
+	require.Equal(t, nonce, after)
+
+	//MinimumToken has no view function, the call reverts
+	require.Nil(t, sb.RemoveInvariant(token, "flag"))
+	require.Nil(t, sb.RemoveInvariant(token, "cap"))
+	require.NotNil(t, sb.RemoveInvariant(token, "cap"))
+	require.Nil(t, sb.AddInvariant(Invariant{Name: "view", Address: token, Call: crypto.Keccak256([]byte("totalSupply()"))[:4]}))
+	txHash, err = transfer(1)
+	require.Nil(t, err)
+	r, err = sb.GetReceipt(txHash)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(r.Violations))
+	require.Contains(t, r.Violations[0].Reason, "view call reverted")
+}
@@ -0,0 +1,216 @@
+package byzcoin
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// The keystore files follow the Web3 Secret Storage definition (version 3),
+// so that keys can be exchanged with geth, MetaMask and other wallets.
+
+// EncryptKey returns the key encrypted with password, in the v3 keystore JSON format
+func EncryptKey(key *Key, password string, scryptN, scryptP int) ([]byte, error) {
+	return keystore.EncryptKey(&keystore.Key{
+		Id:         key.Id,
+		Address:    key.Address,
+		PrivateKey: key.PrivateKey,
+	}, password, scryptN, scryptP)
+}
+
+// DecryptKey decrypts a v3 keystore JSON with password
+func DecryptKey(keyJSON []byte, password string) (*Key, error) {
+	k, err := keystore.DecryptKey(keyJSON, password)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{
+		Id:         k.Id,
+		Address:    k.Address,
+		PrivateKey: k.PrivateKey,
+	}, nil
+}
+
+// SignTx signs an Ethereum transaction to be sent to the bvm
+func (k *Key) SignTx(tx *types.Transaction) (*types.Transaction, error) {
+	return types.SignTx(tx, types.HomesteadSigner{}, k.PrivateKey)
+}
+
+// Keystore stores password protected keys in a directory, one file per key
+type Keystore struct {
+	dir string
+	// ScryptN and ScryptP are the scrypt parameters used when storing new
+	// keys. They default to the go-ethereum standard ones.
+	ScryptN int
+	ScryptP int
+}
+
+// NewKeystore returns a keystore in dir, creating the directory if needed
+func NewKeystore(dir string) (*Keystore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Keystore{
+		dir:     dir,
+		ScryptN: keystore.StandardScryptN,
+		ScryptP: keystore.StandardScryptP,
+	}, nil
+}
+
+// Dir returns the directory of the keystore
+func (ks *Keystore) Dir() string {
+	return ks.dir
+}
+
+// NewAccount generates a new key and stores it encrypted with password
+func (ks *Keystore) NewAccount(password string) (*Key, error) {
+	private, err := crypto.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	key := NewKeyFromECDSA(private)
+	if _, err := ks.Store(key, password); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Store encrypts the key with password and writes it to the keystore. It
+// returns the path of the written file.
+func (ks *Keystore) Store(key *Key, password string) (string, error) {
+	if _, err := ks.find(key.Address); err == nil {
+		return "", fmt.Errorf("account %s already in keystore", key.Address.Hex())
+	}
+	keyJSON, err := EncryptKey(key, password, ks.ScryptN, ks.ScryptP)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(ks.dir, keyFileName(key.Address))
+	// Write to a temporary file first, so that a crash does not leave a
+	// truncated key behind.
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, keyJSON, 0600); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// Load decrypts the key of address with password
+func (ks *Keystore) Load(address common.Address, password string) (*Key, error) {
+	path, err := ks.find(address)
+	if err != nil {
+		return nil, err
+	}
+	keyJSON, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := DecryptKey(keyJSON, password)
+	if err != nil {
+		return nil, err
+	}
+	if key.Address != address {
+		return nil, fmt.Errorf("key file %s contains address %s", path, key.Address.Hex())
+	}
+	return key, nil
+}
+
+// Import stores a v3 keystore JSON, re-encrypting it with newPassword
+func (ks *Keystore) Import(keyJSON []byte, password, newPassword string) (*Key, error) {
+	key, err := DecryptKey(keyJSON, password)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ks.Store(key, newPassword); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Export returns the key of address as a v3 keystore JSON encrypted with newPassword
+func (ks *Keystore) Export(address common.Address, password, newPassword string) ([]byte, error) {
+	key, err := ks.Load(address, password)
+	if err != nil {
+		return nil, err
+	}
+	return EncryptKey(key, newPassword, ks.ScryptN, ks.ScryptP)
+}
+
+// Delete removes the key of address, once the password has been checked
+func (ks *Keystore) Delete(address common.Address, password string) error {
+	if _, err := ks.Load(address, password); err != nil {
+		return err
+	}
+	path, err := ks.find(address)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Accounts returns the addresses of all the keys in the keystore
+func (ks *Keystore) Accounts() ([]common.Address, error) {
+	files, err := ioutil.ReadDir(ks.dir)
+	if err != nil {
+		return nil, err
+	}
+	var addresses []common.Address
+	for _, f := range files {
+		if address, ok := keyFileAddress(f.Name()); ok && !f.IsDir() {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses, nil
+}
+
+// SignTx signs tx with the key of address
+func (ks *Keystore) SignTx(address common.Address, password string, tx *types.Transaction) (*types.Transaction, error) {
+	key, err := ks.Load(address, password)
+	if err != nil {
+		return nil, err
+	}
+	return key.SignTx(tx)
+}
+
+func (ks *Keystore) find(address common.Address) (string, error) {
+	files, err := ioutil.ReadDir(ks.dir)
+	if err != nil {
+		return "", err
+	}
+	for _, f := range files {
+		if a, ok := keyFileAddress(f.Name()); ok && a == address {
+			return filepath.Join(ks.dir, f.Name()), nil
+		}
+	}
+	return "", errors.New("no key for address " + address.Hex())
+}
+
+// keyFileName uses the same naming as geth: UTC--<created_at UTC ISO8601>--<address hex>
+func keyFileName(address common.Address) string {
+	ts := time.Now().UTC().Format("2006-01-02T15-04-05.000000000Z")
+	return fmt.Sprintf("UTC--%s--%s", ts, common.Bytes2Hex(address[:]))
+}
+
+func keyFileAddress(name string) (common.Address, bool) {
+	i := strings.LastIndex(name, "--")
+	if !strings.HasPrefix(name, "UTC--") || i < 0 || strings.HasSuffix(name, ".tmp") {
+		return common.Address{}, false
+	}
+	hex := name[i+2:]
+	if len(hex) != 2*common.AddressLength {
+		return common.Address{}, false
+	}
+	return common.HexToAddress(hex), true
+}
@@ -0,0 +1,74 @@
+package byzcoin
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/require"
+)
+
+// Stores the test account A in a keystore, reloads it and signs a transaction with it
+func TestKeystore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bvm-keystore")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ks, err := NewKeystore(dir)
+	require.Nil(t, err)
+	ks.ScryptN, ks.ScryptP = keystore.LightScryptN, keystore.LightScryptP
+
+	private, err := crypto.HexToECDSA("a33fca62081a2665454fe844a8afbe8e2e02fb66af558e695a79d058f9042f0d")
+	require.Nil(t, err)
+	key := NewKeyFromECDSA(private)
+	addressA := common.HexToAddress("0x2afd357E96a3aCbcd01615681C1D7e3398d5fb61")
+	require.Equal(t, addressA, key.Address)
+
+	_, err = ks.Store(key, "password")
+	require.Nil(t, err)
+	_, err = ks.Store(key, "password")
+	require.NotNil(t, err)
+
+	accounts, err := ks.Accounts()
+	require.Nil(t, err)
+	require.Equal(t, []common.Address{addressA}, accounts)
+
+	_, err = ks.Load(addressA, "wrong")
+	require.NotNil(t, err)
+	loaded, err := ks.Load(addressA, "password")
+	require.Nil(t, err)
+	require.Equal(t, key.Id, loaded.Id)
+
+	gasLimit, gasPrice := transactionGasParameters()
+	tx := types.NewTransaction(0, common.HexToAddress("0x2887A24130cACFD8f71C479d9f9Da5b9C6425CE8"), big.NewInt(1), gasLimit, gasPrice, nil)
+	signedTx, err := ks.SignTx(addressA, "password", tx)
+	require.Nil(t, err)
+	sender, err := types.Sender(types.HomesteadSigner{}, signedTx)
+	require.Nil(t, err)
+	require.Equal(t, addressA, sender)
+
+	//Export and import into a second keystore under another password
+	keyJSON, err := ks.Export(addressA, "password", "other")
+	require.Nil(t, err)
+	dir2, err := ioutil.TempDir("", "bvm-keystore")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir2)
+	ks2, err := NewKeystore(dir2)
+	require.Nil(t, err)
+	ks2.ScryptN, ks2.ScryptP = keystore.LightScryptN, keystore.LightScryptP
+	imported, err := ks2.Import(keyJSON, "other", "new")
+	require.Nil(t, err)
+	require.Equal(t, addressA, imported.Address)
+	_, err = ks2.Load(addressA, "new")
+	require.Nil(t, err)
+
+	require.Nil(t, ks.Delete(addressA, "password"))
+	accounts, err = ks.Accounts()
+	require.Nil(t, err)
+	require.Empty(t, accounts)
+}
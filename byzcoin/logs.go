@@ -0,0 +1,233 @@
+package byzcoin
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// The logs emitted by the transactions are kept in their receipts. To find
+// them by block, the memory database also holds, for every byzcoin block
+// that contains bvm transactions, the list of these transactions and the
+// bloom filter of all their logs.
+
+var (
+	blockPrefix = []byte("bvm-block-")
+	blocksKey   = []byte("bvm-blocks")
+)
+
+// blockLogs is what is stored for every byzcoin block containing bvm
+// transactions.
+type blockLogs struct {
+	Bloom    types.Bloom
+	TxHashes []common.Hash
+	LogCount uint
+}
+
+// LogFilter selects logs, like the filter of eth_getLogs.
+type LogFilter struct {
+	// FromBlock and ToBlock are the byzcoin block indexes, both included.
+	// A ToBlock of 0 means the latest block.
+	FromBlock uint64
+	ToBlock   uint64
+	// Addresses restricts the logs to the ones emitted by these contracts.
+	// An empty list matches all contracts.
+	Addresses []common.Address
+	// Topics restricts the logs by position: the topic at position i must
+	// be one of Topics[i]. An empty Topics[i] matches any topic.
+	Topics [][]common.Hash
+}
+
+// indexReceipt records the position of the transaction and of its logs in the byzcoin block blockIndex, and adds
+// its logs to the bloom filter of the block
+func indexReceipt(memdb *MemDatabase, blockIndex uint64, r *Receipt) error {
+	block, err := getBlockLogs(memdb, blockIndex)
+	if err != nil {
+		return err
+	}
+	if block == nil {
+		block = &blockLogs{}
+		err = addBlock(memdb, blockIndex)
+		if err != nil {
+			return err
+		}
+	}
+	txIndex := uint(len(block.TxHashes))
+	for _, l := range r.Logs {
+		l.BlockNumber = blockIndex
+		l.TxHash = r.TxHash
+		l.TxIndex = txIndex
+		l.Index = block.LogCount
+		block.LogCount++
+	}
+	block.TxHashes = append(block.TxHashes, r.TxHash)
+	block.Bloom = orBloom(block.Bloom, r.Bloom)
+
+	buf, err := json.Marshal(block)
+	if err != nil {
+		return err
+	}
+	return memdb.Put(blockKey(blockIndex), buf)
+}
+
+// getLogs returns the logs matching the filter, ordered by block, transaction and position
+func getLogs(memdb *MemDatabase, filter LogFilter) ([]*types.Log, error) {
+	blocks, err := getBlocks(memdb)
+	if err != nil {
+		return nil, err
+	}
+	logs := []*types.Log{}
+	for _, index := range blocks {
+		if index < filter.FromBlock || (filter.ToBlock != 0 && index > filter.ToBlock) {
+			continue
+		}
+		block, err := getBlockLogs(memdb, index)
+		if err != nil {
+			return nil, err
+		}
+		if block == nil || !bloomMatches(block.Bloom, filter) {
+			continue
+		}
+		for _, txHash := range block.TxHashes {
+			r, err := getReceipt(memdb, txHash)
+			if err != nil {
+				return nil, err
+			}
+			for _, l := range r.Logs {
+				if logMatches(l, filter) {
+					logs = append(logs, l)
+				}
+			}
+		}
+	}
+	return logs, nil
+}
+
+func logMatches(l *types.Log, filter LogFilter) bool {
+	if len(filter.Addresses) > 0 {
+		found := false
+		for _, a := range filter.Addresses {
+			if a == l.Address {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(filter.Topics) > len(l.Topics) {
+		return false
+	}
+	for i, topics := range filter.Topics {
+		if len(topics) == 0 {
+			continue
+		}
+		found := false
+		for _, topic := range topics {
+			if topic == l.Topics[i] {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// bloomMatches returns false if the bloom filter shows that no log of the block can match the filter
+func bloomMatches(bloom types.Bloom, filter LogFilter) bool {
+	if len(filter.Addresses) > 0 {
+		found := false
+		for _, a := range filter.Addresses {
+			if types.BloomLookup(bloom, a) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, topics := range filter.Topics {
+		if len(topics) == 0 {
+			continue
+		}
+		found := false
+		for _, topic := range topics {
+			if types.BloomLookup(bloom, topic) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func orBloom(a, b types.Bloom) types.Bloom {
+	return types.BytesToBloom(new(big.Int).Or(a.Big(), b.Big()).Bytes())
+}
+
+func getBlockLogs(memdb *MemDatabase, blockIndex uint64) (*blockLogs, error) {
+	ok, err := memdb.Has(blockKey(blockIndex))
+	if err != nil || !ok {
+		return nil, err
+	}
+	buf, err := memdb.Get(blockKey(blockIndex))
+	if err != nil {
+		return nil, err
+	}
+	block := &blockLogs{}
+	err = json.Unmarshal(buf, block)
+	if err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// getBlocks returns the sorted indexes of the blocks with bvm transactions
+func getBlocks(memdb *MemDatabase) ([]uint64, error) {
+	ok, err := memdb.Has(blocksKey)
+	if err != nil || !ok {
+		return nil, err
+	}
+	buf, err := memdb.Get(blocksKey)
+	if err != nil {
+		return nil, err
+	}
+	var blocks []uint64
+	err = json.Unmarshal(buf, &blocks)
+	if err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
+
+func addBlock(memdb *MemDatabase, blockIndex uint64) error {
+	blocks, err := getBlocks(memdb)
+	if err != nil {
+		return err
+	}
+	blocks = append(blocks, blockIndex)
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i] < blocks[j] })
+	buf, err := json.Marshal(blocks)
+	if err != nil {
+		return err
+	}
+	return memdb.Put(blocksKey, buf)
+}
+
+func blockKey(blockIndex uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, blockIndex)
+	return append(common.CopyBytes(blockPrefix), key...)
+}
@@ -0,0 +1,81 @@
+package byzcoin
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/require"
+)
+
+//Indexes the receipts of three transactions in two blocks and queries their logs
+func TestGetLogs(t *testing.T) {
+	memdb, _, err := getDB(ES{DbBuf: []byte{}})
+	require.Nil(t, err)
+
+	token := common.HexToAddress("0x45663483f58d687c8aF17B85cCCDD9391b567498")
+	loan := common.HexToAddress("0x2887A24130cACFD8f71C479d9f9Da5b9C6425CE8")
+	transfer := crypto.Keccak256Hash([]byte("Transfer(address,address,uint256)"))
+	approval := crypto.Keccak256Hash([]byte("Approval(address,address,uint256)"))
+	from := common.BytesToHash(common.HexToAddress("0x2afd357E96a3aCbcd01615681C1D7e3398d5fb61").Bytes())
+
+	newReceipt := func(txHash common.Hash, logs ...*types.Log) *Receipt {
+		r := types.NewReceipt(nil, false, 21000)
+		r.TxHash = txHash
+		r.Logs = logs
+		r.Bloom = types.CreateBloom(types.Receipts{r})
+		return &Receipt{Receipt: r}
+	}
+	receipts := []struct {
+		block uint64
+		r     *Receipt
+	}{
+		{3, newReceipt(common.HexToHash("0x01"),
+			&types.Log{Address: token, Topics: []common.Hash{transfer, from}},
+			&types.Log{Address: token, Topics: []common.Hash{approval, from}})},
+		{3, newReceipt(common.HexToHash("0x02"))},
+		{5, newReceipt(common.HexToHash("0x03"),
+			&types.Log{Address: loan, Topics: []common.Hash{transfer}})},
+	}
+	for _, rcpt := range receipts {
+		require.Nil(t, indexReceipt(memdb, rcpt.block, rcpt.r))
+		require.Nil(t, storeReceipt(memdb, rcpt.r))
+	}
+
+	logs, err := getLogs(memdb, LogFilter{})
+	require.Nil(t, err)
+	require.Equal(t, 3, len(logs))
+	//Positions are given inside the byzcoin block
+	require.Equal(t, uint64(3), logs[1].BlockNumber)
+	require.Equal(t, uint(1), logs[1].Index)
+	require.Equal(t, uint64(5), logs[2].BlockNumber)
+	require.Equal(t, uint(0), logs[2].Index)
+	require.Equal(t, common.HexToHash("0x03"), logs[2].TxHash)
+
+	logs, err = getLogs(memdb, LogFilter{Topics: [][]common.Hash{{transfer}}})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(logs))
+
+	logs, err = getLogs(memdb, LogFilter{Addresses: []common.Address{token}, Topics: [][]common.Hash{{transfer, approval}, {from}}})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(logs))
+
+	logs, err = getLogs(memdb, LogFilter{Topics: [][]common.Hash{{}, {from}}})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(logs))
+
+	logs, err = getLogs(memdb, LogFilter{FromBlock: 4})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(logs))
+	require.Equal(t, loan, logs[0].Address)
+
+	logs, err = getLogs(memdb, LogFilter{ToBlock: 4, Addresses: []common.Address{loan}})
+	require.Nil(t, err)
+	require.Empty(t, logs)
+
+	//The bloom filter of block 5 rules out the approval topic
+	block, err := getBlockLogs(memdb, 5)
+	require.Nil(t, err)
+	require.False(t, bloomMatches(block.Bloom, LogFilter{Topics: [][]common.Hash{{approval}}}))
+}
@@ -0,0 +1,95 @@
+package byzcoin
+
+import (
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// NonceSource returns the nonce of an address as currently stored on the
+// ledger. The Client implements it.
+type NonceSource interface {
+	GetNonce(address common.Address) (uint64, error)
+}
+
+// NonceManager hands out the nonces of Ethereum senders, so that several
+// transactions of the same address can be prepared without waiting for the
+// previous ones to be included.
+//
+// A nonce handed out by Next is pending until it is either confirmed, once
+// the transaction is included, or rejected. As a rejected transaction leaves
+// a gap that makes all later transactions of the address fail, a rejection
+// drops all pending nonces of the address and the next call to Next asks
+// the ledger again.
+type NonceManager struct {
+	sync.Mutex
+	source   NonceSource
+	accounts map[common.Address]*accountNonces
+}
+
+type accountNonces struct {
+	next    uint64
+	pending map[uint64]bool
+}
+
+// NewNonceManager returns a nonce manager reading the nonces from source.
+func NewNonceManager(source NonceSource) *NonceManager {
+	return &NonceManager{
+		source:   source,
+		accounts: map[common.Address]*accountNonces{},
+	}
+}
+
+// Next returns the nonce to use for the next transaction of address and
+// marks it as pending.
+func (nm *NonceManager) Next(address common.Address) (uint64, error) {
+	nm.Lock()
+	defer nm.Unlock()
+	acc, ok := nm.accounts[address]
+	if !ok {
+		nonce, err := nm.source.GetNonce(address)
+		if err != nil {
+			return 0, err
+		}
+		acc = &accountNonces{next: nonce, pending: map[uint64]bool{}}
+		nm.accounts[address] = acc
+	}
+	nonce := acc.next
+	acc.next++
+	acc.pending[nonce] = true
+	return nonce, nil
+}
+
+// Confirm marks the nonce as used by an included transaction.
+func (nm *NonceManager) Confirm(address common.Address, nonce uint64) {
+	nm.Lock()
+	defer nm.Unlock()
+	if acc, ok := nm.accounts[address]; ok {
+		delete(acc.pending, nonce)
+	}
+}
+
+// Reject is called when the transaction using nonce has been refused. All
+// pending nonces of address are dropped and the nonce is read again from the
+// ledger on the next call to Next.
+func (nm *NonceManager) Reject(address common.Address, nonce uint64) {
+	nm.Reset(address)
+}
+
+// Pending returns the number of transactions of address waiting for
+// confirmation.
+func (nm *NonceManager) Pending(address common.Address) int {
+	nm.Lock()
+	defer nm.Unlock()
+	if acc, ok := nm.accounts[address]; ok {
+		return len(acc.pending)
+	}
+	return 0
+}
+
+// Reset forgets everything about address.
+func (nm *NonceManager) Reset(address common.Address) {
+	nm.Lock()
+	defer nm.Unlock()
+	delete(nm.accounts, address)
+}
@@ -0,0 +1,50 @@
+package byzcoin
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNonces replaces the ledger for the nonce manager tests
+type fakeNonces map[common.Address]uint64
+
+func (f fakeNonces) GetNonce(address common.Address) (uint64, error) {
+	return f[address], nil
+}
+
+func TestNonceManager(t *testing.T) {
+	addressA := common.HexToAddress("0x2afd357E96a3aCbcd01615681C1D7e3398d5fb61")
+	addressB := common.HexToAddress("0x2887A24130cACFD8f71C479d9f9Da5b9C6425CE8")
+	ledger := fakeNonces{addressA: 3}
+	nm := NewNonceManager(ledger)
+
+	//Nonces of A start at the ledger nonce and are handed out in order
+	for i := uint64(3); i < 6; i++ {
+		nonce, err := nm.Next(addressA)
+		require.Nil(t, err)
+		require.Equal(t, i, nonce)
+	}
+	require.Equal(t, 3, nm.Pending(addressA))
+	nonce, err := nm.Next(addressB)
+	require.Nil(t, err)
+	require.Equal(t, uint64(0), nonce)
+
+	//The first two transactions are included, the third one is rejected
+	nm.Confirm(addressA, 3)
+	nm.Confirm(addressA, 4)
+	ledger[addressA] = 5
+	require.Equal(t, 1, nm.Pending(addressA))
+	nm.Reject(addressA, 5)
+	require.Equal(t, 0, nm.Pending(addressA))
+
+	//After the rejection the nonce is read again from the ledger
+	nonce, err = nm.Next(addressA)
+	require.Nil(t, err)
+	require.Equal(t, uint64(5), nonce)
+	//B is not affected
+	nonce, err = nm.Next(addressB)
+	require.Nil(t, err)
+	require.Equal(t, uint64(1), nonce)
+}
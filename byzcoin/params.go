@@ -1,36 +1,27 @@
 package byzcoin
 
 import (
-	"errors"
-	"github.com/dedis/onet/log"
-	"io/ioutil"
 	"math/big"
-	"os"
+	"path"
 
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/student_18_hugo_verex/byzcoin/artifact"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/ethereum/go-ethereum/params"
 )
 
-//returns abi and bytecode of solidity contract
-func getSmartContract(nameOfContract string) (string, string) {
-	dir, err := os.Getwd()
+//getSmartContract returns abi and bytecode of a solidity contract compiled with solcjs into the contracts folder
+func getSmartContract(nameOfContract string) (string, string, error) {
+	prefix := path.Join(nameOfContract, nameOfContract+"_sol_"+nameOfContract)
+	a, err := artifact.LoadSolcjs(artifact.Dir("contracts"), prefix)
 	if err != nil {
-		log.Fatal(err)
+		return "", "", err
 	}
-	contractPath := dir + "/contracts/" + nameOfContract+ "/"+ nameOfContract + "_sol_" + nameOfContract
-	abi, err := ioutil.ReadFile(contractPath+ ".abi")
-	if err != nil {
-		err = errors.New("Problem generating contract ABI")
-		log.ErrFatal(err)
-	}
-	bin, err := ioutil.ReadFile(contractPath + ".bin")
-	if err != nil {
-		err = errors.New("Problem generating contract bytecode")
-		log.ErrFatal(err)
-	}
-	return string(abi), string(bin)
+	return a.ABI, common.Bytes2Hex(a.Bytecode), nil
 }
 
 func getChainConfig() *params.ChainConfig {
@@ -109,7 +100,7 @@ func getContext() vm.Context {
 		Origin: placeHolder,
 		GasPrice: big.NewInt(0),
 		Coinbase: placeHolder,
-		GasLimit: 10000000000,
+		GasLimit: DefaultGasLimits.Block,
 		BlockNumber: big.NewInt(0),
 		Time: big.NewInt(1),
 		Difficulty: big.NewInt(1),
@@ -117,6 +108,34 @@ func getContext() vm.Context {
 
 }
 
+//getHeader returns the Ethereum block header used when applying transactions to the bvm, with the block gas limit
+//of limits
+func getHeader(limits GasLimits) *types.Header {
+	return &types.Header{
+		Number:     big.NewInt(0),
+		Difficulty: big.NewInt(0),
+		ParentHash: common.Hash{0},
+		Time:       big.NewInt(0),
+		GasLimit:   limits.Block,
+	}
+}
+
+//applyMessage runs the message against db without requiring a signed transaction, with the system contracts reading
+//rst. It returns the output of the execution (the revert data if it failed), the gas used and whether the execution
+//failed.
+func applyMessage(db *state.StateDB, rst byzcoin.ReadOnlyStateTrie, msg types.Message) ([]byte, uint64, bool, error) {
+	limits, err := getGasLimits(rst)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	var bc core.ChainContext
+	ctx := core.NewEVMContext(msg, getHeader(limits), bc, &nilAddress)
+	bs := newBvmState(db, rst)
+	bvm := vm.NewEVM(ctx, bs, getChainConfig(), bs.vmConfig(getVMConfig()))
+	gp := new(core.GasPool).AddGas(msg.Gas())
+	return core.ApplyMessage(bvm, msg, gp)
+}
+
 //getDB returns the Memory Database and the general State database given the old Ethereum general state, kept into the ES struct
 func getDB(es ES) (*MemDatabase, *state.StateDB, error) {
 	memDB, err := NewMemDatabase(es.DbBuf)
@@ -131,12 +150,36 @@ func getDB(es ES) (*MemDatabase, *state.StateDB, error) {
 	return memDB, sdb, nil
 }
 
+//commitES commits the state database and the low level trie database, and returns the new Ethereum state to be
+//stored in the bvm instance
+func commitES(memdb *MemDatabase, db *state.StateDB) (ES, error) {
+	root, err := commitState(db)
+	if err != nil {
+		return ES{}, err
+	}
+	dbBuf, err := memdb.Dump()
+	if err != nil {
+		return ES{}, err
+	}
+	return ES{DbBuf: dbBuf, RootHash: root}, nil
+}
+
+//commitState commits the state database and the low level trie database, and returns the root of the state
+func commitState(db *state.StateDB) (common.Hash, error) {
+	root, err := db.Commit(true)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return root, db.Database().TrieDB().Commit(root, true)
+}
+
 //spawnEvm will return the memory database, the general state database and the EVM on which transactions will be applied
 func spawnEvm() (*MemDatabase, *state.StateDB, *vm.EVM, error) {
 	mdb, sdb, err := getDB(ES{DbBuf: []byte{}})
 	if err != nil {
 		return nil, nil, nil, err
 	}
+	installWithdraw(sdb)
 	bvm := vm.NewEVM(getContext(), sdb, getChainConfig(), getVMConfig())
 	return mdb, sdb, bvm, nil
 }
@@ -22,7 +22,8 @@ func TestTokenContract(t *testing.T) {
 	getHash := func(uint64) common.Hash {return common.HexToHash("O")}
 
 	//Get smart contract abi and bytecode
-	simpleAbi, simpleBin := getSmartContract( "ModifiedToken")
+	simpleAbi, simpleBin, err := getSmartContract("ModifiedToken")
+	require.Nil(t, err)
 
 	//Create dummy addresses for testing token transfers
 	addressA := common.HexToAddress("a")
@@ -0,0 +1,291 @@
+package byzcoin
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// The system contracts at ByzcoinStateAddress, Ed25519VerifyAddress and
+// DarcRuleAddress give the contracts access to the ledger. They are not
+// precompiled contracts: those of go-ethereum are global, shared by all the
+// EVMs of the process, and can't see the state trie of the instruction
+// being executed. Instead, every bvm EVM runs on its own bvmState, which
+// holds the state trie and serves the system contracts.
+//
+// The code of the system contracts hashes their address followed by the
+// call data. As the EVM records the preimages of the hashes, bvmState sees
+// the input, runs the host function of the address on it, and serves the
+// result as the code of the address made of the hash. The system code
+// copies that code, and returns it or reverts if the host function failed.
+// Before hashing, the system code burns the base gas of the host function in
+// a loop, so that a call costs this base gas plus hashing the input and
+// copying the output.
+//
+// The host function only runs when the SHA3 is executed by the system
+// contract itself: the EVM is given a tracer telling bvmState which
+// contract executes each SHA3. Another contract hashing the same preimage
+// gets no result, so the base gas can't be skipped.
+//
+// The contract at ByzcoinStateAddress gives a read-only access to the
+// instances of the ledger. Its input is the 32 bytes ID of an instance,
+// and it returns the ABI encoding of
+//
+//	(bool found, bytes value, string contractID, bytes32 darcID)
+
+// ByzcoinStateAddress is the address of the system contract reading
+// byzcoin instances.
+var ByzcoinStateAddress = common.HexToAddress("0x00000000000000000000000000000000000000b2")
+
+// hostFunction computes the output of a system contract from its input and
+// the state trie of the EVM, which can be nil.
+type hostFunction func(rst byzcoin.ReadOnlyStateTrie, input []byte) ([]byte, error)
+
+// hostContract is a system contract: its host function and the gas burnt
+// before running it.
+type hostContract struct {
+	run hostFunction
+	gas uint64
+}
+
+// byzcoinStateGas is the base cost of reading an instance, as a cold SLOAD
+const byzcoinStateGas = uint64(700)
+
+// hostContracts are the system contracts, by address.
+var hostContracts = map[common.Address]hostContract{
+	ByzcoinStateAddress:  {readInstance, byzcoinStateGas},
+	Ed25519VerifyAddress: {verifyEd25519, ed25519VerifyGas},
+	DarcRuleAddress:      {evalDarcRuleInput, darcRuleGas},
+}
+
+var byzcoinStateOutput abi.Arguments
+
+func init() {
+	byzcoinStateOutput = abi.Arguments{}
+	for _, t := range []string{"bool", "bytes", "string", "bytes32"} {
+		typ, err := abi.NewType(t)
+		if err != nil {
+			panic(err)
+		}
+		byzcoinStateOutput = append(byzcoinStateOutput, abi.Argument{Type: typ})
+	}
+}
+
+// burnLoopGas is the gas of an iteration of the loop burning the base gas
+const burnLoopGas = 26
+
+// hostCode returns the code of a system contract burning gas. It hashes the
+// address of the contract followed by the call data, and returns the code of
+// the address made of the hash, without its first byte, if that byte is 1.
+// It reverts otherwise.
+func hostCode(gas uint64) []byte {
+	const ok = 52
+	n := gas / burnLoopGas
+	if n == 0 {
+		n = 1
+	}
+	if n > 0xffff {
+		panic("too much gas to burn in the system code")
+	}
+	code := []byte{
+		// for n := gas / burnLoopGas; n != 0; n-- {}
+		byte(vm.PUSH2), byte(n >> 8), byte(n),
+		byte(vm.JUMPDEST), byte(vm.PUSH1), 1, byte(vm.SWAP1), byte(vm.SUB),
+		byte(vm.DUP1), byte(vm.PUSH1), 3, byte(vm.JUMPI), byte(vm.POP),
+		// mem[0:32] = ADDRESS, mem[32:] = call data
+		byte(vm.ADDRESS), byte(vm.PUSH1), 0, byte(vm.MSTORE),
+		byte(vm.CALLDATASIZE), byte(vm.PUSH1), 0, byte(vm.PUSH1), 32, byte(vm.CALLDATACOPY),
+		// h = SHA3(0, 32 + CALLDATASIZE), bvmState computes the result
+		byte(vm.PUSH1), 32, byte(vm.CALLDATASIZE), byte(vm.ADD), byte(vm.PUSH1), 0, byte(vm.SHA3),
+		// n = EXTCODESIZE(h), EXTCODECOPY(h, 0, 0, n)
+		byte(vm.DUP1), byte(vm.EXTCODESIZE),
+		byte(vm.DUP1), byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.DUP5), byte(vm.EXTCODECOPY),
+		// The first byte tells whether the host function succeeded
+		byte(vm.PUSH1), 0, byte(vm.MLOAD), byte(vm.PUSH1), 0, byte(vm.BYTE),
+		byte(vm.PUSH1), ok, byte(vm.JUMPI),
+		byte(vm.PUSH1), 0, byte(vm.DUP1), byte(vm.REVERT),
+		// RETURN(1, n - 1)
+		byte(vm.JUMPDEST), byte(vm.PUSH1), 1, byte(vm.SWAP1), byte(vm.SUB), byte(vm.PUSH1), 1, byte(vm.RETURN),
+	}
+	if code[ok] != byte(vm.JUMPDEST) {
+		panic("wrong jump destination in the system code")
+	}
+	return code
+}
+
+// systemCodes are the codes of the system contracts, by address.
+var systemCodes = func() map[common.Address][]byte {
+	codes := map[common.Address][]byte{}
+	for addr, c := range hostContracts {
+		codes[addr] = hostCode(c.gas)
+	}
+	return codes
+}()
+
+// bvmState is the state of the bvm EVMs: the Ethereum state, with the
+// system contracts reading the state trie rst.
+type bvmState struct {
+	*state.StateDB
+	rst byzcoin.ReadOnlyStateTrie
+	// results are the outputs of the host functions, served as the code of
+	// the address made of the hash of their input
+	results map[common.Address][]byte
+	// hashing is the contract executing the current SHA3
+	hashing common.Address
+}
+
+// newBvmState returns the state of an EVM running on db, whose system
+// contracts read rst. If rst is nil, the calls reading the ledger fail.
+func newBvmState(db *state.StateDB, rst byzcoin.ReadOnlyStateTrie) *bvmState {
+	return &bvmState{StateDB: db, rst: rst, results: map[common.Address][]byte{}}
+}
+
+// vmConfig returns config with the tracer telling s which contract
+// executes the SHA3s. The steps are passed on to the tracer of config if it
+// is in debug mode.
+func (s *bvmState) vmConfig(config vm.Config) vm.Config {
+	tracer := &hostTracer{state: s}
+	if config.Debug {
+		tracer.next = config.Tracer
+	}
+	config.Debug = true
+	config.Tracer = tracer
+	return config
+}
+
+// AddPreimage records the preimage of hash, and runs the host function it
+// is the input of, if any, when the system contract hashes it.
+func (s *bvmState) AddPreimage(hash common.Hash, preimage []byte) {
+	s.StateDB.AddPreimage(hash, preimage)
+	hashing := s.hashing
+	s.hashing = common.Address{}
+	if len(preimage) < 32 || !bytes.Equal(preimage[:12], make([]byte, 12)) {
+		return
+	}
+	address := common.BytesToAddress(preimage[12:32])
+	if address != hashing {
+		return
+	}
+	c, ok := hostContracts[address]
+	if !ok {
+		return
+	}
+	result := []byte{0}
+	if out, err := c.run(s.rst, preimage[32:]); err == nil {
+		result = append([]byte{1}, out...)
+	}
+	s.results[common.BytesToAddress(hash.Bytes())] = result
+}
+
+// hostTracer records in state the contract executing each SHA3, before the
+// EVM hashes and records the preimage.
+type hostTracer struct {
+	state *bvmState
+	next  vm.Tracer
+}
+
+func (ht *hostTracer) CaptureStart(from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) error {
+	if ht.next == nil {
+		return nil
+	}
+	return ht.next.CaptureStart(from, to, create, input, gas, value)
+}
+
+// CaptureState records the contract executing op if it is a SHA3.
+func (ht *hostTracer) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int, err error) error {
+	ht.state.hashing = common.Address{}
+	if op == vm.SHA3 && err == nil {
+		ht.state.hashing = contract.Address()
+	}
+	if ht.next == nil {
+		return nil
+	}
+	return ht.next.CaptureState(env, pc, op, gas, cost, memory, stack, contract, depth, err)
+}
+
+func (ht *hostTracer) CaptureFault(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int, err error) error {
+	if ht.next == nil {
+		return nil
+	}
+	return ht.next.CaptureFault(env, pc, op, gas, cost, memory, stack, contract, depth, err)
+}
+
+func (ht *hostTracer) CaptureEnd(output []byte, gasUsed uint64, t time.Duration, err error) error {
+	if ht.next == nil {
+		return nil
+	}
+	return ht.next.CaptureEnd(output, gasUsed, t, err)
+}
+
+func (s *bvmState) Exist(addr common.Address) bool {
+	if _, ok := hostContracts[addr]; ok {
+		return true
+	}
+	return s.StateDB.Exist(addr)
+}
+
+func (s *bvmState) Empty(addr common.Address) bool {
+	if _, ok := hostContracts[addr]; ok {
+		return false
+	}
+	return s.StateDB.Empty(addr)
+}
+
+func (s *bvmState) GetCode(addr common.Address) []byte {
+	if code, ok := systemCodes[addr]; ok {
+		return code
+	}
+	if result, ok := s.results[addr]; ok {
+		return result
+	}
+	return s.StateDB.GetCode(addr)
+}
+
+func (s *bvmState) GetCodeSize(addr common.Address) int {
+	if code, ok := systemCodes[addr]; ok {
+		return len(code)
+	}
+	if result, ok := s.results[addr]; ok {
+		return len(result)
+	}
+	return s.StateDB.GetCodeSize(addr)
+}
+
+func (s *bvmState) GetCodeHash(addr common.Address) common.Hash {
+	if code, ok := systemCodes[addr]; ok {
+		return crypto.Keccak256Hash(code)
+	}
+	if result, ok := s.results[addr]; ok {
+		return crypto.Keccak256Hash(result)
+	}
+	return s.StateDB.GetCodeHash(addr)
+}
+
+// readInstance is the host function of ByzcoinStateAddress.
+func readInstance(rst byzcoin.ReadOnlyStateTrie, input []byte) ([]byte, error) {
+	if len(input) != 32 {
+		return nil, errors.New("the input must be a 32 bytes instance ID")
+	}
+	if rst == nil {
+		return nil, errors.New("no byzcoin state")
+	}
+	value, _, contractID, darcID, err := rst.GetValues(input)
+	found := err == nil
+	if !found {
+		value, contractID, darcID = nil, "", nil
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	var darcHash [32]byte
+	copy(darcHash[:], darcID)
+	return byzcoinStateOutput.Pack(found, value, contractID, darcHash)
+}
@@ -0,0 +1,118 @@
+package byzcoin
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/darc"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/stretchr/testify/require"
+)
+
+//Reads instances of a state trie through the system contract
+func TestByzcoinStateReader(t *testing.T) {
+	_, db, err := getDB(ES{DbBuf: []byte{}})
+	require.Nil(t, err)
+	rst := newMemStateTrie()
+	id := byzcoin.NewInstanceID([]byte("instance"))
+	darcID := darc.ID(common.HexToHash("0xda4c").Bytes())
+	rst.apply([]byzcoin.StateChange{
+		byzcoin.NewStateChange(byzcoin.Create, id, "value", []byte("hello"), darcID),
+	})
+
+	call := func(input []byte) ([]byte, uint64, bool) {
+		msg := types.NewMessage(nilAddress, &ByzcoinStateAddress, 0, big.NewInt(0), 1e6, big.NewInt(0), input, false)
+		ret, gas, failed, err := applyMessage(db.Copy(), rst, msg)
+		require.Nil(t, err)
+		return ret, gas, failed
+	}
+
+	ret, gas, failed := call(id.Slice())
+	require.False(t, failed)
+	//The ID is "instance" padded with zeros
+	intrinsic := params.TxGas + params.TxDataNonZeroGas*8 + params.TxDataZeroGas*24
+	require.True(t, gas > intrinsic+byzcoinStateGas/burnLoopGas*burnLoopGas)
+	values, err := byzcoinStateOutput.UnpackValues(ret)
+	require.Nil(t, err)
+	require.Equal(t, true, values[0])
+	require.Equal(t, []byte("hello"), values[1])
+	require.Equal(t, "value", values[2])
+	require.Equal(t, [32]byte(common.BytesToHash(darcID)), values[3])
+
+	//An unknown instance is not found
+	ret, _, failed = call(byzcoin.NewInstanceID([]byte("unknown")).Slice())
+	require.False(t, failed)
+	values, err = byzcoinStateOutput.UnpackValues(ret)
+	require.Nil(t, err)
+	require.Equal(t, false, values[0])
+
+	//The input must be an instance ID
+	_, _, failed = call([]byte("instance"))
+	require.True(t, failed)
+
+	//Without a state trie the call fails
+	msg := types.NewMessage(nilAddress, &ByzcoinStateAddress, 0, big.NewInt(0), 1e6, big.NewInt(0), id.Slice(), false)
+	_, _, failed, err = applyMessage(db.Copy(), nil, msg)
+	require.Nil(t, err)
+	require.True(t, failed)
+
+	//Every EVM reads its own state trie
+	other := newMemStateTrie()
+	other.apply([]byzcoin.StateChange{
+		byzcoin.NewStateChange(byzcoin.Create, id, "value", []byte("world"), darcID),
+	})
+	ret, _, failed, err = applyMessage(db.Copy(), other, msg)
+	require.Nil(t, err)
+	require.False(t, failed)
+	values, err = byzcoinStateOutput.UnpackValues(ret)
+	require.Nil(t, err)
+	require.Equal(t, []byte("world"), values[1])
+}
+
+//The system contracts are not added to the precompiled contracts of go-ethereum
+func TestSystemContractsNotPrecompiled(t *testing.T) {
+	for address := range hostContracts {
+		_, ok := vm.PrecompiledContractsByzantium[address]
+		require.False(t, ok)
+		_, ok = vm.PrecompiledContractsHomestead[address]
+		require.False(t, ok)
+	}
+}
+
+//Only the system contracts run the host functions, a contract hashing their input gets no result
+func TestHostFunctionsOnlyForSystemCode(t *testing.T) {
+	_, db, err := getDB(ES{DbBuf: []byte{}})
+	require.Nil(t, err)
+	rst := newMemStateTrie()
+	id := byzcoin.NewInstanceID([]byte("instance"))
+	rst.apply([]byzcoin.StateChange{
+		byzcoin.NewStateChange(byzcoin.Create, id, "value", []byte("hello"), darc.ID(common.HexToHash("0xda4c").Bytes())),
+	})
+
+	//Returns the code size of the address made of the hash of the call data
+	hasher := common.HexToAddress("0x4a54")
+	db.SetCode(hasher, []byte{
+		byte(vm.CALLDATASIZE), byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.CALLDATACOPY),
+		byte(vm.CALLDATASIZE), byte(vm.PUSH1), 0, byte(vm.SHA3), byte(vm.EXTCODESIZE),
+		byte(vm.PUSH1), 0, byte(vm.MSTORE), byte(vm.PUSH1), 32, byte(vm.PUSH1), 0, byte(vm.RETURN),
+	})
+	preimage := append(common.LeftPadBytes(ByzcoinStateAddress.Bytes(), 32), id.Slice()...)
+	msg := types.NewMessage(nilAddress, &hasher, 0, big.NewInt(0), 1e6, big.NewInt(0), preimage, false)
+	ret, _, failed, err := applyMessage(db, rst, msg)
+	require.Nil(t, err)
+	require.False(t, failed)
+	require.Equal(t, make([]byte, 32), ret)
+
+	//The system contract hashing the same preimage gets the instance
+	msg = types.NewMessage(nilAddress, &ByzcoinStateAddress, 0, big.NewInt(0), 1e6, big.NewInt(0), id.Slice(), false)
+	ret, _, failed, err = applyMessage(db, rst, msg)
+	require.Nil(t, err)
+	require.False(t, failed)
+	values, err := byzcoinStateOutput.UnpackValues(ret)
+	require.Nil(t, err)
+	require.Equal(t, true, values[0])
+}
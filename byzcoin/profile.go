@@ -0,0 +1,255 @@
+package byzcoin
+
+import (
+	"encoding/hex"
+	"sort"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+// The gas profile of a set of transactions is built by replaying them, like
+// the traces. The gas of every transaction is counted for the contract
+// function it called, found from the selector at the start of its input,
+// and the gas of every executed opcode is counted for this opcode.
+
+const (
+	// constructorKey and fallbackKey are the keys of the contract creations
+	// and of the calls without a selector in GasProfile.Functions
+	constructorKey = "constructor"
+	fallbackKey    = "fallback"
+)
+
+// GasProfile is the gas used by a set of transactions, by function and by
+// opcode. Two profiles of the same transactions sent to two versions of a
+// contract can be compared with CompareGasProfiles.
+type GasProfile struct {
+	Transactions uint64 `json:"transactions"`
+	GasUsed      uint64 `json:"gasUsed"`
+	// Functions is indexed by the hex selector of the function,
+	// "constructor" or "fallback"
+	Functions map[string]*FunctionGas `json:"functions"`
+	// Opcodes is indexed by the name of the opcode. The gas of an opcode
+	// doesn't include the intrinsic gas of the transaction, the refunds,
+	// and the gas used by the contracts it calls.
+	Opcodes map[string]*OpcodeGas `json:"opcodes"`
+}
+
+// FunctionGas is the gas used by the transactions calling a function.
+type FunctionGas struct {
+	// Name is the name of the function, if an ABI was given
+	Name    string `json:"name,omitempty"`
+	Calls   uint64 `json:"calls"`
+	Failed  uint64 `json:"failed"`
+	GasUsed uint64 `json:"gasUsed"`
+	MinGas  uint64 `json:"minGas"`
+	MaxGas  uint64 `json:"maxGas"`
+}
+
+// Average returns the average gas used by a call to the function.
+func (f *FunctionGas) Average() uint64 {
+	if f.Calls == 0 {
+		return 0
+	}
+	return f.GasUsed / f.Calls
+}
+
+// OpcodeGas is the gas used by an opcode.
+type OpcodeGas struct {
+	Count uint64 `json:"count"`
+	Gas   uint64 `json:"gas"`
+}
+
+// NewGasProfile returns an empty profile.
+func NewGasProfile() *GasProfile {
+	return &GasProfile{
+		Functions: map[string]*FunctionGas{},
+		Opcodes:   map[string]*OpcodeGas{},
+	}
+}
+
+// Name sets the names of the functions of contractAbi in the profile.
+func (p *GasProfile) Name(contractAbi abi.ABI) {
+	for name, method := range contractAbi.Methods {
+		if f, ok := p.Functions[hex.EncodeToString(method.Id())]; ok {
+			f.Name = name
+		}
+	}
+	if f, ok := p.Functions[constructorKey]; ok {
+		f.Name = constructorKey
+	}
+}
+
+// addTransaction adds a transaction replayed with profiler to the profile.
+func (p *GasProfile) addTransaction(create bool, input []byte, receipt *Receipt, profiler *gasProfiler) {
+	key := fallbackKey
+	switch {
+	case create:
+		key = constructorKey
+	case len(input) >= 4:
+		key = hex.EncodeToString(input[:4])
+	}
+	f, ok := p.Functions[key]
+	if !ok {
+		f = &FunctionGas{MinGas: receipt.GasUsed}
+		p.Functions[key] = f
+	}
+	f.Calls++
+	if receipt.Status == 0 {
+		f.Failed++
+	}
+	f.GasUsed += receipt.GasUsed
+	if receipt.GasUsed < f.MinGas {
+		f.MinGas = receipt.GasUsed
+	}
+	if receipt.GasUsed > f.MaxGas {
+		f.MaxGas = receipt.GasUsed
+	}
+
+	for _, step := range profiler.steps {
+		o, ok := p.Opcodes[step.op.String()]
+		if !ok {
+			o = &OpcodeGas{}
+			p.Opcodes[step.op.String()] = o
+		}
+		o.Count++
+		o.Gas += step.gas()
+	}
+	p.Transactions++
+	p.GasUsed += receipt.GasUsed
+}
+
+// GasDiff is the difference of gas of a function or an opcode between two
+// profiles. Functions are compared on their average gas, opcodes on their
+// total gas.
+type GasDiff struct {
+	Kind   string `json:"kind"`
+	Key    string `json:"key"`
+	Name   string `json:"name,omitempty"`
+	Before uint64 `json:"before"`
+	After  uint64 `json:"after"`
+}
+
+// Delta returns the change of gas, negative if After uses less gas.
+func (d GasDiff) Delta() int64 {
+	return int64(d.After) - int64(d.Before)
+}
+
+// CompareGasProfiles returns the functions and opcodes whose gas differs
+// between before and after, the functions first, each sorted by key.
+func CompareGasProfiles(before, after *GasProfile) []GasDiff {
+	var functions, opcodes []GasDiff
+	for _, key := range unionKeys(before.Functions, after.Functions) {
+		d := GasDiff{Kind: "function", Key: key}
+		if f, ok := before.Functions[key]; ok {
+			d.Before = f.Average()
+			d.Name = f.Name
+		}
+		if f, ok := after.Functions[key]; ok {
+			d.After = f.Average()
+			if f.Name != "" {
+				d.Name = f.Name
+			}
+		}
+		if d.Before != d.After {
+			functions = append(functions, d)
+		}
+	}
+	opKeys := map[string]bool{}
+	for key := range before.Opcodes {
+		opKeys[key] = true
+	}
+	for key := range after.Opcodes {
+		opKeys[key] = true
+	}
+	for key := range opKeys {
+		d := GasDiff{Kind: "opcode", Key: key}
+		if o, ok := before.Opcodes[key]; ok {
+			d.Before = o.Gas
+		}
+		if o, ok := after.Opcodes[key]; ok {
+			d.After = o.Gas
+		}
+		if d.Before != d.After {
+			opcodes = append(opcodes, d)
+		}
+	}
+	sort.Slice(opcodes, func(i, j int) bool { return opcodes[i].Key < opcodes[j].Key })
+	return append(functions, opcodes...)
+}
+
+func unionKeys(a, b map[string]*FunctionGas) []string {
+	keys := []string{}
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// profileTransactions replays the transactions txHashes and returns their
+// gas profile.
+func profileTransactions(memdb *MemDatabase, rst byzcoin.ReadOnlyStateTrie, txHashes []common.Hash) (*GasProfile, error) {
+	profile := NewGasProfile()
+	for _, txHash := range txHashes {
+		profiler := newGasProfiler()
+		_, replayed, _, _, err := replayTransaction(memdb, rst, txHash, profiler)
+		if err != nil {
+			return nil, err
+		}
+		tx, err := getTransaction(memdb, txHash)
+		if err != nil {
+			return nil, err
+		}
+		profile.addTransaction(tx.To() == nil, tx.Data(), replayed, profiler)
+	}
+	return profile, nil
+}
+
+// gasProfiler records the cost of every step. It follows the calls with a
+// call tracer, as the cost of a call opcode given by the EVM includes the
+// gas given to the callee, which is counted by the steps of the callee.
+type gasProfiler struct {
+	*callTracer
+	steps []*stepGas
+}
+
+type stepGas struct {
+	op   vm.OpCode
+	cost uint64
+	// call is the frame opened by a call opcode
+	call *openFrame
+}
+
+// gas returns the gas used by the step itself. For a call, the gas given to
+// the callee is removed from the cost once the callee started, or the gas
+// given back if it never started.
+func (s *stepGas) gas() uint64 {
+	if s.call == nil || s.op == vm.CREATE || s.op == vm.CREATE2 {
+		return s.cost
+	}
+	if s.call.Gas > s.cost {
+		return 0
+	}
+	return s.cost - s.call.Gas
+}
+
+func newGasProfiler() *gasProfiler {
+	return &gasProfiler{callTracer: newCallTracer()}
+}
+
+// CaptureState records the step after passing it to the call tracer.
+func (gp *gasProfiler) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int, err error) error {
+	cerr := gp.callTracer.CaptureState(env, pc, op, gas, cost, memory, stack, contract, depth, err)
+	if err == nil {
+		gp.steps = append(gp.steps, &stepGas{op: op, cost: cost, call: gp.callTracer.opened})
+	}
+	return cerr
+}
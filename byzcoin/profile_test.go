@@ -0,0 +1,66 @@
+package byzcoin
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/require"
+)
+
+//Profiles the deployment of a MinimumToken and three transfers, one of them failing
+func TestProfileTransactions(t *testing.T) {
+	token := newTokenFixture(t)
+	memdb, db, err := getDB(ES{DbBuf: []byte{}})
+	require.Nil(t, err)
+	db.SetBalance(token.addressA, big.NewInt(1e18*5))
+	es, err := commitES(memdb, db)
+	require.Nil(t, err)
+	tokenAbi := token.abi
+	gasLimit, gasPrice := transactionGasParameters()
+
+	txs := []*types.Transaction{types.NewContractCreation(0, big.NewInt(0), gasLimit, gasPrice, token.code)}
+	contractAddress := crypto.CreateAddress(token.addressA, 0)
+	for i, amount := range []int64{10, 20, 1000} {
+		txs = append(txs, types.NewTransaction(uint64(i+1), contractAddress, big.NewInt(0), gasLimit, gasPrice, token.transfer(t, token.addressB, amount)))
+	}
+	var txHashes []common.Hash
+	var gasUsed uint64
+	for _, tx := range txs {
+		signedTx := token.signTx(t, tx)
+		var receipt *Receipt
+		es, receipt = sendStored(t, es, signedTx)
+		txHashes = append(txHashes, signedTx.Hash())
+		gasUsed += receipt.GasUsed
+	}
+
+	memdb, _, err = getDB(es)
+	require.Nil(t, err)
+	profile, err := profileTransactions(memdb, nil, txHashes)
+	require.Nil(t, err)
+	profile.Name(tokenAbi)
+	require.Equal(t, uint64(4), profile.Transactions)
+	require.Equal(t, gasUsed, profile.GasUsed)
+
+	require.Equal(t, uint64(1), profile.Functions[constructorKey].Calls)
+	transferFrom := profile.Functions[common.Bytes2Hex(tokenAbi.Methods["transferFrom"].Id())]
+	require.NotNil(t, transferFrom)
+	require.Equal(t, "transferFrom", transferFrom.Name)
+	require.Equal(t, uint64(3), transferFrom.Calls)
+	require.Equal(t, uint64(1), transferFrom.Failed)
+	require.True(t, transferFrom.MinGas < transferFrom.MaxGas)
+	//Two stores in the constructor, two in each successful transfer
+	require.Equal(t, uint64(6), profile.Opcodes["SSTORE"].Count)
+	require.True(t, profile.Opcodes["SSTORE"].Gas >= 6*5000)
+
+	//Without the failing transfer, the average cost of transferFrom changes
+	other, err := profileTransactions(memdb, nil, txHashes[:3])
+	require.Nil(t, err)
+	require.Empty(t, CompareGasProfiles(profile, profile))
+	diff := CompareGasProfiles(other, profile)
+	require.NotEmpty(t, diff)
+	require.Equal(t, "function", diff[0].Kind)
+	require.Equal(t, transferFrom.Average(), diff[0].After)
+}
@@ -1,6 +1,10 @@
 package byzcoin
 
-import "github.com/dedis/cothority/byzcoin"
+import (
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/ethereum/go-ethereum/common"
+)
 
 // PROTOSTART
 // package keyvalue;
@@ -32,4 +36,148 @@ type ContractDeploymentData struct {
 	gas uint64
 }
 
+// GetNonce asks for the current nonce of an Ethereum address in the bvm
+// instance InstanceID of the ledger ByzCoinID.
+type GetNonce struct {
+	ByzCoinID  skipchain.SkipBlockID
+	InstanceID byzcoin.InstanceID
+	Address    common.Address
+}
+
+// GetNonceReply holds the nonce to use for the next transaction of the
+// address.
+type GetNonceReply struct {
+	Nonce uint64
+}
+
+// EstimateGas asks for the lowest gas limit with which a transaction sent by
+// From succeeds on the current state of the bvm instance. To is empty for a
+// contract creation, and Value is the big-endian amount of wei sent. If Gas
+// is not zero, no gas limit higher than Gas is tried.
+type EstimateGas struct {
+	ByzCoinID  skipchain.SkipBlockID
+	InstanceID byzcoin.InstanceID
+	From       common.Address
+	To         []byte
+	Value      []byte
+	Data       []byte
+	Gas        uint64
+}
+
+// EstimateGasReply holds the estimated gas limit. If the transaction reverts
+// with every gas limit, Reverted is true and RevertData holds the data
+// returned by the contract.
+type EstimateGasReply struct {
+	Gas        uint64
+	Reverted   bool
+	RevertData []byte
+}
+
+// GetReceipt asks for the receipt of the Ethereum transaction TxHash.
+type GetReceipt struct {
+	ByzCoinID  skipchain.SkipBlockID
+	InstanceID byzcoin.InstanceID
+	TxHash     common.Hash
+}
+
+// GetReceiptReply holds the JSON encoding of the receipt.
+type GetReceiptReply struct {
+	Receipt []byte
+}
+
+// GetLogs asks for the logs emitted by the transactions of the bvm instance
+// that match the filter. See LogFilter for the meaning of the fields.
+type GetLogs struct {
+	ByzCoinID  skipchain.SkipBlockID
+	InstanceID byzcoin.InstanceID
+	FromBlock  uint64
+	ToBlock    uint64
+	Addresses  []common.Address
+	Topics     []LogTopics
+}
+
+// LogTopics are the accepted topics at one position of the log topics.
+type LogTopics struct {
+	Hashes []common.Hash
+}
+
+// GetLogsReply holds the JSON encoding of the matching logs.
+type GetLogsReply struct {
+	Logs []byte
+}
+
+// StreamReceipts opens a stream on which the receipts of the new transactions
+// of the bvm instance are sent as their blocks are added to the ledger. If
+// Addresses or Topics are given, only the receipts with at least one
+// matching log are sent.
+type StreamReceipts struct {
+	ByzCoinID  skipchain.SkipBlockID
+	InstanceID byzcoin.InstanceID
+	Addresses  []common.Address
+	Topics     []LogTopics
+}
+
+// StreamReceiptsReply is sent for every new receipt. Receipt and Logs are
+// the JSON encodings of the receipt and of its logs matching the filter.
+type StreamReceiptsReply struct {
+	BlockIndex uint64
+	Receipt    []byte
+	Logs       []byte
+}
+
+// TraceTransaction asks for the opcode trace of the transaction TxHash,
+// replayed on the state it was applied to. The Disable fields leave out parts
+// of every step to make the trace smaller.
+type TraceTransaction struct {
+	ByzCoinID      skipchain.SkipBlockID
+	InstanceID     byzcoin.InstanceID
+	TxHash         common.Hash
+	DisableStack   bool
+	DisableMemory  bool
+	DisableStorage bool
+}
+
+// TraceTransactionReply holds the JSON encoding of the TraceResult.
+type TraceTransactionReply struct {
+	Trace []byte
+}
+
+// TraceCalls asks for the call tree of the transaction TxHash, replayed on
+// the state it was applied to.
+type TraceCalls struct {
+	ByzCoinID  skipchain.SkipBlockID
+	InstanceID byzcoin.InstanceID
+	TxHash     common.Hash
+}
 
+// TraceCallsReply holds the JSON encoding of the root CallFrame.
+type TraceCallsReply struct {
+	Trace []byte
+}
+
+// ProfileGas asks for the gas profile of the transactions TxHashes, replayed
+// on the state they were applied to.
+type ProfileGas struct {
+	ByzCoinID  skipchain.SkipBlockID
+	InstanceID byzcoin.InstanceID
+	TxHashes   []common.Hash
+}
+
+// ProfileGasReply holds the JSON encoding of the GasProfile.
+type ProfileGasReply struct {
+	Profile []byte
+}
+
+// GetContract asks for the contract Name of the registry of the bvm
+// instance, or for all of them if Name is empty.
+type GetContract struct {
+	ByzCoinID  skipchain.SkipBlockID
+	InstanceID byzcoin.InstanceID
+	Name       string
+}
+
+// GetContractReply holds the JSON encoding of the list of
+// RegisteredContract.
+type GetContractReply struct {
+	Contracts []byte
+}
@@ -0,0 +1,175 @@
+package byzcoin
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// The bvm instance keeps a registry of approved code, the hashes of the
+// runtime code of the contracts verified with Stainless, together with the
+// hash of the Scala source and the version of Stainless that produced them.
+// They are added and removed with the approveCode instruction. Once the
+// enforceApprovedCode instruction turned the check on, the transactions
+// creating a contract whose code is not approved fail, and the whole
+// instruction with them. The contracts created by the CREATEs and CREATE2s
+// of other contracts are checked as well, so that neither approved code
+// nor a factory deployed earlier can create unapproved contracts.
+
+var approvedCodeKey = []byte("bvm-approved-code")
+
+// ApprovedCode is the provenance of the runtime code of a verified contract.
+type ApprovedCode struct {
+	// CodeHash is the Keccak256 hash of the runtime code, see CodeHash
+	CodeHash common.Hash `json:"codeHash"`
+	// SourceHash is the hash of the Scala source
+	SourceHash common.Hash `json:"sourceHash"`
+	// Stainless is the version of Stainless that verified the source and
+	// compiled it
+	Stainless string `json:"stainless"`
+}
+
+// CodeHash returns the hash of the runtime code of a contract, as approved
+// in the registry.
+func CodeHash(deployedBytecode []byte) common.Hash {
+	return crypto.Keccak256Hash(deployedBytecode)
+}
+
+// approvedCodes is the registry of the approved code of a bvm instance.
+type approvedCodes struct {
+	Enforce bool           `json:"enforce"`
+	Codes   []ApprovedCode `json:"codes"`
+}
+
+// approveCode adds code to the registry, replacing the provenance of the
+// same code hash.
+func approveCode(memdb *MemDatabase, code ApprovedCode) error {
+	if code.CodeHash == (common.Hash{}) || code.SourceHash == (common.Hash{}) || code.Stainless == "" {
+		return errors.New("the approved code needs a code hash, a source hash and a Stainless version")
+	}
+	r, err := getApprovedCodes(memdb)
+	if err != nil {
+		return err
+	}
+	for i := range r.Codes {
+		if r.Codes[i].CodeHash == code.CodeHash {
+			r.Codes[i] = code
+			return putApprovedCodes(memdb, r)
+		}
+	}
+	r.Codes = append(r.Codes, code)
+	return putApprovedCodes(memdb, r)
+}
+
+// revokeCode removes the code codeHash from the registry.
+func revokeCode(memdb *MemDatabase, codeHash common.Hash) error {
+	r, err := getApprovedCodes(memdb)
+	if err != nil {
+		return err
+	}
+	kept := []ApprovedCode{}
+	for _, code := range r.Codes {
+		if code.CodeHash != codeHash {
+			kept = append(kept, code)
+		}
+	}
+	if len(kept) == len(r.Codes) {
+		return errors.New("code " + codeHash.Hex() + " is not approved")
+	}
+	r.Codes = kept
+	return putApprovedCodes(memdb, r)
+}
+
+// enforceApprovedCode turns the check of the deployed code on or off.
+func enforceApprovedCode(memdb *MemDatabase, enforce bool) error {
+	r, err := getApprovedCodes(memdb)
+	if err != nil {
+		return err
+	}
+	r.Enforce = enforce
+	return putApprovedCodes(memdb, r)
+}
+
+// getApprovedCode returns the provenance of the code codeHash, nil if it is
+// not approved.
+func getApprovedCode(memdb *MemDatabase, codeHash common.Hash) (*ApprovedCode, error) {
+	r, err := getApprovedCodes(memdb)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range r.Codes {
+		if code.CodeHash == codeHash {
+			return &code, nil
+		}
+	}
+	return nil, nil
+}
+
+// checkApprovedCode returns an error if the check is on and the code of one
+// of the contracts created at addresses is not approved. The addresses
+// without code, whose creation was reverted, are skipped.
+func checkApprovedCode(memdb *MemDatabase, db *state.StateDB, addresses []common.Address) error {
+	r, err := getApprovedCodes(memdb)
+	if err != nil || !r.Enforce {
+		return err
+	}
+	for _, address := range addresses {
+		if db.GetCodeSize(address) == 0 {
+			continue
+		}
+		if !r.approved(db.GetCodeHash(address)) {
+			return errors.New("the code " + db.GetCodeHash(address).Hex() + " deployed at " + address.Hex() + " is not approved")
+		}
+	}
+	return nil
+}
+
+// approved tells if the code codeHash is in the registry.
+func (r *approvedCodes) approved(codeHash common.Hash) bool {
+	for _, code := range r.Codes {
+		if code.CodeHash == codeHash {
+			return true
+		}
+	}
+	return false
+}
+
+func getApprovedCodes(memdb *MemDatabase) (*approvedCodes, error) {
+	r := &approvedCodes{}
+	ok, err := memdb.Has(approvedCodeKey)
+	if err != nil || !ok {
+		return r, err
+	}
+	buf, err := memdb.Get(approvedCodeKey)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(buf, r)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func putApprovedCodes(memdb *MemDatabase, r *approvedCodes) error {
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return memdb.Put(approvedCodeKey, buf)
+}
+
+// approveCodeArgs returns the arguments of the approveCode instruction.
+func approveCodeArgs(code ApprovedCode, remove bool) byzcoin.Arguments {
+	// An ApprovedCode always encodes
+	buf, _ := json.Marshal(code)
+	args := byzcoin.Arguments{{Name: "code", Value: buf}}
+	if remove {
+		args = append(args, byzcoin.Argument{Name: "remove", Value: []byte{1}})
+	}
+	return args
+}
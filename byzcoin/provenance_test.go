@@ -0,0 +1,119 @@
+package byzcoin
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/require"
+)
+
+//factoryRuntime is the code of a factory, creating a contract with the call data as creation code
+var factoryRuntime = []byte{
+	byte(vm.CALLDATASIZE), byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.CALLDATACOPY),
+	byte(vm.CALLDATASIZE), byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.CREATE),
+	byte(vm.PUSH1), 0, byte(vm.MSTORE), byte(vm.PUSH1), 32, byte(vm.PUSH1), 0, byte(vm.RETURN),
+}
+
+//factoryCode returns the creation code of a factory whose constructor creates a contract with the creation code
+//child, if it is not empty
+func factoryCode(child []byte) []byte {
+	var code []byte
+	header := 12
+	if len(child) > 0 {
+		header += 15
+		childOffset := byte(header + len(factoryRuntime))
+		code = append(code,
+			byte(vm.PUSH1), byte(len(child)), byte(vm.PUSH1), childOffset, byte(vm.PUSH1), 0, byte(vm.CODECOPY),
+			byte(vm.PUSH1), byte(len(child)), byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.CREATE), byte(vm.POP),
+		)
+	}
+	code = append(code,
+		byte(vm.PUSH1), byte(len(factoryRuntime)), byte(vm.PUSH1), byte(header), byte(vm.PUSH1), 0, byte(vm.CODECOPY),
+		byte(vm.PUSH1), byte(len(factoryRuntime)), byte(vm.PUSH1), 0, byte(vm.RETURN),
+	)
+	code = append(code, factoryRuntime...)
+	return append(code, child...)
+}
+
+//Only deploys the approved code once the registry is enforced
+func TestApprovedCode(t *testing.T) {
+	sb, keyA := newFundedBackend(t)
+	defer sb.Close()
+
+	emitter, _, err := sb.Deploy(keyA, emitterCode(), nil)
+	require.Nil(t, err)
+	es, err := sb.getES()
+	require.Nil(t, err)
+	_, db, err := getDB(*es)
+	require.Nil(t, err)
+	code := ApprovedCode{
+		CodeHash:   CodeHash(db.GetCode(emitter)),
+		SourceHash: crypto.Keccak256Hash([]byte("object Emitter")),
+		Stainless:  "0.1.0",
+	}
+	require.Equal(t, db.GetCodeHash(emitter), code.CodeHash)
+
+	require.NotNil(t, sb.ApproveCode(ApprovedCode{CodeHash: code.CodeHash}))
+	require.Nil(t, sb.EnforceApprovedCode(true))
+	_, _, err = sb.Deploy(keyA, emitterCode(), nil)
+	require.NotNil(t, err)
+
+	require.Nil(t, sb.ApproveCode(code))
+	approved, err := sb.GetApprovedCode(code.CodeHash)
+	require.Nil(t, err)
+	require.Equal(t, &code, approved)
+	_, _, err = sb.Deploy(keyA, emitterCode(), nil)
+	require.Nil(t, err)
+	//Other transactions are not checked
+	_, err = sb.Transact(keyA, common.HexToAddress("0x2887A24130cACFD8f71C479d9f9Da5b9C6425CE8"), nil, nil)
+	require.Nil(t, err)
+
+	require.Nil(t, sb.RevokeCode(code.CodeHash))
+	require.NotNil(t, sb.RevokeCode(code.CodeHash))
+	_, _, err = sb.Deploy(keyA, emitterCode(), nil)
+	require.NotNil(t, err)
+	require.Nil(t, sb.EnforceApprovedCode(false))
+	_, _, err = sb.Deploy(keyA, emitterCode(), nil)
+	require.Nil(t, err)
+	approved, err = sb.GetApprovedCode(common.Hash{})
+	require.Nil(t, err)
+	require.Nil(t, approved)
+}
+
+//The contracts created by other contracts need approved code too
+func TestApprovedCodeFactory(t *testing.T) {
+	sb, keyA := newFundedBackend(t)
+	defer sb.Close()
+
+	//A factory deployed before the check is turned on, and approved code whose constructor creates a contract
+	factory, _, err := sb.Deploy(keyA, factoryCode(nil), nil)
+	require.Nil(t, err)
+	require.Nil(t, sb.ApproveCode(ApprovedCode{CodeHash: CodeHash(factoryRuntime)}))
+	require.Nil(t, sb.EnforceApprovedCode(true))
+
+	_, err = sb.Transact(keyA, factory, nil, emitterCode())
+	require.NotNil(t, err)
+	_, _, err = sb.Deploy(keyA, factoryCode(emitterCode()), nil)
+	require.NotNil(t, err)
+	//A factory creating nothing is fine
+	_, _, err = sb.Deploy(keyA, factoryCode(nil), nil)
+	require.Nil(t, err)
+
+	es, err := sb.getES()
+	require.Nil(t, err)
+	_, db, err := getDB(*es)
+	require.Nil(t, err)
+	nonce := db.GetNonce(factory)
+	require.Nil(t, sb.ApproveCode(ApprovedCode{CodeHash: CodeHash(emitterCode()[11:])}))
+	_, err = sb.Transact(keyA, factory, nil, emitterCode())
+	require.Nil(t, err)
+	es, err = sb.getES()
+	require.Nil(t, err)
+	_, db, err = getDB(*es)
+	require.Nil(t, err)
+	require.Equal(t, CodeHash(emitterCode()[11:]), db.GetCodeHash(crypto.CreateAddress(factory, nonce)))
+	_, _, err = sb.Deploy(keyA, factoryCode(emitterCode()), nil)
+	require.Nil(t, err)
+}
@@ -0,0 +1,137 @@
+package byzcoin
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// receiptPrefix prefixes the keys under which the receipts are stored in the
+// memory database of the bvm, next to the state trie nodes.
+var receiptPrefix = []byte("bvm-receipt-")
+
+// txPrefix prefixes the keys under which the transactions are stored.
+var txPrefix = []byte("bvm-tx-")
+
+// Receipt is the receipt of a transaction applied to the bvm. On top of the
+// Ethereum receipt it holds the revert reason of failed transactions.
+type Receipt struct {
+	*types.Receipt
+	// RevertReason is the reason given to revert() or require() by the
+	// contract, decoded from the Error(string) form
+	RevertReason string
+	// RevertData is the raw data returned by a failed execution
+	RevertData []byte
+	// PreStateRoot is the root of the state the transaction was applied to
+	PreStateRoot common.Hash
+	// Violations are the invariants broken by the transaction that don't
+	// reject it
+	Violations []Violation
+	// InvariantGas is the gas used to check the invariants, it is part of
+	// GasUsed
+	InvariantGas uint64
+	// InstructionGas is the gas of the byzcoin instructions asked by the
+	// contracts, it is part of GasUsed
+	InstructionGas uint64
+}
+
+// RevertError returns the error corresponding to a failed transaction.
+func (r *Receipt) RevertError() *RevertError {
+	return &RevertError{Reason: r.RevertReason, Data: r.RevertData}
+}
+
+type receiptJSON struct {
+	Receipt        *types.Receipt `json:"receipt"`
+	RevertReason   string         `json:"revertReason,omitempty"`
+	RevertData     hexutil.Bytes  `json:"revertData,omitempty"`
+	PreStateRoot   common.Hash    `json:"preStateRoot"`
+	Violations     []Violation    `json:"violations,omitempty"`
+	InvariantGas   uint64         `json:"invariantGas,omitempty"`
+	InstructionGas uint64         `json:"instructionGas,omitempty"`
+}
+
+// MarshalJSON encodes the receipt, it is needed as the embedded Ethereum
+// receipt would otherwise only encode itself.
+func (r Receipt) MarshalJSON() ([]byte, error) {
+	return json.Marshal(receiptJSON{
+		Receipt:        r.Receipt,
+		RevertReason:   r.RevertReason,
+		RevertData:     r.RevertData,
+		PreStateRoot:   r.PreStateRoot,
+		Violations:     r.Violations,
+		InvariantGas:   r.InvariantGas,
+		InstructionGas: r.InstructionGas,
+	})
+}
+
+// UnmarshalJSON decodes a receipt encoded with MarshalJSON.
+func (r *Receipt) UnmarshalJSON(input []byte) error {
+	var dec receiptJSON
+	if err := json.Unmarshal(input, &dec); err != nil {
+		return err
+	}
+	if dec.Receipt == nil {
+		return errors.New("missing receipt")
+	}
+	r.Receipt = dec.Receipt
+	r.RevertReason = dec.RevertReason
+	r.RevertData = dec.RevertData
+	r.PreStateRoot = dec.PreStateRoot
+	r.Violations = dec.Violations
+	r.InvariantGas = dec.InvariantGas
+	r.InstructionGas = dec.InstructionGas
+	return nil
+}
+
+// storeReceipt saves the receipt in the memory database, indexed by its transaction hash
+func storeReceipt(memdb *MemDatabase, r *Receipt) error {
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return memdb.Put(receiptKey(r.TxHash), buf)
+}
+
+// getReceipt returns the receipt of the transaction txHash
+func getReceipt(memdb *MemDatabase, txHash common.Hash) (*Receipt, error) {
+	buf, err := memdb.Get(receiptKey(txHash))
+	if err != nil {
+		return nil, errors.New("no receipt for transaction " + txHash.Hex())
+	}
+	r := &Receipt{}
+	err = json.Unmarshal(buf, r)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// storeTransaction saves the transaction, indexed by its hash
+func storeTransaction(memdb *MemDatabase, tx *types.Transaction) error {
+	buf, err := tx.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	return memdb.Put(append(common.CopyBytes(txPrefix), tx.Hash().Bytes()...), buf)
+}
+
+// getTransaction returns the transaction txHash
+func getTransaction(memdb *MemDatabase, txHash common.Hash) (*types.Transaction, error) {
+	buf, err := memdb.Get(append(common.CopyBytes(txPrefix), txHash.Bytes()...))
+	if err != nil {
+		return nil, errors.New("no transaction " + txHash.Hex())
+	}
+	tx := &types.Transaction{}
+	err = tx.UnmarshalJSON(buf)
+	if err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+func receiptKey(txHash common.Hash) []byte {
+	return append(common.CopyBytes(receiptPrefix), txHash.Bytes()...)
+}
@@ -0,0 +1,164 @@
+package byzcoin
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// The bvm instance keeps a registry of the deployed contracts, under human
+// readable names. The register instruction names the contract deployed by
+// a transaction of the instance, with its ABI and the hash of its source:
+// the address and the deployer are read from the transaction, so that they
+// can be trusted. The first signer of the instruction owns the name, only
+// the owner can register it again or remove it.
+
+var contractRegistryKey = []byte("bvm-contract-registry")
+
+// RegisteredContract is a contract of the registry.
+type RegisteredContract struct {
+	Name string `json:"name"`
+	// Address and Deployer are set by the bvm from DeployTx
+	Address  common.Address `json:"address"`
+	Deployer common.Address `json:"deployer"`
+	DeployTx common.Hash    `json:"deployTx"`
+	// ABI is the JSON ABI of the contract
+	ABI        string      `json:"abi"`
+	SourceHash common.Hash `json:"sourceHash"`
+	// Owner is the darc identity that registered the name
+	Owner string `json:"owner"`
+}
+
+// ParseABI parses the ABI of the contract.
+func (rc *RegisteredContract) ParseABI() (abi.ABI, error) {
+	return abi.JSON(strings.NewReader(rc.ABI))
+}
+
+// registerContract adds rc to the registry, owned by the first signer of
+// inst. The address and the deployer are the ones of its deployment.
+func registerContract(memdb *MemDatabase, db *state.StateDB, inst byzcoin.Instruction, rc RegisteredContract) error {
+	if rc.Name == "" {
+		return errors.New("the contract has no name")
+	}
+	if len(inst.SignerIdentities) == 0 {
+		return errors.New("the instruction has no signer")
+	}
+	if _, err := rc.ParseABI(); err != nil {
+		return err
+	}
+	r, err := getReceipt(memdb, rc.DeployTx)
+	if err != nil {
+		return err
+	}
+	if r.Status != types.ReceiptStatusSuccessful || r.ContractAddress == (common.Address{}) {
+		return errors.New("the transaction " + rc.DeployTx.Hex() + " didn't deploy a contract")
+	}
+	if db.GetCodeSize(r.ContractAddress) == 0 {
+		return errors.New("the contract deployed by " + rc.DeployTx.Hex() + " has no code")
+	}
+	tx, err := getTransaction(memdb, rc.DeployTx)
+	if err != nil {
+		return err
+	}
+	rc.Address = r.ContractAddress
+	rc.Deployer, err = txSender(tx)
+	if err != nil {
+		return err
+	}
+	rc.Owner = inst.SignerIdentities[0].String()
+
+	contracts, err := getRegisteredContracts(memdb)
+	if err != nil {
+		return err
+	}
+	for i := range contracts {
+		if contracts[i].Name == rc.Name {
+			if !signedBy(inst, contracts[i].Owner) {
+				return errors.New("the name " + rc.Name + " is owned by " + contracts[i].Owner)
+			}
+			contracts[i] = rc
+			return putRegisteredContracts(memdb, contracts)
+		}
+	}
+	return putRegisteredContracts(memdb, append(contracts, rc))
+}
+
+// unregisterContract removes the contract name, if one of the signers of
+// inst owns it.
+func unregisterContract(memdb *MemDatabase, inst byzcoin.Instruction, name string) error {
+	contracts, err := getRegisteredContracts(memdb)
+	if err != nil {
+		return err
+	}
+	kept := []RegisteredContract{}
+	for _, rc := range contracts {
+		if rc.Name != name {
+			kept = append(kept, rc)
+			continue
+		}
+		if !signedBy(inst, rc.Owner) {
+			return errors.New("the name " + name + " is owned by " + rc.Owner)
+		}
+	}
+	if len(kept) == len(contracts) {
+		return errors.New("no contract " + name)
+	}
+	return putRegisteredContracts(memdb, kept)
+}
+
+// lookupContracts returns the contract name of the registry, or all of them
+// if name is empty.
+func lookupContracts(memdb *MemDatabase, name string) ([]RegisteredContract, error) {
+	contracts, err := getRegisteredContracts(memdb)
+	if err != nil || name == "" {
+		return contracts, err
+	}
+	for _, rc := range contracts {
+		if rc.Name == name {
+			return []RegisteredContract{rc}, nil
+		}
+	}
+	return nil, errors.New("no contract " + name)
+}
+
+func getRegisteredContracts(memdb *MemDatabase) ([]RegisteredContract, error) {
+	contracts := []RegisteredContract{}
+	ok, err := memdb.Has(contractRegistryKey)
+	if err != nil || !ok {
+		return contracts, err
+	}
+	buf, err := memdb.Get(contractRegistryKey)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(buf, &contracts)
+	if err != nil {
+		return nil, err
+	}
+	return contracts, nil
+}
+
+func putRegisteredContracts(memdb *MemDatabase, contracts []RegisteredContract) error {
+	buf, err := json.Marshal(contracts)
+	if err != nil {
+		return err
+	}
+	return memdb.Put(contractRegistryKey, buf)
+}
+
+// registerArgs returns the arguments of the register instruction.
+func registerArgs(rc RegisteredContract, remove bool) byzcoin.Arguments {
+	// A RegisteredContract always encodes
+	buf, _ := json.Marshal(rc)
+	args := byzcoin.Arguments{{Name: "contract", Value: buf}}
+	if remove {
+		args = append(args, byzcoin.Argument{Name: "remove", Value: []byte{1}})
+	}
+	return args
+}
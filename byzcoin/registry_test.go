@@ -0,0 +1,66 @@
+package byzcoin
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/dedis/cothority/darc"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/require"
+)
+
+//Names deployed contracts in the registry
+func TestContractRegistry(t *testing.T) {
+	sb, keyA := newFundedBackend(t)
+	defer sb.Close()
+
+	rawAbi, bytecode, err := getSmartContract("MinimumToken")
+	require.Nil(t, err)
+	tokenAbi, err := abi.JSON(strings.NewReader(rawAbi))
+	require.Nil(t, err)
+	constructorArgs, err := tokenAbi.Pack("", keyA.Address, big.NewInt(100))
+	require.Nil(t, err)
+	token, deployTx, err := sb.Deploy(keyA, append(common.Hex2Bytes(bytecode), constructorArgs...), nil)
+	require.Nil(t, err)
+	sourceHash := crypto.Keccak256Hash([]byte("MinimumToken.sol"))
+
+	//Only the deployments can be registered
+	transferTx, err := sb.Transact(keyA, common.HexToAddress("0x2887A24130cACFD8f71C479d9f9Da5b9C6425CE8"), nil, nil)
+	require.Nil(t, err)
+	require.NotNil(t, sb.RegisterContract("token", transferTx.Hash(), rawAbi, sourceHash))
+	require.NotNil(t, sb.RegisterContract("token", deployTx.Hash(), "not an ABI", sourceHash))
+
+	require.Nil(t, sb.RegisterContract("token", deployTx.Hash(), rawAbi, sourceHash))
+	rc, err := sb.LookupContract("token")
+	require.Nil(t, err)
+	require.Equal(t, token, rc.Address)
+	require.Equal(t, keyA.Address, rc.Deployer)
+	require.Equal(t, sourceHash, rc.SourceHash)
+	require.Equal(t, sb.Signer.Identity().String(), rc.Owner)
+	registeredAbi, err := rc.ParseABI()
+	require.Nil(t, err)
+	require.Contains(t, registeredAbi.Methods, "transferFrom")
+	_, err = sb.LookupContract("loan")
+	require.NotNil(t, err)
+
+	//Only the owner can change or remove the name
+	signer := sb.Signer
+	sb.Signer = darc.NewSignerEd25519(nil, nil)
+	require.NotNil(t, sb.RegisterContract("token", deployTx.Hash(), rawAbi, common.Hash{}))
+	require.NotNil(t, sb.UnregisterContract("token"))
+	require.Nil(t, sb.RegisterContract("token-copy", deployTx.Hash(), rawAbi, sourceHash))
+	sb.Signer = signer
+	contracts, err := sb.Contracts()
+	require.Nil(t, err)
+	require.Equal(t, 2, len(contracts))
+
+	require.Nil(t, sb.UnregisterContract("token"))
+	require.NotNil(t, sb.UnregisterContract("token"))
+	contracts, err = sb.Contracts()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(contracts))
+	require.Equal(t, "token-copy", contracts[0].Name)
+}
@@ -0,0 +1,54 @@
+package byzcoin
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// revertSelector is the selector of Error(string), the ABI form in which
+// solidity returns the reason given to revert() and require().
+var revertSelector = crypto.Keccak256([]byte("Error(string)"))[:4]
+
+// RevertError is returned when the execution of a transaction is reverted.
+type RevertError struct {
+	// Reason is the decoded revert reason, empty if the contract gave none
+	Reason string
+	// Data is the raw revert data returned by the EVM
+	Data []byte
+}
+
+func newRevertError(data []byte) *RevertError {
+	reason, err := unpackRevert(data)
+	if err != nil {
+		reason = ""
+	}
+	return &RevertError{Reason: reason, Data: common.CopyBytes(data)}
+}
+
+func (e *RevertError) Error() string {
+	if e.Reason == "" {
+		return "execution reverted"
+	}
+	return "execution reverted: " + e.Reason
+}
+
+// unpackRevert decodes revert data of the Error(string) form.
+func unpackRevert(data []byte) (string, error) {
+	if len(data) < 4 || !bytes.Equal(data[:4], revertSelector) {
+		return "", errors.New("revert data is not of the Error(string) form")
+	}
+	typ, err := abi.NewType("string")
+	if err != nil {
+		return "", err
+	}
+	var reason string
+	err = abi.Arguments{{Type: typ}}.Unpack(&reason, data[4:])
+	if err != nil {
+		return "", err
+	}
+	return reason, nil
+}
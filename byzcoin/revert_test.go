@@ -0,0 +1,54 @@
+package byzcoin
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnpackRevert(t *testing.T) {
+	// revert("error") as returned by solidity
+	data := common.Hex2Bytes("08c379a0" +
+		"0000000000000000000000000000000000000000000000000000000000000020" +
+		"0000000000000000000000000000000000000000000000000000000000000005" +
+		"6572726f72000000000000000000000000000000000000000000000000000000")
+	reason, err := unpackRevert(data)
+	require.Nil(t, err)
+	require.Equal(t, "error", reason)
+	require.Equal(t, "execution reverted: error", newRevertError(data).Error())
+
+	_, err = unpackRevert([]byte{1, 2, 3, 4})
+	require.NotNil(t, err)
+	require.Equal(t, "execution reverted", newRevertError(nil).Error())
+}
+
+//A failing require of MinimumToken ends up in the stored receipt
+func TestSendTx_Revert(t *testing.T) {
+	token, memdb, db := deployToken(t)
+
+	//Transferring to the zero address is forbidden
+	gasLimit, gasPrice := transactionGasParameters()
+	tx := token.signTx(t, types.NewTransaction(1, token.address, big.NewInt(0), gasLimit, gasPrice, token.transfer(t, common.Address{}, 1)))
+	receipt, err := sendTx(tx, db)
+	require.Nil(t, err)
+	require.Equal(t, types.ReceiptStatusFailed, receipt.Status)
+	require.Equal(t, "error", receipt.RevertReason)
+	require.Equal(t, "execution reverted: error", receipt.RevertError().Error())
+	//The nonce is used even though the transaction failed
+	require.Equal(t, uint64(2), db.GetNonce(token.addressA))
+
+	require.Nil(t, storeReceipt(memdb, receipt))
+	es, err := commitES(memdb, db)
+	require.Nil(t, err)
+	memdb, _, err = getDB(es)
+	require.Nil(t, err)
+	stored, err := getReceipt(memdb, tx.Hash())
+	require.Nil(t, err)
+	require.Equal(t, receipt.Status, stored.Status)
+	require.Equal(t, receipt.GasUsed, stored.GasUsed)
+	require.Equal(t, "error", stored.RevertReason)
+	require.Equal(t, receipt.RevertData, stored.RevertData)
+}
@@ -1,18 +1,40 @@
 package byzcoin
 
 import (
+	"encoding/json"
+	"errors"
+	"math/big"
+
 	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/skipchain"
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+	"github.com/dedis/protobuf"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
 )
 
-// This service is only used because we need to register our contracts to
+// This service is used because we need to register our contracts to
 // the ByzCoin service. So we create this stub and add contracts to it
-// from the `contracts` directory.
+// from the `contracts` directory. It also answers the read-only queries
+// on the state of the bvm instances.
+
+// ServiceName is the name under which the service is registered
+const ServiceName = "contracts"
 
 func init() {
-	_, err := onet.RegisterNewService("contracts", newService)
+	_, err := onet.RegisterNewService(ServiceName, newService)
 	log.ErrFatal(err)
+	network.RegisterMessages(&GetNonce{}, &GetNonceReply{},
+		&EstimateGas{}, &EstimateGasReply{},
+		&GetReceipt{}, &GetReceiptReply{},
+		&GetLogs{}, &GetLogsReply{},
+		&StreamReceipts{}, &StreamReceiptsReply{},
+		&TraceTransaction{}, &TraceTransactionReply{},
+		&TraceCalls{}, &TraceCallsReply{},
+		&ProfileGas{}, &ProfileGasReply{},
+		&GetContract{}, &GetContractReply{})
 }
 
 // Service is only used to being able to store our contracts
@@ -22,13 +44,257 @@ type Service struct {
 	*onet.ServiceProcessor
 }
 
+// GetNonce returns the nonce of an Ethereum address, that is the nonce the
+// next transaction sent by this address must have.
+func (s *Service) GetNonce(req *GetNonce) (*GetNonceReply, error) {
+	es, err := s.getES(req.ByzCoinID, req.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	_, db, err := getDB(*es)
+	if err != nil {
+		return nil, err
+	}
+	return &GetNonceReply{Nonce: db.GetNonce(req.Address)}, nil
+}
+
+// EstimateGas runs the transaction against the current state of the bvm
+// instance, without committing anything, and returns the lowest gas limit
+// with which it succeeds.
+func (s *Service) EstimateGas(req *EstimateGas) (*EstimateGasReply, error) {
+	es, rst, err := s.getState(req.ByzCoinID, req.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	var to *common.Address
+	if len(req.To) > 0 {
+		if len(req.To) != common.AddressLength {
+			return nil, errors.New("invalid destination address")
+		}
+		address := common.BytesToAddress(req.To)
+		to = &address
+	}
+	gas, err := estimateGas(*es, rst, req.From, to, new(big.Int).SetBytes(req.Value), req.Data, req.Gas)
+	if revert, ok := err.(*RevertError); ok {
+		return &EstimateGasReply{Reverted: true, RevertData: revert.Data}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &EstimateGasReply{Gas: gas}, nil
+}
+
+// GetReceipt returns the receipt of a transaction applied to the bvm
+// instance. The receipt of a failed transaction holds its revert reason.
+func (s *Service) GetReceipt(req *GetReceipt) (*GetReceiptReply, error) {
+	es, err := s.getES(req.ByzCoinID, req.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	memdb, _, err := getDB(*es)
+	if err != nil {
+		return nil, err
+	}
+	r, err := getReceipt(memdb, req.TxHash)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return &GetReceiptReply{Receipt: buf}, nil
+}
+
+// GetContract looks up the registry of contracts of the bvm instance.
+func (s *Service) GetContract(req *GetContract) (*GetContractReply, error) {
+	es, err := s.getES(req.ByzCoinID, req.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	memdb, _, err := getDB(*es)
+	if err != nil {
+		return nil, err
+	}
+	contracts, err := lookupContracts(memdb, req.Name)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := json.Marshal(contracts)
+	if err != nil {
+		return nil, err
+	}
+	return &GetContractReply{Contracts: buf}, nil
+}
+
+// GetLogs returns the logs of the transactions of the bvm instance matching
+// the filter of the request.
+func (s *Service) GetLogs(req *GetLogs) (*GetLogsReply, error) {
+	es, err := s.getES(req.ByzCoinID, req.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	memdb, _, err := getDB(*es)
+	if err != nil {
+		return nil, err
+	}
+	filter := LogFilter{
+		FromBlock: req.FromBlock,
+		ToBlock:   req.ToBlock,
+		Addresses: req.Addresses,
+	}
+	for _, topics := range req.Topics {
+		filter.Topics = append(filter.Topics, topics.Hashes)
+	}
+	logs, err := getLogs(memdb, filter)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := json.Marshal(logs)
+	if err != nil {
+		return nil, err
+	}
+	return &GetLogsReply{Logs: buf}, nil
+}
+
+// TraceTransaction replays a transaction of the bvm instance with a struct
+// logger and returns the opcode trace, like debug_traceTransaction. The
+// replay is not committed and doesn't change the state of the instance. It
+// reads the current instances of the ledger, not the ones the transaction
+// read.
+func (s *Service) TraceTransaction(req *TraceTransaction) (*TraceTransactionReply, error) {
+	es, rst, err := s.getState(req.ByzCoinID, req.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	memdb, _, err := getDB(*es)
+	if err != nil {
+		return nil, err
+	}
+	trace, err := traceTransaction(memdb, rst, req.TxHash, &vm.LogConfig{
+		DisableStack:   req.DisableStack,
+		DisableMemory:  req.DisableMemory,
+		DisableStorage: req.DisableStorage,
+	})
+	if err != nil {
+		return nil, err
+	}
+	buf, err := json.Marshal(trace)
+	if err != nil {
+		return nil, err
+	}
+	return &TraceTransactionReply{Trace: buf}, nil
+}
+
+// TraceCalls replays a transaction of the bvm instance and returns its call
+// tree, with the calls and contract creations made by the contracts.
+func (s *Service) TraceCalls(req *TraceCalls) (*TraceCallsReply, error) {
+	es, rst, err := s.getState(req.ByzCoinID, req.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	memdb, _, err := getDB(*es)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := traceCalls(memdb, rst, req.TxHash)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := json.Marshal(tree)
+	if err != nil {
+		return nil, err
+	}
+	return &TraceCallsReply{Trace: buf}, nil
+}
+
+// ProfileGas replays transactions of the bvm instance and returns the gas
+// they used by contract function and by opcode.
+func (s *Service) ProfileGas(req *ProfileGas) (*ProfileGasReply, error) {
+	if len(req.TxHashes) == 0 {
+		return nil, errors.New("no transaction to profile")
+	}
+	es, rst, err := s.getState(req.ByzCoinID, req.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	memdb, _, err := getDB(*es)
+	if err != nil {
+		return nil, err
+	}
+	profile, err := profileTransactions(memdb, rst, req.TxHashes)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := json.Marshal(profile)
+	if err != nil {
+		return nil, err
+	}
+	return &ProfileGasReply{Profile: buf}, nil
+}
+
+// getES returns the Ethereum state stored in the bvm instance, as of the
+// latest block of the ledger.
+func (s *Service) getES(bcID skipchain.SkipBlockID, instID byzcoin.InstanceID) (*ES, error) {
+	es, _, err := s.getState(bcID, instID)
+	return es, err
+}
+
+// getState returns the Ethereum state stored in the bvm instance and the
+// state trie of the ledger it was read from, for the executions reading
+// byzcoin instances.
+func (s *Service) getState(bcID skipchain.SkipBlockID, instID byzcoin.InstanceID) (*ES, byzcoin.ReadOnlyStateTrie, error) {
+	bcs, err := s.byzcoinService()
+	if err != nil {
+		return nil, nil, err
+	}
+	rst, err := bcs.GetReadOnlyStateTrie(bcID)
+	if err != nil {
+		return nil, nil, err
+	}
+	value, _, contractID, _, err := rst.GetValues(instID.Slice())
+	if err != nil {
+		return nil, nil, err
+	}
+	if contractID != ContractBvmID {
+		return nil, nil, errors.New("instance is not a bvm")
+	}
+	es := &ES{}
+	err = protobuf.Decode(value, es)
+	if err != nil {
+		return nil, nil, err
+	}
+	return es, rst, nil
+}
+
+func (s *Service) byzcoinService() (*byzcoin.Service, error) {
+	bcs, ok := s.Service(byzcoin.ServiceName).(*byzcoin.Service)
+	if !ok {
+		return nil, errors.New("byzcoin service not available")
+	}
+	return bcs, nil
+}
+
 func newService(c *onet.Context) (onet.Service, error) {
 	s := &Service{
 		ServiceProcessor: onet.NewServiceProcessor(c),
 	}
-	err := byzcoin.RegisterContract(c, ContractBvmID, contractBvmFromBytes)
+	err := s.RegisterHandlers(s.GetNonce, s.EstimateGas, s.GetReceipt,
+		s.GetLogs, s.TraceTransaction, s.TraceCalls, s.ProfileGas, s.GetContract)
+	if err != nil {
+		return nil, err
+	}
+	err = s.RegisterStreamingHandlers(s.StreamReceipts)
+	if err != nil {
+		return nil, err
+	}
+	err = byzcoin.RegisterContract(c, ContractBvmID, contractBvmFromBytes)
 	if err != nil {
 		log.Error()
 	}
+	err = byzcoin.RegisterContract(c, ContractBvmGasLimitsID, contractGasLimitsFromBytes)
+	if err != nil {
+		log.Error(err)
+	}
 	return s, nil
 }
@@ -2,10 +2,101 @@ package byzcoin
 
 import (
 	"testing"
+	"time"
 
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/onet"
 	"github.com/dedis/onet/log"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/require"
 )
 
 func TestMain(m *testing.M) {
+	//The tests without coin instances fund their accounts with the credit faucet
+	faucetEnabled = true
 	log.MainTest(m)
 }
+
+//credit funds address with the credit faucet of the tests
+func credit(t *testing.T, cl *Client, address common.Address) {
+	require.Nil(t, cl.invoke("credit", byzcoin.Arguments{{Name: "address", Value: []byte(address.Hex())}}))
+}
+
+//Deploys a contract through the client and checks that the nonce is updated
+func TestService_GetNonce(t *testing.T) {
+	bct := newBCTest(t)
+	bct.local.Check = onet.CheckNone
+	defer bct.Close()
+
+	instID := bct.createInstance(t, byzcoin.Arguments{})
+	cl := NewClient(bct.cl, instID, bct.signer)
+
+	private, err := crypto.HexToECDSA("a33fca62081a2665454fe844a8afbe8e2e02fb66af558e695a79d058f9042f0d")
+	require.Nil(t, err)
+	key := NewKeyFromECDSA(private)
+
+	nonce, err := cl.GetNonce(key.Address)
+	require.Nil(t, err)
+	require.Equal(t, uint64(0), nonce)
+
+	credit(t, cl, key.Address)
+	_, bytecode, err := getSmartContract("MinimumToken")
+	require.Nil(t, err)
+	contractAddress, _, err := cl.Deploy(key, common.Hex2Bytes(bytecode), nil)
+	require.Nil(t, err)
+	require.Equal(t, crypto.CreateAddress(key.Address, 0), contractAddress)
+
+	nonce, err = cl.GetNonce(key.Address)
+	require.Nil(t, err)
+	require.Equal(t, uint64(1), nonce)
+	require.Equal(t, 0, cl.Nonces.Pending(key.Address))
+}
+
+//Receives the receipt of a deployment through the stream
+func TestService_StreamReceipts(t *testing.T) {
+	bct := newBCTest(t)
+	bct.local.Check = onet.CheckNone
+	defer bct.Close()
+
+	instID := bct.createInstance(t, byzcoin.Arguments{})
+	cl := NewClient(bct.cl, instID, bct.signer)
+
+	private, err := crypto.HexToECDSA("a33fca62081a2665454fe844a8afbe8e2e02fb66af558e695a79d058f9042f0d")
+	require.Nil(t, err)
+	key := NewKeyFromECDSA(private)
+	credit(t, cl, key.Address)
+
+	//The handler runs off the test goroutine, the errors are sent to it
+	receipts := make(chan *Receipt, 10)
+	errs := make(chan error, 10)
+	go func() {
+		streamCl := NewClient(bct.cl, instID, bct.signer)
+		err := streamCl.StreamReceipts(LogFilter{}, func(r *Receipt, logs []*types.Log, err error) {
+			if err != nil {
+				errs <- err
+				return
+			}
+			receipts <- r
+		})
+		log.Lvl2("stream closed:", err)
+	}()
+	// Leave some time to the stream to be set up
+	time.Sleep(bct.gMsg.BlockInterval)
+
+	_, bytecode, err := getSmartContract("MinimumToken")
+	require.Nil(t, err)
+	contractAddress, tx, err := cl.Deploy(key, common.Hex2Bytes(bytecode), nil)
+	require.Nil(t, err)
+
+	select {
+	case r := <-receipts:
+		require.Equal(t, tx.Hash(), r.TxHash)
+		require.Equal(t, contractAddress, r.ContractAddress)
+	case err := <-errs:
+		require.Nil(t, err)
+	case <-time.After(10 * bct.gMsg.BlockInterval):
+		t.Fatal("no receipt received")
+	}
+}
@@ -0,0 +1,673 @@
+package byzcoin
+
+import (
+	"crypto/sha256"
+	"errors"
+	"math/big"
+	"sync"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/byzcoin/contracts"
+	"github.com/dedis/cothority/byzcoin/trie"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/darc/expression"
+	"github.com/dedis/protobuf"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// SimulatedBackend runs the bvm contract in the process, on a state trie
+// kept in memory, so that contracts can be tested without starting conodes.
+// Every instruction is applied at once in a new block of its own. The darcs
+// are not checked by the simulated ledger: all instructions are allowed,
+// only the rules checked by the bvm itself apply.
+type SimulatedBackend struct {
+	sync.Mutex
+	InstanceID byzcoin.InstanceID
+	// Signer is given as the signer of the instructions, to the contracts
+	// that check darcs themselves, like the withdrawals
+	Signer darc.Signer
+	Nonces *NonceManager
+	// GasLimit and GasPrice are used for all transactions sent
+	GasLimit uint64
+	GasPrice *big.Int
+
+	trie        *memStateTrie
+	darcID      darc.ID
+	counter     uint64
+	subscribers map[*subscription]bool
+	closed      bool
+}
+
+// simulatedBlock is sent to the receipt streams when a block is added.
+type simulatedBlock struct {
+	memdb *MemDatabase
+	index uint64
+}
+
+// subscription queues the blocks of a receipt stream. Blocks are queued
+// under the lock of the backend without waiting for the stream, so that a
+// handler sending instructions can't block the backend.
+type subscription struct {
+	blocks []*simulatedBlock
+	// notify wakes the stream up when blocks are queued or the backend is
+	// closed
+	notify chan struct{}
+}
+
+// wake wakes the stream up, if it is not already about to wake up.
+func (s *subscription) wake() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// NewSimulatedBackend spawns a bvm instance on an empty simulated ledger.
+// The darc of the instance is owned by Signer.
+func NewSimulatedBackend() (*SimulatedBackend, error) {
+	signer := darc.NewSignerEd25519(nil, nil)
+	owner := []darc.Identity{signer.Identity()}
+	d := darc.NewDarc(darc.InitRules(owner, owner), []byte("simulated bvm"))
+	darcBuf, err := d.ToProto()
+	if err != nil {
+		return nil, err
+	}
+	darcID := d.GetBaseID()
+	sb := &SimulatedBackend{
+		GasLimit:    uint64(1e7),
+		GasPrice:    big.NewInt(1),
+		Signer:      signer,
+		trie:        newMemStateTrie(),
+		darcID:      darcID,
+		subscribers: map[*subscription]bool{},
+	}
+	//The darc of the bvm instance is the genesis darc, the darc of the config instance
+	sb.trie.apply([]byzcoin.StateChange{
+		byzcoin.NewStateChange(byzcoin.Create, byzcoin.NewInstanceID(darcID), byzcoin.ContractDarcID, darcBuf, darcID),
+		byzcoin.NewStateChange(byzcoin.Create, byzcoin.ConfigInstanceID, byzcoin.ContractConfigID, nil, darcID),
+	})
+	sb.Nonces = NewNonceManager(sb)
+
+	inst := byzcoin.Instruction{
+		InstanceID:    byzcoin.NewInstanceID(darcID),
+		SignerCounter: []uint64{sb.nextCounter()},
+		Spawn:         &byzcoin.Spawn{ContractID: ContractBvmID},
+	}
+	c := &contractBvm{}
+	sc, _, err := c.Spawn(sb.trie, inst, nil)
+	if err != nil {
+		return nil, err
+	}
+	sb.trie.apply(sc)
+	sb.InstanceID = inst.DeriveID("")
+	return sb, nil
+}
+
+// GetNonce returns the nonce of address.
+func (sb *SimulatedBackend) GetNonce(address common.Address) (uint64, error) {
+	sb.Lock()
+	defer sb.Unlock()
+	es, err := sb.getES()
+	if err != nil {
+		return 0, err
+	}
+	_, db, err := getDB(*es)
+	if err != nil {
+		return 0, err
+	}
+	return db.GetNonce(address), nil
+}
+
+// GetBalance returns the balance of address, in wei.
+func (sb *SimulatedBackend) GetBalance(address common.Address) (*big.Int, error) {
+	sb.Lock()
+	defer sb.Unlock()
+	es, err := sb.getES()
+	if err != nil {
+		return nil, err
+	}
+	_, db, err := getDB(*es)
+	if err != nil {
+		return nil, err
+	}
+	return db.GetBalance(address), nil
+}
+
+// EstimateGas returns the lowest gas limit with which the transaction from
+// the address from succeeds.
+func (sb *SimulatedBackend) EstimateGas(from common.Address, to *common.Address, value *big.Int, data []byte) (uint64, error) {
+	sb.Lock()
+	defer sb.Unlock()
+	es, err := sb.getES()
+	if err != nil {
+		return 0, err
+	}
+	return estimateGas(*es, sb.trie, from, to, value, data, 0)
+}
+
+// GetReceipt returns the receipt of the transaction txHash.
+func (sb *SimulatedBackend) GetReceipt(txHash common.Hash) (*Receipt, error) {
+	memdb, err := sb.getMemDB()
+	if err != nil {
+		return nil, err
+	}
+	return getReceipt(memdb, txHash)
+}
+
+// GetLogs returns the logs matching filter.
+func (sb *SimulatedBackend) GetLogs(filter LogFilter) ([]*types.Log, error) {
+	memdb, err := sb.getMemDB()
+	if err != nil {
+		return nil, err
+	}
+	return getLogs(memdb, filter)
+}
+
+// StreamReceipts calls handler with the receipts of the new transactions
+// matching filter, like Client.StreamReceipts. It returns when the backend
+// is closed.
+func (sb *SimulatedBackend) StreamReceipts(filter LogFilter, handler func(*Receipt, []*types.Log, error)) error {
+	sb.Lock()
+	if sb.closed {
+		sb.Unlock()
+		return errors.New("backend closed")
+	}
+	s := &subscription{notify: make(chan struct{}, 1)}
+	sb.subscribers[s] = true
+	sb.Unlock()
+
+	for range s.notify {
+		sb.Lock()
+		blocks, closed := s.blocks, sb.closed
+		s.blocks = nil
+		sb.Unlock()
+
+		for _, block := range blocks {
+			receipts, logs, err := matchingReceipts(block.memdb, block.index, filter)
+			if err != nil {
+				handler(nil, nil, err)
+				continue
+			}
+			for i, r := range receipts {
+				handler(r, logs[i], nil)
+			}
+		}
+		if closed {
+			break
+		}
+	}
+	return errors.New("backend closed")
+}
+
+// TraceTransaction returns the opcode trace of the transaction txHash.
+func (sb *SimulatedBackend) TraceTransaction(txHash common.Hash, cfg vm.LogConfig) (*TraceResult, error) {
+	var trace *TraceResult
+	err := sb.replay(func(memdb *MemDatabase) error {
+		var err error
+		trace, err = traceTransaction(memdb, sb.trie, txHash, &cfg)
+		return err
+	})
+	return trace, err
+}
+
+// TraceCalls returns the call tree of the transaction txHash.
+func (sb *SimulatedBackend) TraceCalls(txHash common.Hash) (*CallFrame, error) {
+	var tree *CallFrame
+	err := sb.replay(func(memdb *MemDatabase) error {
+		var err error
+		tree, err = traceCalls(memdb, sb.trie, txHash)
+		return err
+	})
+	return tree, err
+}
+
+// ProfileGas returns the gas profile of the transactions txHashes.
+func (sb *SimulatedBackend) ProfileGas(txHashes []common.Hash, abis ...abi.ABI) (*GasProfile, error) {
+	var profile *GasProfile
+	err := sb.replay(func(memdb *MemDatabase) error {
+		var err error
+		profile, err = profileTransactions(memdb, sb.trie, txHashes)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, contractAbi := range abis {
+		profile.Name(contractAbi)
+	}
+	return profile, nil
+}
+
+// Deposit credits address with the value of amount coins. There is no coin
+// instance on the simulated ledger, the coins are attached to the deposit
+// instruction as if they had been fetched.
+func (sb *SimulatedBackend) Deposit(amount uint64, address common.Address) error {
+	coins := []byzcoin.Coin{{Name: contracts.CoinName, Value: amount}}
+	_, err := sb.InvokeWithCoins("deposit", depositArgs(address, amount), coins)
+	return err
+}
+
+// NewCoin creates an empty coin instance guarded by a new darc with rules.
+// Withdrawals to the coin need a WithdrawRule allowing Signer.
+func (sb *SimulatedBackend) NewCoin(rules darc.Rules) (byzcoin.InstanceID, error) {
+	sb.Lock()
+	defer sb.Unlock()
+	d := darc.NewDarc(rules, []byte("simulated coin"))
+	darcBuf, err := d.ToProto()
+	if err != nil {
+		return byzcoin.InstanceID{}, err
+	}
+	coinBuf, err := protobuf.Encode(&byzcoin.Coin{Name: contracts.CoinName})
+	if err != nil {
+		return byzcoin.InstanceID{}, err
+	}
+	coinHash := sha256.Sum256(append(d.GetBaseID(), []byte("coin")...))
+	coinID := byzcoin.NewInstanceID(coinHash[:])
+	sb.trie.apply([]byzcoin.StateChange{
+		byzcoin.NewStateChange(byzcoin.Create, byzcoin.NewInstanceID(d.GetBaseID()), byzcoin.ContractDarcID, darcBuf, d.GetBaseID()),
+		byzcoin.NewStateChange(byzcoin.Create, coinID, contracts.ContractCoinID, coinBuf, d.GetBaseID()),
+	})
+	return coinID, nil
+}
+
+// SetGasLimits changes the gas limits on the ledger to l, spawning them
+// under the genesis darc the first time.
+func (sb *SimulatedBackend) SetGasLimits(l GasLimits) error {
+	sb.Lock()
+	defer sb.Unlock()
+	inst := byzcoin.Instruction{InstanceID: byzcoin.NewInstanceID(sb.darcID)}
+	c := &contractGasLimits{}
+	var sc []byzcoin.StateChange
+	_, _, _, _, err := sb.trie.GetValues(GasLimitsID.Slice())
+	if err == nil {
+		inst.InstanceID = GasLimitsID
+		inst.Invoke = &byzcoin.Invoke{Command: "setLimits", Args: gasLimitsArgs(l)}
+		sc, _, err = c.Invoke(sb.trie, inst, nil)
+	} else {
+		inst.Spawn = &byzcoin.Spawn{ContractID: ContractBvmGasLimitsID, Args: gasLimitsArgs(l)}
+		sc, _, err = c.Spawn(sb.trie, inst, nil)
+	}
+	if err != nil {
+		return err
+	}
+	sb.trie.apply(sc)
+	return nil
+}
+
+// ApproveCode adds the provenance of verified code to the registry.
+func (sb *SimulatedBackend) ApproveCode(code ApprovedCode) error {
+	return sb.Invoke("approveCode", approveCodeArgs(code, false))
+}
+
+// RevokeCode removes the code codeHash from the registry.
+func (sb *SimulatedBackend) RevokeCode(codeHash common.Hash) error {
+	return sb.Invoke("approveCode", approveCodeArgs(ApprovedCode{CodeHash: codeHash}, true))
+}
+
+// EnforceApprovedCode turns on or off the check that the deployed contracts
+// have approved code.
+func (sb *SimulatedBackend) EnforceApprovedCode(enforce bool) error {
+	return sb.Invoke("enforceApprovedCode", enforceArgs(enforce))
+}
+
+// GetApprovedCode returns the provenance of the code codeHash, nil if it is
+// not approved.
+func (sb *SimulatedBackend) GetApprovedCode(codeHash common.Hash) (*ApprovedCode, error) {
+	memdb, err := sb.getMemDB()
+	if err != nil {
+		return nil, err
+	}
+	return getApprovedCode(memdb, codeHash)
+}
+
+// RegisterContract names the contract deployed by the transaction deployTx
+// in the registry, owned by Signer.
+func (sb *SimulatedBackend) RegisterContract(name string, deployTx common.Hash, abi string, sourceHash common.Hash) error {
+	return sb.Invoke("register", registerArgs(RegisteredContract{Name: name, DeployTx: deployTx, ABI: abi, SourceHash: sourceHash}, false))
+}
+
+// UnregisterContract removes the contract name from the registry.
+func (sb *SimulatedBackend) UnregisterContract(name string) error {
+	return sb.Invoke("register", registerArgs(RegisteredContract{Name: name}, true))
+}
+
+// LookupContract returns the contract name of the registry.
+func (sb *SimulatedBackend) LookupContract(name string) (*RegisteredContract, error) {
+	if name == "" {
+		return nil, errors.New("no contract name")
+	}
+	memdb, err := sb.getMemDB()
+	if err != nil {
+		return nil, err
+	}
+	contracts, err := lookupContracts(memdb, name)
+	if err != nil {
+		return nil, err
+	}
+	return &contracts[0], nil
+}
+
+// Contracts returns all the contracts of the registry.
+func (sb *SimulatedBackend) Contracts() ([]RegisteredContract, error) {
+	memdb, err := sb.getMemDB()
+	if err != nil {
+		return nil, err
+	}
+	return lookupContracts(memdb, "")
+}
+
+// SetRule sets the rule action of the darc of the bvm instance to expr, for
+// the rules checked by the bvm itself, like DeployRule.
+func (sb *SimulatedBackend) SetRule(action darc.Action, expr expression.Expr) error {
+	sb.Lock()
+	defer sb.Unlock()
+	d, err := byzcoin.LoadDarcFromTrie(sb.trie, sb.darcID)
+	if err != nil {
+		return err
+	}
+	evolved := d.Copy()
+	if evolved.Rules.Contains(action) {
+		err = evolved.Rules.UpdateRule(action, expr)
+	} else {
+		err = evolved.Rules.AddRule(action, expr)
+	}
+	if err != nil {
+		return err
+	}
+	err = evolved.EvolveFrom(d)
+	if err != nil {
+		return err
+	}
+	darcBuf, err := evolved.ToProto()
+	if err != nil {
+		return err
+	}
+	sb.trie.apply([]byzcoin.StateChange{
+		byzcoin.NewStateChange(byzcoin.Update, byzcoin.NewInstanceID(sb.darcID), byzcoin.ContractDarcID, darcBuf, sb.darcID),
+	})
+	return nil
+}
+
+// Coins returns the value of the coin instance coinID.
+func (sb *SimulatedBackend) Coins(coinID byzcoin.InstanceID) (uint64, error) {
+	sb.Lock()
+	defer sb.Unlock()
+	value, _, _, _, err := sb.trie.GetValues(coinID.Slice())
+	if err != nil {
+		return 0, err
+	}
+	var coin byzcoin.Coin
+	err = protobuf.Decode(value, &coin)
+	if err != nil {
+		return 0, err
+	}
+	return coin.Value, nil
+}
+
+// AddInvariant attaches inv to its contract.
+func (sb *SimulatedBackend) AddInvariant(inv Invariant) error {
+	return sb.Invoke("invariant", invariantArgs(inv, false))
+}
+
+// RemoveInvariant removes the invariant name of the contract at address.
+func (sb *SimulatedBackend) RemoveInvariant(address common.Address, name string) error {
+	return sb.Invoke("invariant", invariantArgs(Invariant{Address: address, Name: name}, true))
+}
+
+// Bind binds the address of key to the signer of the backend.
+func (sb *SimulatedBackend) Bind(key *Key) error {
+	args, err := bindArgs(sb.InstanceID, sb.Signer.Identity().String(), key)
+	if err != nil {
+		return err
+	}
+	return sb.Invoke("bind", args)
+}
+
+// Unbind removes the binding of address, which must be bound to the signer
+// of the backend.
+func (sb *SimulatedBackend) Unbind(address common.Address) error {
+	return sb.Invoke("bind", unbindArgs(address))
+}
+
+// EnforceBindings turns on or off the check that the senders of the
+// transactions are bound to the signer of the backend.
+func (sb *SimulatedBackend) EnforceBindings(enforce bool) error {
+	return sb.Invoke("enforceBindings", enforceArgs(enforce))
+}
+
+// BoundIdentity returns the darc identity address is bound to, or the
+// empty string.
+func (sb *SimulatedBackend) BoundIdentity(address common.Address) (string, error) {
+	memdb, err := sb.getMemDB()
+	if err != nil {
+		return "", err
+	}
+	return boundIdentity(memdb, address)
+}
+
+// Deploy deploys the contract bytecode with key, and returns the address of
+// the new contract. If the deployment is included but reverted, the
+// transaction and the address it was computed for are returned with a
+// *RevertError.
+func (sb *SimulatedBackend) Deploy(key *Key, bytecode []byte, value *big.Int) (common.Address, *types.Transaction, error) {
+	tx, err := sendTransaction(sb, sb.txParams(), key, nil, value, bytecode)
+	if tx == nil {
+		return common.Address{}, nil, err
+	}
+	if err != nil {
+		return crypto.CreateAddress(key.Address, tx.Nonce()), tx, err
+	}
+	r, err := sb.GetReceipt(tx.Hash())
+	if err != nil {
+		return common.Address{}, tx, err
+	}
+	return r.ContractAddress, tx, nil
+}
+
+// Transact sends a transaction from key to the address to, carrying data.
+func (sb *SimulatedBackend) Transact(key *Key, to common.Address, value *big.Int, data []byte) (*types.Transaction, error) {
+	return sendTransaction(sb, sb.txParams(), key, &to, value, data)
+}
+
+// SendTx applies an already signed transaction in a new block.
+func (sb *SimulatedBackend) SendTx(signedTx *types.Transaction) error {
+	txBuf, err := signedTx.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	return sb.Invoke("transaction", byzcoin.Arguments{{Name: "tx", Value: txBuf}})
+}
+
+// Invoke applies the instruction invoking command on the bvm instance in a
+// new block, the same way byzcoin does.
+func (sb *SimulatedBackend) Invoke(command string, args byzcoin.Arguments) error {
+	_, err := sb.InvokeWithCoins(command, args, nil)
+	return err
+}
+
+// InvokeWithCoins is like Invoke, with coins attached to the instruction. It
+// returns the coins left by the instruction.
+func (sb *SimulatedBackend) InvokeWithCoins(command string, args byzcoin.Arguments, coins []byzcoin.Coin) ([]byzcoin.Coin, error) {
+	sb.Lock()
+	defer sb.Unlock()
+	if sb.closed {
+		return nil, errors.New("backend closed")
+	}
+	value, _, _, _, err := sb.trie.GetValues(sb.InstanceID.Slice())
+	if err != nil {
+		return nil, err
+	}
+	c, err := contractBvmFromBytes(value)
+	if err != nil {
+		return nil, err
+	}
+	inst := byzcoin.Instruction{
+		InstanceID:       sb.InstanceID,
+		SignerIdentities: []darc.Identity{sb.Signer.Identity()},
+		SignerCounter:    []uint64{sb.nextCounter()},
+		Invoke: &byzcoin.Invoke{
+			Command: command,
+			Args:    args,
+		},
+	}
+	sc, cout, err := c.Invoke(sb.trie, inst, coins)
+	if err != nil {
+		return nil, err
+	}
+	sb.trie.apply(sc)
+	sb.trie.index++
+
+	memdb, err := sb.memDB()
+	if err != nil {
+		return nil, err
+	}
+	block := &simulatedBlock{memdb: memdb, index: uint64(sb.trie.index)}
+	for s := range sb.subscribers {
+		s.blocks = append(s.blocks, block)
+		s.wake()
+	}
+	return cout, nil
+}
+
+// BlockIndex returns the index of the last block of the simulated ledger.
+func (sb *SimulatedBackend) BlockIndex() int {
+	sb.Lock()
+	defer sb.Unlock()
+	return sb.trie.index
+}
+
+// Close stops the receipt streams. No instruction can be sent afterwards.
+func (sb *SimulatedBackend) Close() {
+	sb.Lock()
+	defer sb.Unlock()
+	if sb.closed {
+		return
+	}
+	sb.closed = true
+	for s := range sb.subscribers {
+		s.wake()
+	}
+	sb.subscribers = nil
+}
+
+func (sb *SimulatedBackend) txParams() txParams {
+	return txParams{nonces: sb.Nonces, gasLimit: sb.GasLimit, gasPrice: sb.GasPrice}
+}
+
+func (sb *SimulatedBackend) nextCounter() uint64 {
+	sb.counter++
+	return sb.counter
+}
+
+// replay runs f, which replays transactions of the memory database, under
+// the lock of the backend.
+func (sb *SimulatedBackend) replay(f func(memdb *MemDatabase) error) error {
+	sb.Lock()
+	defer sb.Unlock()
+	memdb, err := sb.memDB()
+	if err != nil {
+		return err
+	}
+	return f(memdb)
+}
+
+// getMemDB returns the memory database of the bvm instance.
+func (sb *SimulatedBackend) getMemDB() (*MemDatabase, error) {
+	sb.Lock()
+	defer sb.Unlock()
+	return sb.memDB()
+}
+
+func (sb *SimulatedBackend) memDB() (*MemDatabase, error) {
+	es, err := sb.getES()
+	if err != nil {
+		return nil, err
+	}
+	memdb, _, err := getDB(*es)
+	return memdb, err
+}
+
+func (sb *SimulatedBackend) getES() (*ES, error) {
+	value, _, _, _, err := sb.trie.GetValues(sb.InstanceID.Slice())
+	if err != nil {
+		return nil, err
+	}
+	es := &ES{}
+	err = protobuf.Decode(value, es)
+	if err != nil {
+		return nil, err
+	}
+	return es, nil
+}
+
+// memStateTrie is a read-only state trie holding the instances in a map.
+// The instruction index of the last block is kept in index, as the
+// GetIndex of the byzcoin state trie.
+type memStateTrie struct {
+	values map[string]memInstance
+	index  int
+}
+
+type memInstance struct {
+	value      []byte
+	version    uint64
+	contractID string
+	darcID     darc.ID
+}
+
+func newMemStateTrie() *memStateTrie {
+	return &memStateTrie{values: map[string]memInstance{}}
+}
+
+func (t *memStateTrie) GetValues(key []byte) ([]byte, uint64, string, darc.ID, error) {
+	inst, ok := t.values[string(key)]
+	if !ok {
+		return nil, 0, "", nil, errKeyNotSet
+	}
+	return inst.value, inst.version, inst.contractID, inst.darcID, nil
+}
+
+func (t *memStateTrie) GetProof(key []byte) (*trie.Proof, error) {
+	return nil, errors.New("the simulated state trie has no proofs")
+}
+
+func (t *memStateTrie) GetIndex() int {
+	return t.index
+}
+
+func (t *memStateTrie) GetNonce() ([]byte, error) {
+	return make([]byte, 32), nil
+}
+
+func (t *memStateTrie) ForEach(f func(k, v []byte) error) error {
+	for k, inst := range t.values {
+		if err := f([]byte(k), inst.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply applies the state changes returned by a contract.
+func (t *memStateTrie) apply(scs []byzcoin.StateChange) {
+	for _, sc := range scs {
+		key := string(sc.InstanceID)
+		switch sc.StateAction {
+		case byzcoin.Create:
+			t.values[key] = memInstance{value: sc.Value, contractID: string(sc.ContractID), darcID: sc.DarcID}
+		case byzcoin.Update:
+			inst := t.values[key]
+			inst.value = sc.Value
+			inst.version++
+			inst.contractID = string(sc.ContractID)
+			inst.darcID = sc.DarcID
+			t.values[key] = inst
+		case byzcoin.Remove:
+			delete(t.values, key)
+		}
+	}
+}
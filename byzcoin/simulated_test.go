@@ -0,0 +1,145 @@
+package byzcoin
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/require"
+)
+
+//Deploys a MinimumToken and transfers tokens on the simulated backend
+func TestSimulatedBackend(t *testing.T) {
+	sb, keyA := newFundedBackend(t)
+	defer sb.Close()
+	addressB := common.HexToAddress("0x2887A24130cACFD8f71C479d9f9Da5b9C6425CE8")
+	balance, err := sb.GetBalance(keyA.Address)
+	require.Nil(t, err)
+	require.Equal(t, big.NewInt(1e18*5), balance)
+
+	//The handler runs off the test goroutine, the errors are sent to it
+	received := make(chan *Receipt, 10)
+	errs := make(chan error, 10)
+	go sb.StreamReceipts(LogFilter{}, func(r *Receipt, logs []*types.Log, err error) {
+		if err != nil {
+			errs <- err
+			return
+		}
+		received <- r
+	})
+	next := func() *Receipt {
+		select {
+		case r := <-received:
+			return r
+		case err := <-errs:
+			require.Nil(t, err)
+		}
+		return nil
+	}
+	//Waits for the stream to be registered
+	for {
+		sb.Lock()
+		n := len(sb.subscribers)
+		sb.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	rawAbi, bytecode, err := getSmartContract("MinimumToken")
+	require.Nil(t, err)
+	tokenAbi, err := abi.JSON(strings.NewReader(rawAbi))
+	require.Nil(t, err)
+	constructorArgs, err := tokenAbi.Pack("", keyA.Address, big.NewInt(100))
+	require.Nil(t, err)
+	contractAddress, deployTx, err := sb.Deploy(keyA, append(common.Hex2Bytes(bytecode), constructorArgs...), nil)
+	require.Nil(t, err)
+	require.Equal(t, crypto.CreateAddress(keyA.Address, 0), contractAddress)
+
+	transfer, err := tokenAbi.Pack("transferFrom", keyA.Address, addressB, big.NewInt(10))
+	require.Nil(t, err)
+	_, err = sb.Transact(keyA, contractAddress, nil, transfer)
+	require.Nil(t, err)
+
+	//The transfer reverts but is included and uses its nonce
+	transfer, err = tokenAbi.Pack("transferFrom", keyA.Address, addressB, big.NewInt(1000))
+	require.Nil(t, err)
+	tx, err := sb.Transact(keyA, contractAddress, nil, transfer)
+	require.NotNil(t, tx)
+	revertErr, ok := err.(*RevertError)
+	require.True(t, ok)
+	require.Equal(t, "error", revertErr.Reason)
+	nonce, err := sb.GetNonce(keyA.Address)
+	require.Nil(t, err)
+	require.Equal(t, uint64(3), nonce)
+
+	//One block for the deposit and one per transaction
+	require.Equal(t, 4, sb.BlockIndex())
+	require.Equal(t, deployTx.Hash(), next().TxHash)
+	require.Equal(t, types.ReceiptStatusSuccessful, next().Status)
+	require.Equal(t, types.ReceiptStatusFailed, next().Status)
+
+	trace, err := sb.TraceCalls(tx.Hash())
+	require.Nil(t, err)
+	require.Equal(t, contractAddress, trace.To)
+	require.NotEmpty(t, trace.Error)
+}
+
+//A reverted deployment returns its transaction and address with the revert
+func TestSimulatedBackend_DeployRevert(t *testing.T) {
+	sb, keyA := newFundedBackend(t)
+	defer sb.Close()
+
+	//PUSH1 0 PUSH1 0 REVERT
+	address, tx, err := sb.Deploy(keyA, common.Hex2Bytes("60006000fd"), nil)
+	_, ok := err.(*RevertError)
+	require.True(t, ok)
+	require.NotNil(t, tx)
+	require.Equal(t, crypto.CreateAddress(keyA.Address, 0), address)
+	receipt, err := sb.GetReceipt(tx.Hash())
+	require.Nil(t, err)
+	require.Equal(t, types.ReceiptStatusFailed, receipt.Status)
+}
+
+//A stream whose handler doesn't return doesn't block the instructions
+func TestSimulatedBackend_SlowStream(t *testing.T) {
+	sb, err := NewSimulatedBackend()
+	require.Nil(t, err)
+
+	release := make(chan struct{})
+	handled := make(chan struct{}, 1000)
+	go sb.StreamReceipts(LogFilter{}, func(r *Receipt, logs []*types.Log, err error) {
+		<-release
+		handled <- struct{}{}
+	})
+	for {
+		sb.Lock()
+		n := len(sb.subscribers)
+		sb.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	privateA, err := crypto.HexToECDSA("a33fca62081a2665454fe844a8afbe8e2e02fb66af558e695a79d058f9042f0d")
+	require.Nil(t, err)
+	keyA := NewKeyFromECDSA(privateA)
+	require.Nil(t, sb.Deposit(5, keyA.Address))
+	//More blocks than a buffered channel would have held
+	for i := 0; i < 150; i++ {
+		_, err = sb.Transact(keyA, common.Address{}, nil, nil)
+		require.Nil(t, err)
+	}
+	close(release)
+	for i := 0; i < 150; i++ {
+		<-handled
+	}
+	sb.Close()
+}
@@ -0,0 +1,130 @@
+package byzcoin
+
+import (
+	"encoding/json"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/onet/log"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// StreamReceipts follows the blocks of the ledger through the block
+// streaming of byzcoin and sends, for every new block, the receipts of the
+// bvm transactions it includes.
+func (s *Service) StreamReceipts(req *StreamReceipts) (chan *StreamReceiptsReply, chan bool, error) {
+	bcs, err := s.byzcoinService()
+	if err != nil {
+		return nil, nil, err
+	}
+	// Make sure the instance is a bvm before following the chain
+	_, err = s.getES(req.ByzCoinID, req.InstanceID)
+	if err != nil {
+		return nil, nil, err
+	}
+	blocks, stopBlocks, err := bcs.StreamTransactions(&byzcoin.StreamingRequest{ID: req.ByzCoinID})
+	if err != nil {
+		return nil, nil, err
+	}
+	filter := LogFilter{Addresses: req.Addresses}
+	for _, topics := range req.Topics {
+		filter.Topics = append(filter.Topics, topics.Hashes)
+	}
+
+	out := make(chan *StreamReceiptsReply)
+	stop := make(chan bool)
+	go func() {
+		defer close(out)
+		defer close(stopBlocks)
+		for {
+			select {
+			case <-stop:
+				return
+			case resp, ok := <-blocks:
+				if !ok {
+					return
+				}
+				replies, err := s.blockReceipts(req, uint64(resp.Block.Index), filter)
+				if err != nil {
+					log.Error("couldn't get the receipts of block", resp.Block.Index, err)
+					continue
+				}
+				for _, reply := range replies {
+					select {
+					case out <- reply:
+					case <-stop:
+						return
+					}
+				}
+			}
+		}
+	}()
+	return out, stop, nil
+}
+
+// blockReceipts returns the replies for the receipts of the bvm transactions
+// of block blockIndex that match the filter.
+func (s *Service) blockReceipts(req *StreamReceipts, blockIndex uint64, filter LogFilter) ([]*StreamReceiptsReply, error) {
+	es, err := s.getES(req.ByzCoinID, req.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	memdb, _, err := getDB(*es)
+	if err != nil {
+		return nil, err
+	}
+	receipts, logs, err := matchingReceipts(memdb, blockIndex, filter)
+	if err != nil {
+		return nil, err
+	}
+	var replies []*StreamReceiptsReply
+	for i, r := range receipts {
+		receiptBuf, err := json.Marshal(r)
+		if err != nil {
+			return nil, err
+		}
+		logsBuf, err := json.Marshal(logs[i])
+		if err != nil {
+			return nil, err
+		}
+		replies = append(replies, &StreamReceiptsReply{
+			BlockIndex: blockIndex,
+			Receipt:    receiptBuf,
+			Logs:       logsBuf,
+		})
+	}
+	return replies, nil
+}
+
+// matchingReceipts returns the receipts of the bvm transactions of block
+// blockIndex that have a log matching the filter, with their matching logs.
+// With an empty filter all receipts are returned.
+func matchingReceipts(memdb *MemDatabase, blockIndex uint64, filter LogFilter) ([]*Receipt, [][]*types.Log, error) {
+	block, err := getBlockLogs(memdb, blockIndex)
+	if err != nil || block == nil {
+		return nil, nil, err
+	}
+	all := len(filter.Addresses) == 0 && len(filter.Topics) == 0
+	if !all && !bloomMatches(block.Bloom, filter) {
+		return nil, nil, nil
+	}
+	var receipts []*Receipt
+	var matching [][]*types.Log
+	for _, txHash := range block.TxHashes {
+		r, err := getReceipt(memdb, txHash)
+		if err != nil {
+			return nil, nil, err
+		}
+		logs := []*types.Log{}
+		for _, l := range r.Logs {
+			if logMatches(l, filter) {
+				logs = append(logs, l)
+			}
+		}
+		if !all && len(logs) == 0 {
+			continue
+		}
+		receipts = append(receipts, r)
+		matching = append(matching, logs)
+	}
+	return receipts, matching, nil
+}
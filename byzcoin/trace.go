@@ -0,0 +1,215 @@
+package byzcoin
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+// Transactions are traced by replaying them on the state they were applied
+// to. As the trie nodes are never removed from the memory database, the state
+// before any transaction can be opened from its root, kept in the receipt.
+// The replay is done on a state that is never committed, so tracing has no
+// effect on the ledger.
+//
+// Only the Ethereum state is the one of the transaction: the system
+// contracts reading the ledger and the checks of the instruction read the
+// current state trie. If the instances the transaction read changed since,
+// the trace of an older transaction can differ from what actually ran.
+
+// TraceResult is the opcode trace of a transaction, in the same form as the
+// result of debug_traceTransaction. The system contracts read the current
+// ledger, not the one the transaction was applied to.
+type TraceResult struct {
+	Gas         uint64         `json:"gas"`
+	Failed      bool           `json:"failed"`
+	ReturnValue string         `json:"returnValue"`
+	StructLogs  []StructLogRes `json:"structLogs"`
+	// StorageDiff holds the storage slots changed by the transaction
+	StorageDiff map[common.Address]map[common.Hash]StorageDiff `json:"storageDiff"`
+}
+
+// StructLogRes is one step of the trace.
+type StructLogRes struct {
+	Pc      uint64             `json:"pc"`
+	Op      string             `json:"op"`
+	Gas     uint64             `json:"gas"`
+	GasCost uint64             `json:"gasCost"`
+	Depth   int                `json:"depth"`
+	Error   string             `json:"error,omitempty"`
+	Stack   *[]string          `json:"stack,omitempty"`
+	Memory  *[]string          `json:"memory,omitempty"`
+	Storage *map[string]string `json:"storage,omitempty"`
+}
+
+// StorageDiff is the value of a storage slot before and after the
+// transaction.
+type StorageDiff struct {
+	Before common.Hash `json:"before"`
+	After  common.Hash `json:"after"`
+}
+
+// traceTransaction replays the transaction txHash on its pre-state and
+// returns its trace.
+func traceTransaction(memdb *MemDatabase, rst byzcoin.ReadOnlyStateTrie, txHash common.Hash, cfg *vm.LogConfig) (*TraceResult, error) {
+	logger := newStorageTracer(vm.NewStructLogger(cfg))
+	receipt, replayed, ret, db, err := replayTransaction(memdb, rst, txHash, logger)
+	if err != nil {
+		return nil, err
+	}
+	pre, err := state.New(receipt.PreStateRoot, state.NewDatabase(memdb))
+	if err != nil {
+		return nil, err
+	}
+	return &TraceResult{
+		Gas:         replayed.GasUsed,
+		Failed:      replayed.Status == 0,
+		ReturnValue: fmt.Sprintf("%x", ret),
+		StructLogs:  formatLogs(logger.StructLogs()),
+		StorageDiff: logger.diff(pre, db),
+	}, nil
+}
+
+// traceCalls replays the transaction txHash on its pre-state and returns its
+// call tree.
+func traceCalls(memdb *MemDatabase, rst byzcoin.ReadOnlyStateTrie, txHash common.Hash) (*CallFrame, error) {
+	tracer := newCallTracer()
+	_, _, _, _, err := replayTransaction(memdb, rst, txHash, tracer)
+	if err != nil {
+		return nil, err
+	}
+	tree := tracer.CallTree()
+	if tree == nil {
+		return nil, errors.New("the transaction didn't execute")
+	}
+	return tree, nil
+}
+
+// replayTransaction applies the transaction txHash again on its pre-state,
+// with tracer, the system contracts reading rst. It returns the stored
+// receipt, the receipt of the replay, the return value and the state after
+// the replay.
+func replayTransaction(memdb *MemDatabase, rst byzcoin.ReadOnlyStateTrie, txHash common.Hash, tracer vm.Tracer) (*Receipt, *Receipt, []byte, *state.StateDB, error) {
+	receipt, err := getReceipt(memdb, txHash)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	if receipt.PreStateRoot == (common.Hash{}) {
+		return nil, nil, nil, nil, errors.New("the pre-state of the transaction is unknown")
+	}
+	tx, err := getTransaction(memdb, txHash)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	db, err := state.New(receipt.PreStateRoot, state.NewDatabase(memdb))
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	config := getVMConfig()
+	config.Debug = true
+	config.Tracer = tracer
+	//The transaction had enough gas when it was applied
+	replayed, ret, err := applyTransaction(tx, db, rst, config, tx.Gas())
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("couldn't replay the transaction: %v", err)
+	}
+	return receipt, replayed, ret, db, nil
+}
+
+// storageTracer is a struct logger that also records the storage slots
+// written by SSTORE, with the address of the contract they belong to.
+type storageTracer struct {
+	*vm.StructLogger
+	written map[common.Address]map[common.Hash]bool
+}
+
+func newStorageTracer(logger *vm.StructLogger) *storageTracer {
+	return &storageTracer{
+		StructLogger: logger,
+		written:      map[common.Address]map[common.Hash]bool{},
+	}
+}
+
+// CaptureState records the SSTOREs before passing the step to the struct
+// logger.
+func (st *storageTracer) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int, err error) error {
+	if op == vm.SSTORE && len(stack.Data()) >= 1 {
+		address := contract.Address()
+		if st.written[address] == nil {
+			st.written[address] = map[common.Hash]bool{}
+		}
+		st.written[address][common.BigToHash(stack.Back(0))] = true
+	}
+	return st.StructLogger.CaptureState(env, pc, op, gas, cost, memory, stack, contract, depth, err)
+}
+
+// diff returns the written slots whose value differs between pre and post.
+// Writes made by reverted calls are not in post, so they don't show up.
+func (st *storageTracer) diff(pre, post *state.StateDB) map[common.Address]map[common.Hash]StorageDiff {
+	diff := map[common.Address]map[common.Hash]StorageDiff{}
+	for address, slots := range st.written {
+		for slot := range slots {
+			before := pre.GetState(address, slot)
+			after := post.GetState(address, slot)
+			if before == after {
+				continue
+			}
+			if diff[address] == nil {
+				diff[address] = map[common.Hash]StorageDiff{}
+			}
+			diff[address][slot] = StorageDiff{Before: before, After: after}
+		}
+	}
+	return diff
+}
+
+// formatLogs formats the steps of the struct logger like go-ethereum does for
+// debug_traceTransaction.
+func formatLogs(logs []vm.StructLog) []StructLogRes {
+	formatted := make([]StructLogRes, len(logs))
+	for index, trace := range logs {
+		formatted[index] = StructLogRes{
+			Pc:      trace.Pc,
+			Op:      trace.Op.String(),
+			Gas:     trace.Gas,
+			GasCost: trace.GasCost,
+			Depth:   trace.Depth,
+		}
+		if trace.Err != nil {
+			formatted[index].Error = trace.Err.Error()
+		}
+		if trace.Stack != nil {
+			stack := make([]string, len(trace.Stack))
+			for i, value := range trace.Stack {
+				stack[i] = fmt.Sprintf("%x", padWord(value))
+			}
+			formatted[index].Stack = &stack
+		}
+		if trace.Memory != nil {
+			memory := make([]string, 0, (len(trace.Memory)+31)/32)
+			for i := 0; i+32 <= len(trace.Memory); i += 32 {
+				memory = append(memory, fmt.Sprintf("%x", trace.Memory[i:i+32]))
+			}
+			formatted[index].Memory = &memory
+		}
+		if trace.Storage != nil {
+			storage := make(map[string]string)
+			for i, storageValue := range trace.Storage {
+				storage[fmt.Sprintf("%x", i)] = fmt.Sprintf("%x", storageValue)
+			}
+			formatted[index].Storage = &storage
+		}
+	}
+	return formatted
+}
+
+// padWord pads a stack value to 32 bytes.
+func padWord(value *big.Int) []byte {
+	return common.LeftPadBytes(value.Bytes(), 32)
+}
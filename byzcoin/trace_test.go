@@ -0,0 +1,50 @@
+package byzcoin
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/stretchr/testify/require"
+)
+
+//Traces a MinimumToken transfer replayed on its pre-state
+func TestTraceTransaction(t *testing.T) {
+	token, memdb, db := deployToken(t)
+	contractAddress := token.address
+	es, err := commitES(memdb, db)
+	require.Nil(t, err)
+
+	//Applies the transfer the same way the transaction instruction does
+	gasLimit, gasPrice := transactionGasParameters()
+	tx := token.signTx(t, types.NewTransaction(1, contractAddress, big.NewInt(0), gasLimit, gasPrice, token.transfer(t, token.addressB, 10)))
+	es, receipt := sendStored(t, es, tx)
+
+	memdb, _, err = getDB(es)
+	require.Nil(t, err)
+	trace, err := traceTransaction(memdb, nil, tx.Hash(), &vm.LogConfig{DisableMemory: true})
+	require.Nil(t, err)
+	require.False(t, trace.Failed)
+	require.Equal(t, receipt.GasUsed, trace.Gas)
+	require.NotEmpty(t, trace.StructLogs)
+	sstores := 0
+	for _, step := range trace.StructLogs {
+		require.Nil(t, step.Memory)
+		require.NotNil(t, step.Stack)
+		if step.Op == "SSTORE" {
+			sstores++
+		}
+	}
+	require.Equal(t, 2, sstores)
+	//The balances of A and B changed
+	require.Equal(t, 2, len(trace.StorageDiff[contractAddress]))
+	for _, diff := range trace.StorageDiff[contractAddress] {
+		require.NotEqual(t, diff.Before, diff.After)
+	}
+
+	//Tracing doesn't change the state
+	_, db, err = getDB(es)
+	require.Nil(t, err)
+	require.Equal(t, uint64(2), db.GetNonce(token.addressA))
+}
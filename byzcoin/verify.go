@@ -0,0 +1,149 @@
+package byzcoin
+
+import (
+	"errors"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/darc"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Two system contracts let the contracts authorize the users of the
+// ledger, whose identities are Ed25519 keys and darcs.
+//
+// The one at Ed25519VerifyAddress verifies an Ed25519 signature. Its input
+// is the 32 bytes public key, the 64 bytes signature and the message, and
+// it returns 1 as a 32 bytes word if the signature is valid, 0 otherwise.
+//
+// The one at DarcRuleAddress tells whether an identity satisfies a rule of
+// a darc of the ledger. Its input is the ABI encoding of
+//
+//	(bytes32 darcID, string action, bytes identity)
+//
+// where identity is either a 32 bytes Ed25519 public key or the string of a
+// darc identity, like "darc:<hex ID>". It returns 1 if the identity
+// satisfies the rule, 0 otherwise. Like the system contract reading the
+// instances, it reads the state trie of the bvmState of the EVM. It reads
+// at most maxDarcRuleReads darcs, so that the cost of an evaluation is
+// bounded whatever the depth of the darcs.
+//
+// Like the one reading the instances, they only run when called, a
+// contract hashing their input doesn't skip their base gas.
+
+var (
+	// Ed25519VerifyAddress is the address of the system contract verifying
+	// Ed25519 signatures.
+	Ed25519VerifyAddress = common.HexToAddress("0x00000000000000000000000000000000000000b3")
+	// DarcRuleAddress is the address of the system contract evaluating
+	// darc rules.
+	DarcRuleAddress = common.HexToAddress("0x00000000000000000000000000000000000000b4")
+)
+
+const (
+	// ed25519VerifyGas is the base cost of a verification
+	ed25519VerifyGas = uint64(2000)
+	// darcRuleGas is the base cost of evaluating a rule
+	darcRuleGas = uint64(5000)
+	// maxDarcRuleReads is the highest number of darcs read by the
+	// evaluation of a rule
+	maxDarcRuleReads = 16
+)
+
+var darcRuleInput abi.Arguments
+
+func init() {
+	for _, t := range []string{"bytes32", "string", "bytes"} {
+		typ, err := abi.NewType(t)
+		if err != nil {
+			panic(err)
+		}
+		darcRuleInput = append(darcRuleInput, abi.Argument{Type: typ})
+	}
+}
+
+var (
+	hostTrue  = common.LeftPadBytes([]byte{1}, 32)
+	hostFalse = make([]byte, 32)
+)
+
+// verifyEd25519 is the host function of Ed25519VerifyAddress.
+func verifyEd25519(rst byzcoin.ReadOnlyStateTrie, input []byte) ([]byte, error) {
+	if len(input) < 96 {
+		return nil, errors.New("the input must hold a public key and a signature")
+	}
+	point := cothority.Suite.Point()
+	if err := point.UnmarshalBinary(input[:32]); err != nil {
+		return hostFalse, nil
+	}
+	if darc.NewIdentityEd25519(point).Verify(input[96:], input[32:96]) != nil {
+		return hostFalse, nil
+	}
+	return hostTrue, nil
+}
+
+// evalDarcRuleInput is the host function of DarcRuleAddress.
+func evalDarcRuleInput(rst byzcoin.ReadOnlyStateTrie, input []byte) ([]byte, error) {
+	if rst == nil {
+		return nil, errors.New("no byzcoin state")
+	}
+	values, err := darcRuleInput.UnpackValues(input)
+	if err != nil {
+		return nil, err
+	}
+	darcID := values[0].([32]byte)
+	action := values[1].(string)
+	identity := values[2].([]byte)
+	if evalDarcRule(rst, darcID[:], darc.Action(action), identity) != nil {
+		return hostFalse, nil
+	}
+	return hostTrue, nil
+}
+
+// evalDarcRule returns an error if identity doesn't satisfy the rule action
+// of the darc darcID. A 32 bytes identity is an Ed25519 public key.
+func evalDarcRule(rst byzcoin.ReadOnlyStateTrie, darcID darc.ID, action darc.Action, identity []byte) error {
+	id := string(identity)
+	if len(identity) == 32 {
+		point := cothority.Suite.Point()
+		if err := point.UnmarshalBinary(identity); err != nil {
+			return err
+		}
+		id = darc.NewIdentityEd25519(point).String()
+	}
+	d, err := byzcoin.LoadDarcFromTrie(rst, darcID)
+	if err != nil {
+		return err
+	}
+	expr := d.Rules.Get(action)
+	if expr == nil {
+		return errors.New("the darc has no " + string(action) + " rule")
+	}
+	// The darcs of the rule are read by a getter giving up after
+	// maxDarcRuleReads darcs
+	reads := 1
+	getDarc := darcGetter(rst)
+	bounded := func(s string, latest bool) *darc.Darc {
+		if reads >= maxDarcRuleReads {
+			return nil
+		}
+		reads++
+		return getDarc(s, latest)
+	}
+	return darc.EvalExpr(expr, bounded, id)
+}
+
+// evalRule returns an error if the identities ids don't satisfy the rule
+// action of the darc darcID.
+func evalRule(rst byzcoin.ReadOnlyStateTrie, darcID darc.ID, action darc.Action, ids ...string) error {
+	d, err := byzcoin.LoadDarcFromTrie(rst, darcID)
+	if err != nil {
+		return err
+	}
+	expr := d.Rules.Get(action)
+	if expr == nil {
+		return errors.New("the darc has no " + string(action) + " rule")
+	}
+	return darc.EvalExpr(expr, darcGetter(rst), ids...)
+}
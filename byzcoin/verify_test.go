@@ -0,0 +1,152 @@
+package byzcoin
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/darc/expression"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/stretchr/testify/require"
+)
+
+//Verifies Ed25519 signatures and evaluates darc rules from the EVM
+func TestVerifySystemContracts(t *testing.T) {
+	_, db, err := getDB(ES{DbBuf: []byte{}})
+	require.Nil(t, err)
+	call := func(to common.Address, input []byte, rst byzcoin.ReadOnlyStateTrie) ([]byte, bool) {
+		msg := types.NewMessage(nilAddress, &to, 0, big.NewInt(0), 1e6, big.NewInt(0), input, false)
+		ret, _, failed, err := applyMessage(db.Copy(), rst, msg)
+		require.Nil(t, err)
+		return ret, failed
+	}
+
+	signer := darc.NewSignerEd25519(nil, nil)
+	other := darc.NewSignerEd25519(nil, nil)
+	public, err := signer.Ed25519.Point.MarshalBinary()
+	require.Nil(t, err)
+	otherPublic, err := other.Ed25519.Point.MarshalBinary()
+	require.Nil(t, err)
+	msg := []byte("withdraw 10 coins")
+	sig, err := signer.Sign(msg)
+	require.Nil(t, err)
+
+	input := append(append(append([]byte{}, public...), sig...), msg...)
+	ret, failed := call(Ed25519VerifyAddress, input, nil)
+	require.False(t, failed)
+	require.Equal(t, hostTrue, ret)
+	input[len(input)-1]++
+	ret, failed = call(Ed25519VerifyAddress, input, nil)
+	require.False(t, failed)
+	require.Equal(t, hostFalse, ret)
+	_, failed = call(Ed25519VerifyAddress, public, nil)
+	require.True(t, failed)
+
+	//The darc allows signer to vote
+	rules := darc.NewRules()
+	require.Nil(t, rules.AddRule("invoke:vote", expression.Expr(signer.Identity().String())))
+	d := darc.NewDarc(rules, []byte("voters"))
+	darcBuf, err := d.ToProto()
+	require.Nil(t, err)
+	rst := newMemStateTrie()
+	rst.apply([]byzcoin.StateChange{
+		byzcoin.NewStateChange(byzcoin.Create, byzcoin.NewInstanceID(d.GetBaseID()), byzcoin.ContractDarcID, darcBuf, d.GetBaseID()),
+	})
+	var darcID [32]byte
+	copy(darcID[:], d.GetBaseID())
+	evalRule := func(action string, identity []byte) ([]byte, bool) {
+		input, err := darcRuleInput.Pack(darcID, action, identity)
+		require.Nil(t, err)
+		return call(DarcRuleAddress, input, rst)
+	}
+	ret, failed = evalRule("invoke:vote", public)
+	require.False(t, failed)
+	require.Equal(t, hostTrue, ret)
+	ret, _ = evalRule("invoke:vote", []byte(signer.Identity().String()))
+	require.Equal(t, hostTrue, ret)
+	ret, _ = evalRule("invoke:vote", otherPublic)
+	require.Equal(t, hostFalse, ret)
+	ret, _ = evalRule("invoke:count", public)
+	require.Equal(t, hostFalse, ret)
+
+	//Without a state trie the call fails
+	input, err = darcRuleInput.Pack(darcID, "invoke:vote", public)
+	require.Nil(t, err)
+	_, failed = call(DarcRuleAddress, input, nil)
+	require.True(t, failed)
+}
+
+//The verifications and the rule evaluations cost their base gas, hashing their input in a contract gives nothing
+func TestVerifyCosts(t *testing.T) {
+	_, db, err := getDB(ES{DbBuf: []byte{}})
+	require.Nil(t, err)
+	signer := darc.NewSignerEd25519(nil, nil)
+	public, err := signer.Ed25519.Point.MarshalBinary()
+	require.Nil(t, err)
+	sig, err := signer.Sign([]byte("vote"))
+	require.Nil(t, err)
+	verifyInput := append(append(append([]byte{}, public...), sig...), []byte("vote")...)
+
+	//A chain of darcs, each allowing the previous one to vote and sign, the first one allowing signer
+	rst := newMemStateTrie()
+	newDarc := func(expr expression.Expr) [32]byte {
+		rules := darc.NewRules()
+		require.Nil(t, rules.AddRule("invoke:vote", expr))
+		require.Nil(t, rules.AddRule(darc.Action("_sign"), expr))
+		d := darc.NewDarc(rules, []byte(expr))
+		buf, err := d.ToProto()
+		require.Nil(t, err)
+		rst.apply([]byzcoin.StateChange{
+			byzcoin.NewStateChange(byzcoin.Create, byzcoin.NewInstanceID(d.GetBaseID()), byzcoin.ContractDarcID, buf, d.GetBaseID()),
+		})
+		var id [32]byte
+		copy(id[:], d.GetBaseID())
+		return id
+	}
+	chain := [][32]byte{newDarc(expression.Expr(signer.Identity().String()))}
+	for i := 0; i < maxDarcRuleReads; i++ {
+		next := chain[len(chain)-1]
+		chain = append(chain, newDarc(expression.Expr(darc.NewIdentityDarc(next[:]).String())))
+	}
+	ruleInput := func(id [32]byte) []byte {
+		input, err := darcRuleInput.Pack(id, "invoke:vote", public)
+		require.Nil(t, err)
+		return input
+	}
+
+	call := func(to common.Address, input []byte) ([]byte, uint64) {
+		msg := types.NewMessage(nilAddress, &to, 0, big.NewInt(0), 1e6, big.NewInt(0), input, false)
+		ret, gas, failed, err := applyMessage(db, rst, msg)
+		require.Nil(t, err)
+		require.False(t, failed)
+		return ret, gas
+	}
+	ret, gas := call(Ed25519VerifyAddress, verifyInput)
+	require.Equal(t, hostTrue, ret)
+	require.True(t, gas > params.TxGas+ed25519VerifyGas/burnLoopGas*burnLoopGas)
+	ret, gas = call(DarcRuleAddress, ruleInput(chain[2]))
+	require.Equal(t, hostTrue, ret)
+	require.True(t, gas > params.TxGas+darcRuleGas/burnLoopGas*burnLoopGas)
+
+	//The evaluation gives up after maxDarcRuleReads darcs
+	ret, _ = call(DarcRuleAddress, ruleInput(chain[maxDarcRuleReads-1]))
+	require.Equal(t, hostTrue, ret)
+	ret, _ = call(DarcRuleAddress, ruleInput(chain[maxDarcRuleReads]))
+	require.Equal(t, hostFalse, ret)
+
+	//Returns the code size of the address made of the hash of the call data
+	hasher := common.HexToAddress("0x4a54")
+	db.SetCode(hasher, []byte{
+		byte(vm.CALLDATASIZE), byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.CALLDATACOPY),
+		byte(vm.CALLDATASIZE), byte(vm.PUSH1), 0, byte(vm.SHA3), byte(vm.EXTCODESIZE),
+		byte(vm.PUSH1), 0, byte(vm.MSTORE), byte(vm.PUSH1), 32, byte(vm.PUSH1), 0, byte(vm.RETURN),
+	})
+	ret, _ = call(hasher, append(common.LeftPadBytes(Ed25519VerifyAddress.Bytes(), 32), verifyInput...))
+	require.Equal(t, make([]byte, 32), ret)
+	ret, _ = call(hasher, append(common.LeftPadBytes(DarcRuleAddress.Bytes(), 32), ruleInput(chain[2])...))
+	require.Equal(t, make([]byte, 32), ret)
+}
@@ -0,0 +1,165 @@
+package byzcoin
+
+import (
+	"errors"
+	"math/big"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/byzcoin/contracts"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/protobuf"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Withdrawals take ether out of the bvm. Accounts and contracts send the
+// ether to WithdrawAddress, with the 32 bytes ID of a coin instance as data.
+// The system contract at WithdrawAddress only accepts whole coins and logs
+// the withdrawal. Once the transaction succeeded, the ether is burnt and
+// the coin instance is credited by a state change of the instruction.
+//
+// The darc of the coin instance must allow the signers of the instruction
+// to invoke:withdraw, and the coins must have been deposited before,
+// otherwise the whole instruction fails.
+
+// WithdrawAddress is the address of the system contract receiving the
+// withdrawals.
+var WithdrawAddress = common.HexToAddress("0x00000000000000000000000000000000000000b1")
+
+// WithdrawRule is the rule of the darc of a coin instance that allows
+// withdrawals to it.
+var WithdrawRule = darc.Action("invoke:withdraw")
+
+// withdrawTopic is the topic of the log of a withdrawal, the second topic is
+// the coin instance and the data the value in wei.
+var withdrawTopic = crypto.Keccak256Hash([]byte("Withdraw(bytes32,uint256)"))
+
+// withdrawCode returns the code of the system contract. It reverts unless
+// the data is 32 bytes long and the value a multiple of WeiPerCoin, and
+// otherwise logs the withdrawal.
+func withdrawCode() []byte {
+	const fail = 92
+	code := []byte{
+		byte(vm.CALLDATASIZE), byte(vm.PUSH1), 32, byte(vm.EQ), byte(vm.ISZERO),
+		byte(vm.PUSH1), fail, byte(vm.JUMPI),
+		byte(vm.PUSH32),
+	}
+	code = append(code, common.BigToHash(WeiPerCoin).Bytes()...)
+	code = append(code,
+		byte(vm.CALLVALUE), byte(vm.MOD), byte(vm.PUSH1), fail, byte(vm.JUMPI),
+		// The value is the data of the log
+		byte(vm.CALLVALUE), byte(vm.PUSH1), 0, byte(vm.MSTORE),
+		// LOG2(0, 32, withdrawTopic, coin instance)
+		byte(vm.PUSH1), 0, byte(vm.CALLDATALOAD),
+		byte(vm.PUSH32))
+	code = append(code, withdrawTopic.Bytes()...)
+	code = append(code,
+		byte(vm.PUSH1), 32, byte(vm.PUSH1), 0, byte(vm.LOG2), byte(vm.STOP),
+		byte(vm.JUMPDEST), byte(vm.PUSH1), 0, byte(vm.DUP1), byte(vm.REVERT))
+	if code[fail] != byte(vm.JUMPDEST) {
+		panic("wrong jump destination in the withdraw code")
+	}
+	return code
+}
+
+// installWithdraw deploys the system contract at WithdrawAddress, if it is
+// not there yet, and tells whether it did.
+func installWithdraw(db *state.StateDB) bool {
+	if db.GetCodeSize(WithdrawAddress) != 0 {
+		return false
+	}
+	db.SetCode(WithdrawAddress, withdrawCode())
+	return true
+}
+
+// withdrawal is the ether sent to a coin instance by a transaction.
+type withdrawal struct {
+	coinID byzcoin.InstanceID
+	wei    *big.Int
+}
+
+// withdrawals returns the withdrawals logged by the system contract in the
+// receipt, added up by coin instance.
+func withdrawals(r *Receipt) []withdrawal {
+	var ws []withdrawal
+	index := map[common.Hash]int{}
+	for _, l := range r.Logs {
+		if l.Address != WithdrawAddress || len(l.Topics) != 2 || l.Topics[0] != withdrawTopic {
+			continue
+		}
+		wei := new(big.Int).SetBytes(l.Data)
+		if wei.Sign() == 0 {
+			continue
+		}
+		if i, ok := index[l.Topics[1]]; ok {
+			ws[i].wei.Add(ws[i].wei, wei)
+			continue
+		}
+		index[l.Topics[1]] = len(ws)
+		ws = append(ws, withdrawal{coinID: byzcoin.NewInstanceID(l.Topics[1].Bytes()), wei: wei})
+	}
+	return ws
+}
+
+// applyWithdrawals burns the ether of the withdrawals, takes their coins
+// out of the deposited ones and returns the state changes crediting the coin
+// instances.
+func applyWithdrawals(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, memdb *MemDatabase, db *state.StateDB, ws []withdrawal) ([]byzcoin.StateChange, error) {
+	var sc []byzcoin.StateChange
+	for _, w := range ws {
+		value, _, contractID, darcID, err := rst.GetValues(w.coinID.Slice())
+		if err != nil {
+			return nil, err
+		}
+		if contractID != contracts.ContractCoinID {
+			return nil, errors.New("withdrawal to an instance that is not a coin")
+		}
+		err = checkWithdrawRule(rst, inst, darcID)
+		if err != nil {
+			return nil, err
+		}
+		var coin byzcoin.Coin
+		err = protobuf.Decode(value, &coin)
+		if err != nil {
+			return nil, err
+		}
+		coins := new(big.Int).Div(w.wei, WeiPerCoin)
+		if !coins.IsUint64() {
+			return nil, errors.New("too many coins withdrawn")
+		}
+		err = takeDeposited(memdb, coins.Uint64())
+		if err != nil {
+			return nil, err
+		}
+		err = coin.SafeAdd(coins.Uint64())
+		if err != nil {
+			return nil, err
+		}
+		coinBuf, err := protobuf.Encode(&coin)
+		if err != nil {
+			return nil, err
+		}
+		sc = append(sc, byzcoin.NewStateChange(byzcoin.Update, w.coinID, contracts.ContractCoinID, coinBuf, darcID))
+		db.SubBalance(WithdrawAddress, w.wei)
+	}
+	return sc, nil
+}
+
+// checkWithdrawRule returns an error if the signers of inst can't withdraw
+// to the coin instances guarded by the darc darcID.
+func checkWithdrawRule(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, darcID darc.ID) error {
+	var ids []string
+	for _, id := range inst.SignerIdentities {
+		ids = append(ids, id.String())
+	}
+	return evalRule(rst, darcID, WithdrawRule, ids...)
+}
+
+// Withdraw sends coins worth of ether from key to the coin instance coinID.
+func Withdraw(b Backend, key *Key, coinID byzcoin.InstanceID, coins uint64) (*types.Transaction, error) {
+	value := new(big.Int).Mul(new(big.Int).SetUint64(coins), WeiPerCoin)
+	return b.Transact(key, WithdrawAddress, value, coinID.Slice())
+}
@@ -0,0 +1,92 @@
+package byzcoin
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/darc/expression"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/require"
+)
+
+//Withdraws ether to coin instances, whose darcs must allow the signer
+func TestWithdraw(t *testing.T) {
+	sb, keyA := newFundedBackend(t)
+	defer sb.Close()
+
+	owner := []darc.Identity{sb.Signer.Identity()}
+	rules := darc.InitRules(owner, owner)
+	require.Nil(t, rules.AddRule(WithdrawRule, expression.Expr(sb.Signer.Identity().String())))
+	coinID, err := sb.NewCoin(rules)
+	require.Nil(t, err)
+	closedCoinID, err := sb.NewCoin(darc.InitRules(owner, owner))
+	require.Nil(t, err)
+
+	tx, err := Withdraw(sb, keyA, coinID, 2)
+	require.Nil(t, err)
+	coins, err := sb.Coins(coinID)
+	require.Nil(t, err)
+	require.Equal(t, uint64(2), coins)
+	r, err := sb.GetReceipt(tx.Hash())
+	require.Nil(t, err)
+	balance, err := sb.GetBalance(keyA.Address)
+	require.Nil(t, err)
+	spent := new(big.Int).Mul(big.NewInt(2), WeiPerCoin)
+	spent.Add(spent, new(big.Int).Mul(new(big.Int).SetUint64(r.GasUsed), sb.GasPrice))
+	require.Equal(t, new(big.Int).Sub(big.NewInt(1e18*5), spent), balance)
+	//The ether is burnt
+	balance, err = sb.GetBalance(WithdrawAddress)
+	require.Nil(t, err)
+	require.Equal(t, 0, balance.Sign())
+
+	//Only whole coins can be withdrawn
+	_, err = sb.Transact(keyA, WithdrawAddress, big.NewInt(1e9), coinID.Slice())
+	_, ok := err.(*RevertError)
+	require.True(t, ok)
+
+	//The darc of the coin has no withdraw rule, and the bvm instance is not a coin: the instructions fail
+	nonce, err := sb.GetNonce(keyA.Address)
+	require.Nil(t, err)
+	_, err = Withdraw(sb, keyA, closedCoinID, 1)
+	require.NotNil(t, err)
+	_, err = Withdraw(sb, keyA, sb.InstanceID, 1)
+	require.NotNil(t, err)
+	after, err := sb.GetNonce(keyA.Address)
+	require.Nil(t, err)
+	require.Equal(t, nonce, after)
+	coins, err = sb.Coins(closedCoinID)
+	require.Nil(t, err)
+	require.Equal(t, uint64(0), coins)
+
+	//Three deposited coins are left, the ether of the faucet can't take out more
+	privateB, err := crypto.GenerateKey()
+	require.Nil(t, err)
+	keyB := NewKeyFromECDSA(privateB)
+	require.Nil(t, sb.Invoke("credit", byzcoin.Arguments{{Name: "address", Value: []byte(keyB.Address.Hex())}}))
+	_, err = Withdraw(sb, keyB, coinID, 4)
+	require.NotNil(t, err)
+	_, err = Withdraw(sb, keyB, coinID, 3)
+	require.Nil(t, err)
+	coins, err = sb.Coins(coinID)
+	require.Nil(t, err)
+	require.Equal(t, uint64(5), coins)
+	_, err = Withdraw(sb, keyA, coinID, 1)
+	require.NotNil(t, err)
+}
+
+//The system contract installed before a transaction is part of the committed pre-state of the transaction
+func TestInstallWithdraw(t *testing.T) {
+	memdb, db, err := getDB(ES{DbBuf: []byte{}})
+	require.Nil(t, err)
+	require.True(t, installWithdraw(db))
+	require.False(t, installWithdraw(db))
+	root, err := commitState(db)
+	require.Nil(t, err)
+
+	pre, err := state.New(root, state.NewDatabase(memdb))
+	require.Nil(t, err)
+	require.Equal(t, withdrawCode(), pre.GetCode(WithdrawAddress))
+}